@@ -2,25 +2,79 @@ package app
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	commonHTTP "github.com/ThreeDotsLabs/go-event-driven/common/http"
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/components/cqrs"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
+	"strconv"
+	"strings"
 	"tickets/app/api"
+	"tickets/app/metrics"
+	"tickets/app/money"
+	"tickets/app/poison"
+	"tickets/app/redisstreams"
+	"tickets/app/repositories"
+	"tickets/app/webhooks"
+	"time"
 )
 
 type TicketsRequest struct {
-	Tickets []Ticket `json:"tickets"`
+	Tickets []TicketRequest `json:"tickets"`
 }
 
-func handleTicket(ctx context.Context, ticket Ticket, idempotencyKey string, bus *cqrs.EventBus) error {
+// TicketRequest keeps the price as it was sent, so a missing currency gets DefaultCurrency before the price is parsed.
+type TicketRequest struct {
+	TicketID      string       `json:"ticket_id"`
+	Status        TicketStatus `json:"status"`
+	CustomerEmail string       `json:"customer_email"`
+	Price         PriceRequest `json:"price"`
+}
+
+type PriceRequest struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (r TicketRequest) ticket() (Ticket, error) {
+	currency := r.Price.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+
+	price, err := money.Parse(r.Price.Amount, currency)
+	if err != nil {
+		return Ticket{}, fmt.Errorf("invalid price of ticket %s: %w", r.TicketID, err)
+	}
+
+	return Ticket{
+		TicketID:      r.TicketID,
+		Status:        r.Status,
+		CustomerEmail: r.CustomerEmail,
+		Price:         price,
+	}, nil
+}
+
+type RefundTicketRequest struct {
+	Reason string `json:"reason"`
+}
+
+type WebhookSubscriptionRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+func handleTicket(ctx context.Context, ticket Ticket, header EventHeader, bus *cqrs.EventBus) error {
 	event := TicketEvent{
 		Ticket: &ticket,
-		Header: NewEventHandlerWithIdempotencyKey(idempotencyKey),
+		Header: header,
 	}
 
 	switch ticket.Status {
@@ -45,17 +99,30 @@ func handleTicket(ctx context.Context, ticket Ticket, idempotencyKey string, bus
 
 type NewServerInput struct {
 	EventBus       *cqrs.EventBus
+	CommandBus     *cqrs.CommandBus
 	TicketsService api.TicketsService
-	Logger         watermill.LoggerAdapter
+	PoisonService  poison.Service
+	Webhooks       *webhooks.Service
+	// StreamJanitor is nil when the Pub/Sub backend is not redis.
+	StreamJanitor *redisstreams.Janitor
+	// AdminToken is the bearer token of the admin and webhook endpoints, they reject every request when it's empty.
+	AdminToken string
+	Logger     watermill.LoggerAdapter
 }
 
 func NewServer(input NewServerInput) *echo.Echo {
 	e := commonHTTP.NewEcho()
+	e.Use(httpTracing)
+	e.Use(httpMetrics)
 
 	e.GET("/health", func(c echo.Context) error {
 		return c.String(http.StatusOK, "ok")
 	})
 
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+
+	admin := requireAdminToken(input.AdminToken)
+
 	e.POST("/tickets-status", func(c echo.Context) error {
 		var request TicketsRequest
 		err := c.Bind(&request)
@@ -63,18 +130,23 @@ func NewServer(input NewServerInput) *echo.Echo {
 			return err
 		}
 
-		correlationId := c.Request().Header.Get("Correlation-ID")
-		if correlationId == "" {
-			correlationId = watermill.NewUUID()
-		}
+		correlationId := correlationIDFromRequest(c)
+		idempotencyKey := idempotencyKeyFromRequest(c)
 
-		idempotencyKey := c.Request().Header.Get("Idempotency-Key")
-		if idempotencyKey == "" {
-			idempotencyKey = fmt.Sprintf("gen_%s", uuid.NewString())
+		ctx := log.ContextWithCorrelationID(c.Request().Context(), correlationId)
+
+		tickets := make([]Ticket, 0, len(request.Tickets))
+		for _, ticketRequest := range request.Tickets {
+			ticket, err := ticketRequest.ticket()
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			tickets = append(tickets, ticket)
 		}
 
-		for _, ticket := range request.Tickets {
-			err := handleTicket(context.Background(), ticket, idempotencyKey, input.EventBus)
+		for _, ticket := range tickets {
+			// every ticket gets its own header, so each event has a unique ID
+			err := handleTicket(ctx, ticket, NewEventHeader(correlationId, idempotencyKey), input.EventBus)
 			if err != nil {
 				return c.String(http.StatusBadRequest, err.Error())
 			}
@@ -84,7 +156,16 @@ func NewServer(input NewServerInput) *echo.Echo {
 	})
 
 	e.GET("/tickets", func(c echo.Context) error {
-		tickets, err := input.TicketsService.GetAll(context.Background())
+		includeCanceled := false
+		if param := c.QueryParam("include_canceled"); param != "" {
+			parsed, err := strconv.ParseBool(param)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "invalid include_canceled")
+			}
+			includeCanceled = parsed
+		}
+
+		tickets, err := input.TicketsService.GetAll(context.Background(), includeCanceled)
 		if err != nil {
 			return c.String(http.StatusInternalServerError, "internal error")
 		}
@@ -92,5 +173,265 @@ func NewServer(input NewServerInput) *echo.Echo {
 		return c.JSON(http.StatusOK, tickets)
 	})
 
+	e.POST("/admin/tickets/:id/refund", func(c echo.Context) error {
+		var request RefundTicketRequest
+		err := c.Bind(&request)
+		if err != nil {
+			return err
+		}
+
+		exists, err := ticketExists(c.Request().Context(), input.TicketsService, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return c.String(http.StatusNotFound, repositories.ErrTicketNotFound.Error())
+		}
+
+		if request.Reason == "" {
+			request.Reason = "refund requested by admin"
+		}
+
+		err = input.CommandBus.Send(c.Request().Context(), RefundTicket{
+			Header:   NewEventHeader(correlationIDFromRequest(c), idempotencyKeyFromRequest(c)),
+			TicketID: c.Param("id"),
+			Reason:   request.Reason,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}, admin)
+
+	e.POST("/admin/tickets/:id/print", func(c echo.Context) error {
+		exists, err := ticketExists(c.Request().Context(), input.TicketsService, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return c.String(http.StatusNotFound, repositories.ErrTicketNotFound.Error())
+		}
+
+		err = input.CommandBus.Send(c.Request().Context(), PrintTicket{
+			Header:   NewEventHeader(correlationIDFromRequest(c), idempotencyKeyFromRequest(c)),
+			TicketID: c.Param("id"),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}, admin)
+
+	e.GET("/admin/poison", func(c echo.Context) error {
+		limit := int64(100)
+		if param := c.QueryParam("limit"); param != "" {
+			parsed, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || parsed <= 0 {
+				return c.String(http.StatusBadRequest, "invalid limit")
+			}
+			limit = parsed
+		}
+
+		messages, err := input.PoisonService.List(c.Request().Context(), limit)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, messages)
+	}, admin)
+
+	e.POST("/admin/poison/:id/requeue", func(c echo.Context) error {
+		err := input.PoisonService.Requeue(c.Request().Context(), poison.RequeueInput{
+			ID:      c.Param("id"),
+			Handler: c.QueryParam("handler"),
+			Actor:   adminActor(c),
+		})
+		if errors.Is(err, poison.ErrMessageNotFound) {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}, admin)
+
+	e.DELETE("/admin/poison/:id", func(c echo.Context) error {
+		err := input.PoisonService.Discard(c.Request().Context(), poison.DiscardInput{
+			ID:    c.Param("id"),
+			Actor: adminActor(c),
+		})
+		if errors.Is(err, poison.ErrMessageNotFound) {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}, admin)
+
+	e.GET("/admin/streams", func(c echo.Context) error {
+		if input.StreamJanitor == nil {
+			return c.String(http.StatusNotImplemented, "streams are only available with the redis Pub/Sub backend")
+		}
+
+		stats, err := input.StreamJanitor.Stats(c.Request().Context())
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, stats)
+	}, admin)
+
+	e.POST("/webhooks", func(c echo.Context) error {
+		var request WebhookSubscriptionRequest
+		err := c.Bind(&request)
+		if err != nil {
+			return err
+		}
+
+		subscription, err := input.Webhooks.Subscribe(c.Request().Context(), webhooks.SubscribeInput{
+			URL:    request.URL,
+			Events: request.Events,
+			Secret: request.Secret,
+		})
+		if errors.Is(err, webhooks.ErrInvalidSubscription) {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, subscription)
+	}, admin)
+
+	e.GET("/webhooks/:id/deliveries", func(c echo.Context) error {
+		limit := 100
+		if param := c.QueryParam("limit"); param != "" {
+			parsed, err := strconv.Atoi(param)
+			if err != nil || parsed <= 0 {
+				return c.String(http.StatusBadRequest, "invalid limit")
+			}
+			limit = parsed
+		}
+
+		_, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusNotFound, repositories.ErrWebhookSubscriptionNotFound.Error())
+		}
+
+		deliveries, err := input.Webhooks.Deliveries(c.Request().Context(), c.Param("id"), limit)
+		if errors.Is(err, repositories.ErrWebhookSubscriptionNotFound) {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, deliveries)
+	}, admin)
+
 	return e
 }
+
+func correlationIDFromRequest(c echo.Context) string {
+	correlationId := c.Request().Header.Get("Correlation-ID")
+	if correlationId == "" {
+		correlationId = watermill.NewUUID()
+	}
+
+	return correlationId
+}
+
+func idempotencyKeyFromRequest(c echo.Context) string {
+	idempotencyKey := c.Request().Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = fmt.Sprintf("gen_%s", uuid.NewString())
+	}
+
+	return idempotencyKey
+}
+
+// ticketExists checks the ticket of an admin command before it's sent,
+// a command for a ticket which is not stored would only fail in the handler, after the request was accepted.
+func ticketExists(ctx context.Context, tickets api.TicketsService, ticketID string) (bool, error) {
+	_, err := uuid.Parse(ticketID)
+	if err != nil {
+		return false, nil
+	}
+
+	_, err = tickets.Get(ctx, ticketID)
+	if errors.Is(err, repositories.ErrTicketNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// requireAdminToken lets through requests with the token in the "Authorization: Bearer" header.
+func requireAdminToken(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			provided, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if token == "" || !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				return c.String(http.StatusUnauthorized, "unauthorized")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// adminActor identifies who performed an admin action for the audit log.
+func adminActor(c echo.Context) string {
+	actor := c.Request().Header.Get("Admin-User")
+	if actor == "" {
+		return "unknown"
+	}
+
+	return actor
+}
+
+// httpMetrics reports the latency of every request in metrics.HTTPRequestDuration, by route template
+// so the IDs in paths don't make a series each.
+func httpMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		err := next(c)
+
+		status := responseStatus(c, err)
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		metrics.HTTPRequestDuration.
+			WithLabelValues(c.Request().Method, route, strconv.Itoa(status)).
+			Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// responseStatus returns the status of the response to a request handled with err,
+// the error is turned into the response only after the middlewares return.
+func responseStatus(c echo.Context, err error) int {
+	if err == nil {
+		return c.Response().Status
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+
+	return http.StatusInternalServerError
+}
@@ -2,32 +2,36 @@ package api
 
 import (
 	"context"
-	"strconv"
+	"tickets/app/money"
 	"tickets/app/repositories"
+	"time"
 )
 
-type PriceDTO struct {
-	Amount   string `json:"amount"`
-	Currency string `json:"currency"`
-}
-
 type TicketDTO struct {
-	TicketID      string   `json:"ticket_id"`
-	CustomerEmail string   `json:"customer_email"`
-	Price         PriceDTO `json:"price"`
+	TicketID      string      `json:"ticket_id"`
+	Status        string      `json:"status"`
+	CustomerEmail string      `json:"customer_email"`
+	Price         money.Money `json:"price"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+	CanceledAt    *time.Time  `json:"canceled_at,omitempty"`
 }
 type TicketsService interface {
-	GetAll(ctx context.Context) ([]TicketDTO, error)
+	// GetAll returns canceled tickets only when includeCanceled is set.
+	GetAll(ctx context.Context, includeCanceled bool) ([]TicketDTO, error)
+	// Get returns repositories.ErrTicketNotFound when the ticket is not stored.
+	Get(ctx context.Context, ticketID string) (TicketDTO, error)
 }
 
 func NewTicketFromRepo(repoTicket repositories.Ticket) TicketDTO {
 	return TicketDTO{
 		TicketID:      repoTicket.TicketID,
+		Status:        string(repoTicket.Status),
 		CustomerEmail: repoTicket.CustomerEmail,
-		Price: PriceDTO{
-			Amount:   strconv.FormatFloat(repoTicket.PriceAmount, 'f', 2, 64),
-			Currency: repoTicket.PriceCurrency,
-		},
+		Price:         repoTicket.Price,
+		CreatedAt:     repoTicket.CreatedAt,
+		UpdatedAt:     repoTicket.UpdatedAt,
+		CanceledAt:    repoTicket.CanceledAt,
 	}
 }
 
@@ -45,8 +49,8 @@ func NewTicketsService(input NewTicketsServiceInput) TicketsService {
 	}
 }
 
-func (s *ticketService) GetAll(ctx context.Context) ([]TicketDTO, error) {
-	tickets, err := s.ticketRepository.GetAll(ctx)
+func (s *ticketService) GetAll(ctx context.Context, includeCanceled bool) ([]TicketDTO, error) {
+	tickets, err := s.ticketRepository.GetAll(ctx, repositories.TicketsFilter{IncludeCanceled: includeCanceled})
 	if err != nil {
 		return nil, err
 	}
@@ -58,3 +62,12 @@ func (s *ticketService) GetAll(ctx context.Context) ([]TicketDTO, error) {
 
 	return ticketsDTO, err
 }
+
+func (s *ticketService) Get(ctx context.Context, ticketID string) (TicketDTO, error) {
+	ticket, err := s.ticketRepository.Get(ctx, ticketID)
+	if err != nil {
+		return TicketDTO{}, err
+	}
+
+	return NewTicketFromRepo(ticket), nil
+}
@@ -5,10 +5,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
+const tracerShutdownTimeout = time.Second * 5
+
 type App struct {
 	Dependencies *Dependencies
 	ErrGroup     *errgroup.Group
@@ -64,6 +67,12 @@ func (a *App) Run() {
 	router := a.Dependencies.Router
 	server := a.Dependencies.Server
 	db := a.Dependencies.db
+	processedMessagesCleaner := a.Dependencies.ProcessedMessagesCleaner
+	scheduler := a.Dependencies.Scheduler
+	bookingSaga := a.Dependencies.BookingSaga
+	webhooksService := a.Dependencies.Webhooks
+	streamJanitor := a.Dependencies.StreamJanitor
+	tracerProvider := a.Dependencies.TracerProvider
 
 	errgrp.Go(func() error {
 		// we don't want to start HTTP server before Watermill router (so service won't be healthy before it's ready)
@@ -82,25 +91,62 @@ func (a *App) Run() {
 		return router.Run(ctx)
 	})
 
-	// close
 	errgrp.Go(func() error {
-		<-ctx.Done()
+		return processedMessagesCleaner.Run(ctx)
+	})
 
-		return router.Close()
+	errgrp.Go(func() error {
+		return scheduler.Run(ctx)
 	})
 
+	errgrp.Go(func() error {
+		return bookingSaga.Run(ctx)
+	})
+
+	errgrp.Go(func() error {
+		return webhooksService.Run(ctx)
+	})
+
+	if streamJanitor != nil {
+		errgrp.Go(func() error {
+			return streamJanitor.Run(ctx)
+		})
+	}
+
+	// close
 	errgrp.Go(func() error {
 		<-ctx.Done()
 
-		return db.Close()
+		return router.Close()
 	})
 
+	if db != nil {
+		// the in-memory mode runs without a database
+		errgrp.Go(func() error {
+			<-ctx.Done()
+
+			return db.Close()
+		})
+	}
+
 	errgrp.Go(func() error {
 		<-ctx.Done()
 
 		return server.Close()
 	})
 
+	if tracerProvider != nil {
+		errgrp.Go(func() error {
+			<-ctx.Done()
+
+			// the spans of the last seconds are still buffered
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+			defer cancel()
+
+			return tracerProvider.Shutdown(shutdownCtx)
+		})
+	}
+
 	err := errgrp.Wait()
 	if err != nil && err != context.Canceled {
 		panic(err)
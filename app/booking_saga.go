@@ -0,0 +1,297 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"tickets/app/circuitbreaker"
+	"tickets/app/receipts"
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	defaultBookingSagaTimeout       = time.Minute * 15
+	defaultBookingSagaCheckInterval = time.Minute
+	bookingSagaTimeoutBatchSize     = 100
+)
+
+// bookingSagaSteps maps the TicketBookingConfirmed handlers to the saga steps they perform.
+var bookingSagaSteps = map[string]repositories.TicketSagaStep{
+	"store-confirmed":          repositories.TicketSagaStepStore,
+	"issues-receipt":           repositories.TicketSagaStepReceipt,
+	"print-ticket":             repositories.TicketSagaStepPrint,
+	"create-confirmation-file": repositories.TicketSagaStepFile,
+}
+
+type NewBookingSagaInput struct {
+	Sagas              repositories.TicketSagasRepository
+	TicketsRepo        repositories.TicketsRepository
+	ReceiptsClient     receipts.ReceiptsClientInterface
+	SpreadsheetsClient SpreadsheetsClientInterface
+	EventBus           *cqrs.EventBus
+	Marshaler          cqrs.CommandEventMarshaler
+	Timeout            time.Duration
+	CheckInterval      time.Duration
+}
+
+// BookingSaga is the process manager of a confirmed booking: it tracks the steps done by the
+// TicketBookingConfirmed handlers in ticket_sagas, and when one of them fails for good or doesn't finish
+// in time, it compensates the steps which already succeeded.
+type BookingSaga struct {
+	sagas              repositories.TicketSagasRepository
+	ticketsRepo        repositories.TicketsRepository
+	receiptsClient     receipts.ReceiptsClientInterface
+	spreadsheetsClient SpreadsheetsClientInterface
+	eventBus           *cqrs.EventBus
+	marshaler          cqrs.CommandEventMarshaler
+	timeout            time.Duration
+	checkInterval      time.Duration
+}
+
+func NewBookingSaga(input NewBookingSagaInput) *BookingSaga {
+	if input.Timeout == 0 {
+		input.Timeout = defaultBookingSagaTimeout
+	}
+	if input.CheckInterval == 0 {
+		input.CheckInterval = defaultBookingSagaCheckInterval
+	}
+
+	return &BookingSaga{
+		sagas:              input.Sagas,
+		ticketsRepo:        input.TicketsRepo,
+		receiptsClient:     input.ReceiptsClient,
+		spreadsheetsClient: input.SpreadsheetsClient,
+		eventBus:           input.EventBus,
+		marshaler:          input.Marshaler,
+		timeout:            input.Timeout,
+		checkInterval:      input.CheckInterval,
+	}
+}
+
+// Middleware records the outcome of the saga steps. It must wrap the retry middleware,
+// so an error seen here means the step failed for good.
+func (s *BookingSaga) Middleware(next message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		step, ok := bookingSagaSteps[message.HandlerNameFromCtx(msg.Context())]
+		if !ok {
+			return next(msg)
+		}
+
+		// the payload is read before the handler runs, as inner middlewares may rewrite it
+		event := TicketBookingConfirmed{}
+		unmarshalErr := s.marshaler.Unmarshal(msg, &event)
+		if unmarshalErr != nil || event.TicketEvent == nil || event.Ticket == nil {
+			// the handler fails the same way, but the failure can't be recorded without the ticket
+			log.FromContext(msg.Context()).
+				WithError(unmarshalErr).
+				WithField("message_uuid", msg.UUID).
+				WithField("saga_step", step).
+				Error("Booking saga can't track a step of a message which is not a booking")
+
+			return next(msg)
+		}
+
+		messages, err := next(msg)
+		if errors.Is(err, circuitbreaker.ErrOpen) {
+			// the step didn't fail, it's redelivered once the circuit closes
+			return messages, err
+		}
+		if err != nil {
+			sagaErr := s.failStep(msg.Context(), event, step, err.Error())
+			if sagaErr != nil {
+				log.FromContext(msg.Context()).WithError(sagaErr).Error("Could not record failed saga step")
+			}
+
+			return messages, err
+		}
+
+		saga, err := s.sagas.CompleteStep(msg.Context(), sagaStart(event), step)
+		if err != nil {
+			return nil, fmt.Errorf("could not record saga step %s: %w", step, err)
+		}
+
+		if saga.Status == repositories.TicketSagaStatusCompensating || saga.Status == repositories.TicketSagaStatusCompensated {
+			// the step finished after the saga failed, so it has to be compensated as well
+			return messages, s.publishFailed(msg.Context(), NewChildEventHeader(event.Header), saga, "step completed after saga failure")
+		}
+
+		return messages, nil
+	}
+}
+
+func (s *BookingSaga) Handlers() []cqrs.EventHandler {
+	startSaga := cqrs.NewEventHandler[TicketBookingConfirmed]("start-booking-saga", func(ctx context.Context, event *TicketBookingConfirmed) error {
+		return s.sagas.Start(ctx, sagaStart(*event))
+	})
+
+	compensateBooking := cqrs.NewEventHandler[BookingSagaFailed]("compensate-booking", func(ctx context.Context, event *BookingSagaFailed) error {
+		return s.compensate(ctx, event)
+	})
+
+	return []cqrs.EventHandler{
+		startSaga,
+		compensateBooking,
+	}
+}
+
+// Run fails the sagas which didn't finish in time until ctx is done.
+func (s *BookingSaga) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		err := s.failTimedOut(ctx)
+		if err != nil {
+			log.FromContext(ctx).WithError(err).Error("Could not fail timed out booking sagas")
+		}
+	}
+}
+
+func (s *BookingSaga) failTimedOut(ctx context.Context) error {
+	sagas, err := s.sagas.FindTimedOut(ctx, time.Now().Add(-s.timeout), bookingSagaTimeoutBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, saga := range sagas {
+		step := repositories.TicketSagaStepStore
+		for _, sagaStep := range repositories.TicketSagaSteps {
+			if !saga.StepCompleted(sagaStep) {
+				step = sagaStep
+				break
+			}
+		}
+
+		start := repositories.TicketSagaStart{TicketID: saga.TicketID}
+		failed, ok, err := s.sagas.FailStep(ctx, start, step, "step timed out")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		// the failure is part of the booking, it's correlated with the confirmation
+		correlationID := saga.CorrelationID
+		if correlationID == "" {
+			correlationID = watermill.NewUUID()
+		}
+		header := NewEventHeader(correlationID, saga.IdempotencyKey)
+		err = s.publishFailed(ctx, header, failed, "step timed out")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *BookingSaga) failStep(ctx context.Context, event TicketBookingConfirmed, step repositories.TicketSagaStep, reason string) error {
+	saga, failed, err := s.sagas.FailStep(ctx, sagaStart(event), step, reason)
+	if err != nil {
+		return err
+	}
+	if !failed {
+		return nil
+	}
+
+	return s.publishFailed(ctx, NewChildEventHeader(event.Header), saga, reason)
+}
+
+func (s *BookingSaga) publishFailed(ctx context.Context, header EventHeader, saga repositories.TicketSaga, reason string) error {
+	failedStep := ""
+	if saga.FailedStep != nil {
+		failedStep = *saga.FailedStep
+	}
+
+	return s.eventBus.Publish(ctx, BookingSagaFailed{
+		Header:     header,
+		TicketID:   saga.TicketID,
+		FailedStep: failedStep,
+		Reason:     reason,
+	})
+}
+
+// compensate undoes every succeeded step which wasn't compensated yet, so it can be called again
+// when a step finishes after the saga failed.
+func (s *BookingSaga) compensate(ctx context.Context, event *BookingSagaFailed) error {
+	saga, err := s.sagas.Get(ctx, event.TicketID)
+	if errors.Is(err, repositories.ErrTicketSagaNotFound) {
+		log.FromContext(ctx).WithField("ticket_id", event.TicketID).Warn("Nothing to compensate, saga not found")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if saga.ReceiptIssuedAt != nil && saga.ReceiptVoidedAt == nil {
+		err = s.receiptsClient.VoidReceipt(ctx, receipts.VoidReceiptRequest{
+			TicketID:       saga.TicketID,
+			Reason:         fmt.Sprintf("booking failed at step %s", event.FailedStep),
+			IdempotencyKey: saga.IdempotencyKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = s.sagas.MarkCompensated(ctx, saga.TicketID, repositories.TicketSagaCompensationVoidReceipt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if saga.PrintedAt != nil && saga.RefundAppendedAt == nil {
+		err = s.spreadsheetsClient.AppendRow(ctx, "tickets-to-refund", []string{
+			saga.TicketID,
+			saga.CustomerEmail,
+			saga.PriceAmount,
+			saga.PriceCurrency,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = s.sagas.MarkCompensated(ctx, saga.TicketID, repositories.TicketSagaCompensationAppendRefund)
+		if err != nil {
+			return err
+		}
+	}
+
+	if saga.StoredAt != nil && saga.TicketRemovedAt == nil {
+		err = s.ticketsRepo.Cancel(ctx, saga.TicketID, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		err = s.sagas.MarkCompensated(ctx, saga.TicketID, repositories.TicketSagaCompensationRemoveTicket)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.sagas.FinishCompensation(ctx, saga.TicketID)
+}
+
+func sagaStart(event TicketBookingConfirmed) repositories.TicketSagaStart {
+	return repositories.TicketSagaStart{
+		TicketID:       event.TicketID,
+		CustomerEmail:  event.CustomerEmail,
+		PriceAmount:    event.Price.Amount(),
+		PriceCurrency:  event.Price.Currency(),
+		IdempotencyKey: event.Header.IdempotencyKey,
+		CorrelationID:  event.Header.CorrelationID,
+	}
+}
@@ -0,0 +1,397 @@
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tickets/app"
+	"tickets/app/circuitbreaker"
+	"tickets/app/money"
+	"tickets/app/receipts"
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBookingSagaCompensatesStepFailedAfterRetries(t *testing.T) {
+	sagas := repositories.NewMemoryTicketSagasRepository()
+	tickets := repositories.NewMemoryTicketsRepository()
+	receiptsService := &receipts.ServiceMock{}
+
+	printAttempts := atomic.Int64{}
+	_, bus, _ := runBookingSaga(t, app.NewBookingSagaInput{
+		Sagas:          sagas,
+		TicketsRepo:    tickets,
+		ReceiptsClient: receiptsService,
+	}, func(context.Context, *app.TicketBookingConfirmed) error {
+		printAttempts.Add(1)
+		return errors.New("spreadsheets are down")
+	})
+
+	ticketID := uuid.NewString()
+	publishBookingConfirmed(t, bus, ticketID, app.NewEventHeader(uuid.NewString(), uuid.NewString()))
+
+	saga := waitForSagaStatus(t, sagas, ticketID, repositories.TicketSagaStatusCompensated)
+	require.NotNil(t, saga.FailedStep)
+	assert.Equal(t, string(repositories.TicketSagaStepPrint), *saga.FailedStep)
+	// the first attempt and 2 retries
+	assert.EqualValues(t, 3, printAttempts.Load())
+
+	assertBookingCompensated(t, sagas, tickets, receiptsService, ticketID)
+}
+
+func TestBookingSagaCompensatesTimedOutSaga(t *testing.T) {
+	sagas := repositories.NewMemoryTicketSagasRepository()
+	tickets := repositories.NewMemoryTicketsRepository()
+	receiptsService := &receipts.ServiceMock{}
+
+	// print-ticket is not registered, so the saga never finishes
+	_, bus, pubSub := runBookingSaga(t, app.NewBookingSagaInput{
+		Sagas:          sagas,
+		TicketsRepo:    tickets,
+		ReceiptsClient: receiptsService,
+		Timeout:        time.Millisecond * 100,
+		CheckInterval:  time.Millisecond * 20,
+	}, nil)
+
+	failedEvents, err := pubSub.Subscribe(context.Background(), "BookingSagaFailed.v1")
+	require.NoError(t, err)
+
+	ticketID := uuid.NewString()
+	header := app.NewEventHeader(uuid.NewString(), uuid.NewString())
+	publishBookingConfirmed(t, bus, ticketID, header)
+
+	saga := waitForSagaStatus(t, sagas, ticketID, repositories.TicketSagaStatusCompensated)
+	require.NotNil(t, saga.FailureReason)
+	assert.Equal(t, "step timed out", *saga.FailureReason)
+	require.NotNil(t, saga.FailedStep)
+	assert.Equal(t, string(repositories.TicketSagaStepPrint), *saga.FailedStep)
+
+	assertBookingCompensated(t, sagas, tickets, receiptsService, ticketID)
+
+	select {
+	case msg := <-failedEvents:
+		msg.Ack()
+		// the failure is correlated with the booking
+		assert.Equal(t, header.CorrelationID, msg.Metadata.Get("correlation_id"))
+	case <-time.After(time.Second):
+		t.Fatal("BookingSagaFailed not published")
+	}
+}
+
+func TestBookingSagaCompensationIsIdempotent(t *testing.T) {
+	sagas := repositories.NewMemoryTicketSagasRepository()
+	tickets := repositories.NewMemoryTicketsRepository()
+	receiptsService := &receipts.ServiceMock{}
+
+	saga, bus, _ := runBookingSaga(t, app.NewBookingSagaInput{
+		Sagas:          sagas,
+		TicketsRepo:    tickets,
+		ReceiptsClient: receiptsService,
+	}, func(context.Context, *app.TicketBookingConfirmed) error {
+		return errors.New("spreadsheets are down")
+	})
+
+	ticketID := uuid.NewString()
+	publishBookingConfirmed(t, bus, ticketID, app.NewEventHeader(uuid.NewString(), uuid.NewString()))
+	waitForSagaStatus(t, sagas, ticketID, repositories.TicketSagaStatusCompensated)
+
+	ticket, err := tickets.Get(context.Background(), ticketID)
+	require.NoError(t, err)
+	require.NotNil(t, ticket.CanceledAt)
+
+	var compensateBooking cqrs.EventHandler
+	for _, handler := range saga.Handlers() {
+		if handler.HandlerName() == "compensate-booking" {
+			compensateBooking = handler
+		}
+	}
+	require.NotNil(t, compensateBooking)
+
+	// compensate-booking gets BookingSagaFailed redelivered
+	for i := 0; i < 2; i++ {
+		err := compensateBooking.Handle(context.Background(), &app.BookingSagaFailed{
+			Header:     app.NewEventHeader(uuid.NewString(), uuid.NewString()),
+			TicketID:   ticketID,
+			FailedStep: string(repositories.TicketSagaStepPrint),
+			Reason:     "redelivered",
+		})
+		require.NoError(t, err)
+	}
+
+	assertBookingCompensated(t, sagas, tickets, receiptsService, ticketID)
+
+	redeliveredTicket, err := tickets.Get(context.Background(), ticketID)
+	require.NoError(t, err)
+	assert.Equal(t, ticket.CanceledAt, redeliveredTicket.CanceledAt, "ticket canceled again")
+}
+
+func TestBookingSagaCircuitOpenDoesNotFailStep(t *testing.T) {
+	sagas := repositories.NewMemoryTicketSagasRepository()
+	receiptsService := &receipts.ServiceMock{}
+
+	printAttempts := atomic.Int64{}
+	_, bus, _ := runBookingSaga(t, app.NewBookingSagaInput{
+		Sagas:          sagas,
+		TicketsRepo:    repositories.NewMemoryTicketsRepository(),
+		ReceiptsClient: receiptsService,
+	}, func(context.Context, *app.TicketBookingConfirmed) error {
+		if printAttempts.Add(1) == 1 {
+			return &circuitbreaker.OpenError{Name: "spreadsheets", RetryAt: time.Now()}
+		}
+
+		return nil
+	})
+
+	ticketID := uuid.NewString()
+	publishBookingConfirmed(t, bus, ticketID, app.NewEventHeader(uuid.NewString(), uuid.NewString()))
+
+	var saga repositories.TicketSaga
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		var err error
+		saga, err = sagas.Get(context.Background(), ticketID)
+		if !assert.NoError(collectT, err) {
+			return
+		}
+		assert.True(collectT, saga.StepCompleted(repositories.TicketSagaStepPrint), "print step not completed")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// open circuits are redelivered, not retried
+	assert.EqualValues(t, 2, printAttempts.Load())
+	assert.Equal(t, repositories.TicketSagaStatusInProgress, saga.Status)
+	assert.Nil(t, saga.FailedStep)
+	assert.Empty(t, receiptsService.VoidedReceipts)
+}
+
+func TestBookingSagaTracksBookingWithoutCurrency(t *testing.T) {
+	sagas := repositories.NewMemoryTicketSagasRepository()
+
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+
+	_, _, pubSub := runBookingSaga(t, app.NewBookingSagaInput{
+		Sagas:          sagas,
+		TicketsRepo:    repositories.NewMemoryTicketsRepository(),
+		ReceiptsClient: &receipts.ServiceMock{},
+	}, nil)
+
+	ticketID := uuid.NewString()
+	msg, err := cqrs.JSONMarshaler{GenerateName: events.Name}.Marshal(app.TicketBookingConfirmed{
+		TicketEvent: &app.TicketEvent{
+			Header: app.NewEventHeader(uuid.NewString(), uuid.NewString()),
+			Ticket: &app.Ticket{
+				TicketID: ticketID,
+				Status:   app.TicketStatusConfirmed,
+				Price:    money.MustParse("50.00", "USD"),
+			},
+		},
+	})
+	require.NoError(t, err)
+	msg.Payload = bytes.Replace(msg.Payload, []byte(`"currency":"USD"`), []byte(`"currency":""`), 1)
+	require.Contains(t, string(msg.Payload), `"currency":""`)
+
+	require.NoError(t, pubSub.Publish("TicketBookingConfirmed", msg))
+
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		saga, err := sagas.Get(context.Background(), ticketID)
+		if !assert.NoError(collectT, err) {
+			return
+		}
+		assert.True(collectT, saga.StepCompleted(repositories.TicketSagaStepStore), "store step not completed")
+		assert.True(collectT, saga.StepCompleted(repositories.TicketSagaStepReceipt), "receipt step not completed")
+		assert.Equal(collectT, app.DefaultCurrency, saga.PriceCurrency)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// runBookingSaga runs the saga with the middlewares of the app around the handlers of its steps store-confirmed,
+// issues-receipt, and print-ticket when printTicket is not nil. Bookings are published with the returned bus,
+// or directly to the returned Pub/Sub.
+func runBookingSaga(
+	t *testing.T,
+	input app.NewBookingSagaInput,
+	printTicket func(ctx context.Context, event *app.TicketBookingConfirmed) error,
+) (*app.BookingSaga, *cqrs.EventBus, *gochannel.GoChannel) {
+	t.Helper()
+
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+	topics := app.TopicStrategy{Events: events}
+	marshaler := cqrs.JSONMarshaler{GenerateName: events.Name}
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+
+	bus, err := cqrs.NewEventBusWithConfig(pubSub, cqrs.EventBusConfig{
+		Marshaler: marshaler,
+		GeneratePublishTopic: func(params cqrs.GenerateEventPublishTopicParams) (string, error) {
+			return topics.EventTopic(params.EventName)
+		},
+		// like the bus of the app, so injectCorrelationId reads the correlation ID of the booking
+		OnPublish: func(params cqrs.OnEventSendParams) error {
+			if event, ok := params.Event.(interface{ GetHeader() app.EventHeader }); ok {
+				params.Message.Metadata.Set("correlation_id", event.GetHeader().CorrelationID)
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	input.EventBus = bus
+	input.Marshaler = marshaler
+	input.SpreadsheetsClient = &app.SpreadsheetsClientMock{Sheets: make(map[string][][]string)}
+	saga := app.NewBookingSaga(input)
+
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+
+	unknownTypes, err := app.NewUnknownTypeFilter(app.NewUnknownTypeFilterInput{
+		Policy:     app.UnknownTypeDrop,
+		Registries: []*app.MessageRegistry{events},
+	})
+	require.NoError(t, err)
+
+	err = app.InjectMiddlewares(app.InjectMiddlewaresInput{
+		Router:           router,
+		Logger:           log.NewWatermill(logrus.NewEntry(logrus.StandardLogger())),
+		Publisher:        pubSub,
+		PoisonQueueTopic: "PoisonQueue",
+		BookingSaga:      saga,
+		Policies: app.NewHandlerPolicies(app.HandlerPolicy{
+			MaxRetries:      2,
+			InitialInterval: time.Millisecond,
+			MaxInterval:     time.Millisecond,
+			Poison:          app.PoisonDrop,
+		}),
+		Registries:   []*app.MessageRegistry{events},
+		UnknownTypes: unknownTypes,
+		Normalizer:   app.NewTicketPayloadNormalizer(events),
+	})
+	require.NoError(t, err)
+
+	processor, err := cqrs.NewEventProcessorWithConfig(router, cqrs.EventProcessorConfig{
+		GenerateSubscribeTopic: func(params cqrs.EventProcessorGenerateSubscribeTopicParams) (string, error) {
+			return topics.EventTopic(params.EventName)
+		},
+		SubscriberConstructor: func(cqrs.EventProcessorSubscriberConstructorParams) (message.Subscriber, error) {
+			return pubSub, nil
+		},
+		Marshaler: marshaler,
+	})
+	require.NoError(t, err)
+
+	handlers := []cqrs.EventHandler{
+		cqrs.NewEventHandler("store-confirmed", func(ctx context.Context, event *app.TicketBookingConfirmed) error {
+			return input.TicketsRepo.Put(ctx, repositories.Ticket{
+				TicketID:    event.TicketID,
+				Price:       event.Price,
+				LastEventAt: event.Header.PublishedAt,
+			})
+		}),
+		cqrs.NewEventHandler("issues-receipt", func(ctx context.Context, event *app.TicketBookingConfirmed) error {
+			return input.ReceiptsClient.IssueReceipt(ctx, receipts.IssueReceiptRequest{TicketID: event.TicketID})
+		}),
+	}
+	if printTicket != nil {
+		handlers = append(handlers, cqrs.NewEventHandler("print-ticket", printTicket))
+	}
+	require.NoError(t, processor.AddHandlers(append(handlers, saga.Handlers()...)...))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() {
+		_ = router.Run(ctx)
+	}()
+	if input.Timeout != 0 {
+		go func() {
+			_ = saga.Run(ctx)
+		}()
+	}
+	<-router.Running()
+
+	return saga, bus, pubSub
+}
+
+func publishBookingConfirmed(t *testing.T, bus *cqrs.EventBus, ticketID string, header app.EventHeader) {
+	t.Helper()
+
+	err := bus.Publish(context.Background(), app.TicketBookingConfirmed{
+		TicketEvent: &app.TicketEvent{
+			Header: header,
+			Ticket: &app.Ticket{
+				TicketID: ticketID,
+				Status:   app.TicketStatusConfirmed,
+				Price:    money.MustParse("50.00", "USD"),
+			},
+		},
+	})
+	require.NoError(t, err)
+}
+
+func waitForSagaStatus(
+	t *testing.T,
+	sagas repositories.TicketSagasRepository,
+	ticketID string,
+	status repositories.TicketSagaStatus,
+) repositories.TicketSaga {
+	t.Helper()
+
+	var saga repositories.TicketSaga
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		var err error
+		saga, err = sagas.Get(context.Background(), ticketID)
+		if !assert.NoError(collectT, err) {
+			return
+		}
+		assert.Equal(collectT, status, saga.Status)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return saga
+}
+
+// assertBookingCompensated checks the receipt was voided once and the ticket was canceled.
+func assertBookingCompensated(
+	t *testing.T,
+	sagas repositories.TicketSagasRepository,
+	tickets repositories.TicketsRepository,
+	receiptsService *receipts.ServiceMock,
+	ticketID string,
+) {
+	t.Helper()
+
+	// the steps may finish after the saga failed, and are compensated then
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		saga, err := sagas.Get(context.Background(), ticketID)
+		if !assert.NoError(collectT, err) {
+			return
+		}
+		assert.NotNil(collectT, saga.StoredAt)
+		assert.NotNil(collectT, saga.ReceiptIssuedAt)
+		assert.NotNil(collectT, saga.ReceiptVoidedAt)
+		assert.NotNil(collectT, saga.TicketRemovedAt)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	voided := 0
+	for _, receipt := range receiptsService.VoidedReceipts {
+		if receipt.TicketID == ticketID {
+			voided++
+		}
+	}
+	assert.Equal(t, 1, voided, "receipt voided once")
+
+	ticket, err := tickets.Get(context.Background(), ticketID)
+	require.NoError(t, err)
+	assert.Equal(t, repositories.TicketStatusCanceled, ticket.Status)
+	assert.NotNil(t, ticket.CanceledAt)
+}
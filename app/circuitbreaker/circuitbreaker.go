@@ -0,0 +1,196 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+// OpenError is returned when a call is not let through, it matches ErrOpen with errors.Is.
+type OpenError struct {
+	Name string
+	// RetryAt is when probing calls are let through, it's in the past while a probing call is in progress.
+	RetryAt time.Time
+}
+
+func (e *OpenError) Error() string {
+	if e.Name == "" {
+		return ErrOpen.Error()
+	}
+
+	return fmt.Sprintf("circuit breaker %s is open", e.Name)
+}
+
+func (e *OpenError) Is(target error) bool {
+	return target == ErrOpen
+}
+
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half_open"
+)
+
+type Config struct {
+	// Name identifies the protected dependency in errors, it's optional.
+	Name string
+	// FailureThreshold is the number of consecutive failures which opens the circuit.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before probing requests are let through.
+	OpenTimeout time.Duration
+	// HalfOpenMaxRequests is the number of probing requests let through at the same time when half open.
+	HalfOpenMaxRequests int
+}
+
+var DefaultConfig = Config{
+	FailureThreshold:    5,
+	OpenTimeout:         time.Second * 30,
+	HalfOpenMaxRequests: 1,
+}
+
+// Breaker stops calls to a failing dependency for OpenTimeout after FailureThreshold consecutive failures,
+// then lets probing calls through and closes again after the first success.
+type Breaker struct {
+	config Config
+	now    func() time.Time
+
+	lock             sync.Mutex
+	state            State
+	failures         int
+	openedAt         time.Time
+	halfOpenRequests int
+}
+
+func New(config Config) *Breaker {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultConfig.FailureThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultConfig.OpenTimeout
+	}
+	if config.HalfOpenMaxRequests <= 0 {
+		config.HalfOpenMaxRequests = DefaultConfig.HalfOpenMaxRequests
+	}
+
+	return &Breaker{
+		config: config,
+		now:    time.Now,
+		state:  StateClosed,
+	}
+}
+
+// Allow returns an *OpenError when the call shouldn't be made, otherwise the outcome has to be reported
+// with Success, Failure or Ignore.
+func (b *Breaker) Allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.currentState() {
+	case StateOpen:
+		return b.openError()
+	case StateHalfOpen:
+		if b.halfOpenRequests >= b.config.HalfOpenMaxRequests {
+			return b.openError()
+		}
+		b.halfOpenRequests++
+	}
+
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.state = StateClosed
+	b.failures = 0
+	b.halfOpenRequests = 0
+}
+
+func (b *Breaker) Failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.currentState() == StateHalfOpen {
+		b.open()
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.config.FailureThreshold {
+		b.open()
+	}
+}
+
+// Ignore reports a call whose outcome says nothing about the dependency, like one canceled by the caller.
+// It only frees the slot of a probing call, so the next one can be let through.
+func (b *Breaker) Ignore() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.currentState() == StateHalfOpen && b.halfOpenRequests > 0 {
+		b.halfOpenRequests--
+	}
+}
+
+// Execute calls fn when the circuit allows it and reports its outcome.
+func (b *Breaker) Execute(fn func() error) error {
+	err := b.Allow()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	if err != nil {
+		b.Failure()
+		return err
+	}
+
+	b.Success()
+
+	return nil
+}
+
+func (b *Breaker) State() State {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.currentState()
+}
+
+// RetryAt is the time when an open circuit lets probing calls through.
+func (b *Breaker) RetryAt() time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state != StateOpen {
+		return b.now()
+	}
+
+	return b.openedAt.Add(b.config.OpenTimeout)
+}
+
+func (b *Breaker) currentState() State {
+	if b.state == StateOpen && !b.now().Before(b.openedAt.Add(b.config.OpenTimeout)) {
+		b.state = StateHalfOpen
+		b.halfOpenRequests = 0
+	}
+
+	return b.state
+}
+
+func (b *Breaker) openError() error {
+	return &OpenError{Name: b.config.Name, RetryAt: b.openedAt.Add(b.config.OpenTimeout)}
+}
+
+func (b *Breaker) open() {
+	b.state = StateOpen
+	b.openedAt = b.now()
+	b.failures = 0
+	b.halfOpenRequests = 0
+}
@@ -0,0 +1,61 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := New(Config{Name: "receipts", FailureThreshold: 2, OpenTimeout: time.Minute, HalfOpenMaxRequests: 1})
+	breaker.now = func() time.Time { return now }
+
+	failing := func() error { return errors.New("failed") }
+
+	assert.Error(t, breaker.Execute(failing))
+	assert.Equal(t, StateClosed, breaker.State())
+
+	assert.Error(t, breaker.Execute(failing))
+	assert.Equal(t, StateOpen, breaker.State())
+	assert.ErrorIs(t, breaker.Allow(), ErrOpen)
+	assert.Equal(t, now.Add(time.Minute), breaker.RetryAt())
+
+	var openErr *OpenError
+	require.ErrorAs(t, breaker.Allow(), &openErr)
+	assert.Equal(t, "receipts", openErr.Name)
+	assert.Equal(t, now.Add(time.Minute), openErr.RetryAt)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, StateHalfOpen, breaker.State())
+	require.NoError(t, breaker.Allow())
+	assert.ErrorIs(t, breaker.Allow(), ErrOpen, "only one probe is let through")
+
+	breaker.Failure()
+	assert.Equal(t, StateOpen, breaker.State(), "failed probe opens the circuit again")
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, breaker.Execute(func() error { return nil }))
+	assert.Equal(t, StateClosed, breaker.State())
+}
+
+func TestBreakerIgnore(t *testing.T) {
+	now := time.Now()
+	breaker := New(Config{FailureThreshold: 1, OpenTimeout: time.Minute, HalfOpenMaxRequests: 1})
+	breaker.now = func() time.Time { return now }
+
+	require.NoError(t, breaker.Allow())
+	breaker.Ignore()
+	assert.Equal(t, StateClosed, breaker.State())
+
+	breaker.Failure()
+	now = now.Add(time.Minute)
+
+	require.NoError(t, breaker.Allow())
+	breaker.Ignore()
+	assert.Equal(t, StateHalfOpen, breaker.State())
+	assert.NoError(t, breaker.Allow(), "ignored probe frees its slot")
+}
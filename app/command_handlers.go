@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"tickets/app/receipts"
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/clients/files"
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+)
+
+type injectCommandHandlersInput struct {
+	receiptsClient     receipts.ReceiptsClientInterface
+	ticketsRepo        repositories.TicketsRepository
+	spreadsheetsClient SpreadsheetsClientInterface
+	filesClient        files.ClientWithResponsesInterface
+	processedMessages  repositories.ProcessedMessagesRepository
+	eventBus           *cqrs.EventBus
+	policies           *HandlerPolicies
+}
+
+func injectCommandHandlers(input injectCommandHandlersInput, cp *cqrs.CommandProcessor) error {
+	ticketsRepo := input.ticketsRepo
+
+	refundTicket := NewExactlyOnceCommandHandler[RefundTicket]("refund-ticket", input.processedMessages, func(ctx context.Context, command *RefundTicket) error {
+		ticket, err := ticketsRepo.Get(ctx, command.TicketID)
+		if errors.Is(err, repositories.ErrTicketNotFound) {
+			logUnknownTicket(ctx, command.TicketID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = input.receiptsClient.VoidReceipt(ctx, receipts.VoidReceiptRequest{
+			TicketID:       ticket.TicketID,
+			Reason:         command.Reason,
+			IdempotencyKey: command.Header.IdempotencyKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		return input.spreadsheetsClient.AppendRow(ctx, "tickets-to-refund", []string{
+			ticket.TicketID,
+			ticket.CustomerEmail,
+			ticket.Price.Amount(),
+			ticket.Price.Currency(),
+		})
+	})
+	input.policies.Set(refundTicket.HandlerName(), remoteCallPolicy)
+
+	reprintTicket := NewExactlyOnceCommandHandler[PrintTicket]("reprint-ticket", input.processedMessages, func(ctx context.Context, command *PrintTicket) error {
+		ticket, err := ticketsRepo.Get(ctx, command.TicketID)
+		if errors.Is(err, repositories.ErrTicketNotFound) {
+			logUnknownTicket(ctx, command.TicketID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// files are not overwritten, every reprint gets a file of its own
+		fileName := fmt.Sprintf("%s-ticket-%s.html", ticket.TicketID, command.Header.ID)
+		err = createTicketFile(ctx, input.filesClient, fileName)
+		if err != nil {
+			return err
+		}
+
+		return input.eventBus.Publish(ctx, TicketPrinted{
+			Header:   NewChildEventHeader(command.Header),
+			TicketID: ticket.TicketID,
+			FileName: fileName,
+		})
+	})
+	input.policies.Set(reprintTicket.HandlerName(), remoteCallPolicy)
+
+	return cp.AddHandlers(
+		refundTicket,
+		reprintTicket,
+	)
+}
+
+// logUnknownTicket reports a command for a ticket which is not stored, it's acked:
+// retries would fail the same way until the message ends up in the poison queue.
+func logUnknownTicket(ctx context.Context, ticketID string) {
+	log.FromContext(ctx).
+		WithField("ticket_id", ticketID).
+		Warn("Ticket of the command not found, skipping it")
+}
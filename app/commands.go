@@ -0,0 +1,39 @@
+package app
+
+type RefundTicket struct {
+	Header EventHeader `json:"header"`
+
+	TicketID string `json:"ticket_id"`
+	Reason   string `json:"reason"`
+}
+
+func (c RefundTicket) GetHeader() EventHeader {
+	return c.Header
+}
+
+type PrintTicket struct {
+	Header EventHeader `json:"header"`
+
+	TicketID string `json:"ticket_id"`
+}
+
+func (c PrintTicket) GetHeader() EventHeader {
+	return c.Header
+}
+
+// NewCommandRegistry registers the wire name of every command, changing a name or a version changes its topic.
+func NewCommandRegistry() (*MessageRegistry, error) {
+	registry := NewMessageRegistry()
+
+	for command, definition := range map[any]MessageDefinition{
+		RefundTicket{}: {Name: "RefundTicket", Version: 1},
+		PrintTicket{}:  {Name: "PrintTicket", Version: 1},
+	} {
+		err := registry.Register(command, definition)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
@@ -8,41 +8,105 @@ import (
 	"net/http"
 	"os"
 	"tickets/app/api"
+	"tickets/app/metrics"
+	"tickets/app/pii"
+	"tickets/app/poison"
 	"tickets/app/receipts"
+	"tickets/app/redisstreams"
 	"tickets/app/repositories"
+	"tickets/app/webhooks"
 
 	"github.com/ThreeDotsLabs/go-event-driven/common/clients"
 	"github.com/ThreeDotsLabs/go-event-driven/common/log"
-	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/labstack/echo/v4"
-	"github.com/redis/go-redis/v9"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type Dependencies struct {
-	ReceiptsClient     receipts.ReceiptsClientInterface
-	SpreadsheetsClient SpreadsheetsClientInterface
-	Router             *message.Router
-	EventProcessor     *cqrs.EventProcessor
-	Server             *echo.Echo
-	db                 *sqlx.DB
+	ReceiptsClient           receipts.ReceiptsClientInterface
+	SpreadsheetsClient       SpreadsheetsClientInterface
+	FilesClient              files.ClientWithResponsesInterface
+	Router                   *message.Router
+	EventBus                 *cqrs.EventBus
+	CommandBus               *cqrs.CommandBus
+	EventProcessor           *cqrs.EventProcessor
+	CommandProcessor         *cqrs.CommandProcessor
+	Server                   *echo.Echo
+	ProcessedMessagesCleaner *ProcessedMessagesCleaner
+	Scheduler                *Scheduler
+	BookingSaga              *BookingSaga
+	Webhooks                 *webhooks.Service
+	StreamJanitor            *redisstreams.Janitor
+	// TracerProvider is nil when spans are not exported.
+	TracerProvider *sdktrace.TracerProvider
+	db             *sqlx.DB
 }
 
 type BuildInput struct {
 	ReceiptsClient     receipts.ReceiptsClientInterface
 	SpreadsheetsClient SpreadsheetsClientInterface
 	FilesClient        files.ClientWithResponsesInterface
+	Repositories       Repositories
+	PubSubBackend      PubSubBackend
+	// PIIKeyring encrypts the PII fields of messages, they are sent in clear text when it's nil.
+	PIIKeyring *pii.Keyring
+	// CircuitBreakers default to DefaultGatewayCircuitBreakers.
+	CircuitBreakers *GatewayCircuitBreakers
+	// SpreadsheetsRateLimit defaults to DefaultSpreadsheetsRateLimit.
+	SpreadsheetsRateLimit *SpreadsheetsRateLimit
+	// SpreadsheetsBatching defaults to DefaultSpreadsheetsBatching.
+	SpreadsheetsBatching *SpreadsheetsBatching
+	// ProcessedMessagesCleanup defaults to DefaultProcessedMessagesCleanupPolicy.
+	ProcessedMessagesCleanup *ProcessedMessagesCleanupPolicy
+	// DB is nil when running in memory, the postgres Pub/Sub backend needs it.
+	DB *sqlx.DB
+}
+
+type Repositories struct {
+	Tickets           repositories.TicketsRepository
+	AuditLog          repositories.AuditLogRepository
+	ProcessedMessages repositories.ProcessedMessagesRepository
+	ScheduledMessages repositories.ScheduledMessagesRepository
+	TicketSagas       repositories.TicketSagasRepository
+	Webhooks          repositories.WebhooksRepository
+}
+
+func NewPostgresRepositories(db *sqlx.DB) Repositories {
+	return Repositories{
+		Tickets:           repositories.NewTicketsRepository(db),
+		AuditLog:          repositories.NewAuditLogRepository(db),
+		ProcessedMessages: repositories.NewProcessedMessagesRepository(db),
+		ScheduledMessages: repositories.NewScheduledMessagesRepository(db),
+		TicketSagas:       repositories.NewTicketSagasRepository(db),
+		Webhooks:          repositories.NewWebhooksRepository(db),
+	}
+}
+
+// NewMemoryRepositories don't need Postgres, but writes of a handler are not transactional.
+func NewMemoryRepositories() Repositories {
+	return Repositories{
+		Tickets:           repositories.NewMemoryTicketsRepository(),
+		AuditLog:          repositories.NewMemoryAuditLogRepository(),
+		ProcessedMessages: repositories.NewMemoryProcessedMessagesRepository(),
+		ScheduledMessages: repositories.NewMemoryScheduledMessagesRepository(),
+		TicketSagas:       repositories.NewMemoryTicketSagasRepository(),
+		Webhooks:          repositories.NewMemoryWebhooksRepository(),
+	}
 }
 
 func (d *Dependencies) Build() error {
-	clients, err := clients.NewClients(
+	clients, err := clients.NewClientsWithHttpClient(
 		os.Getenv("GATEWAY_ADDR"),
 		func(ctx context.Context, req *http.Request) error {
 			req.Header.Set("Correlation-ID", log.CorrelationIDFromContext(ctx))
 
 			return nil
-		})
+		},
+		NewInstrumentedHTTPClient(http.DefaultClient),
+	)
 	if err != nil {
 		return err
 	}
@@ -50,10 +114,64 @@ func (d *Dependencies) Build() error {
 	receiptsClient := receipts.NewReceiptsClient(clients)
 	spreadsheetsClient := NewSpreadsheetsClient(clients)
 
+	backend, err := ParsePubSubBackend(os.Getenv("PUBSUB_BACKEND"))
+	if err != nil {
+		return err
+	}
+
+	var keyring *pii.Keyring
+	if path := os.Getenv("PII_KEYRING_FILE"); path != "" {
+		keyring, err = pii.LoadKeyring(path)
+		if err != nil {
+			return err
+		}
+	} else {
+		logrus.Warn("PII_KEYRING_FILE is not set, PII fields of messages are not encrypted")
+	}
+
+	circuitBreakers, err := GatewayCircuitBreakersFromEnv()
+	if err != nil {
+		return err
+	}
+
+	spreadsheetsRateLimit, err := ParseSpreadsheetsRateLimit(os.Getenv("SPREADSHEETS_RATE_LIMIT"))
+	if err != nil {
+		return err
+	}
+
+	spreadsheetsBatching, err := ParseSpreadsheetsBatching(
+		os.Getenv("SPREADSHEETS_BATCH_SIZE"),
+		os.Getenv("SPREADSHEETS_BATCH_DELAY"),
+	)
+	if err != nil {
+		return err
+	}
+
+	processedMessagesCleanup, err := ParseProcessedMessagesCleanupPolicy(
+		os.Getenv("PROCESSED_MESSAGES_RETENTION"),
+		os.Getenv("PROCESSED_MESSAGES_CLEANUP_INTERVAL"),
+	)
+	if err != nil {
+		return err
+	}
+
+	db, err := sqlx.Open("postgres", os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		return err
+	}
+
 	err = d.build(BuildInput{
-		ReceiptsClient:     receiptsClient,
-		SpreadsheetsClient: spreadsheetsClient,
-		FilesClient:        clients.Files,
+		ReceiptsClient:           receiptsClient,
+		SpreadsheetsClient:       spreadsheetsClient,
+		FilesClient:              clients.Files,
+		Repositories:             NewPostgresRepositories(db),
+		PubSubBackend:            backend,
+		PIIKeyring:               keyring,
+		DB:                       db,
+		CircuitBreakers:          &circuitBreakers,
+		SpreadsheetsRateLimit:    &spreadsheetsRateLimit,
+		SpreadsheetsBatching:     &spreadsheetsBatching,
+		ProcessedMessagesCleanup: &processedMessagesCleanup,
 	})
 	if err != nil {
 		return err
@@ -62,57 +180,228 @@ func (d *Dependencies) Build() error {
 	return Migrate(d.db)
 }
 
+// BuildMock builds the dependencies in memory: mocked clients, in-memory repositories, gochannel Pub/Sub
+// and a generated PII key, so nothing has to be running. PUBSUB_BACKEND can still choose another Pub/Sub backend.
 func (d *Dependencies) BuildMock() error {
 	receiptsClient := receipts.ServiceMock{}
 	spreadsheetsClient := SpreadsheetsClientMock{
 		Sheets: make(map[string][][]string),
 	}
 
+	keyring, err := pii.GenerateKeyring()
+	if err != nil {
+		return err
+	}
+
+	backend := PubSubBackendGoChannel
+	if value := os.Getenv("PUBSUB_BACKEND"); value != "" {
+		backend, err = ParsePubSubBackend(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	var db *sqlx.DB
+	if backend == PubSubBackendPostgres {
+		db, err = sqlx.Open("postgres", os.Getenv("POSTGRES_URL"))
+		if err != nil {
+			return err
+		}
+	}
+
 	return d.build(BuildInput{
 		ReceiptsClient:     &receiptsClient,
 		SpreadsheetsClient: &spreadsheetsClient,
+		FilesClient:        NewFilesClientMock(),
+		Repositories:       NewMemoryRepositories(),
+		PubSubBackend:      backend,
+		PIIKeyring:         keyring,
+		DB:                 db,
 	})
 }
 
 func (d *Dependencies) build(input BuildInput) error {
-	db, err := sqlx.Open("postgres", os.Getenv("POSTGRES_URL"))
-	if err != nil {
-		return err
-	}
+	db := input.DB
 
-	ticketsRepo := repositories.NewTicketsRepository(db)
+	ticketsRepo := input.Repositories.Tickets
+	auditLogRepo := input.Repositories.AuditLog
+	processedMessagesRepo := input.Repositories.ProcessedMessages
+	scheduledMessagesRepo := input.Repositories.ScheduledMessages
+	ticketSagasRepo := input.Repositories.TicketSagas
+	webhooksRepo := input.Repositories.Webhooks
 	ticketsService := api.NewTicketsService(api.NewTicketsServiceInput{
 		TicketRepository: ticketsRepo,
 	})
 
-	receiptsClient := input.ReceiptsClient
-	spreadsheetsClient := input.SpreadsheetsClient
+	breakers := DefaultGatewayCircuitBreakers
+	if input.CircuitBreakers != nil {
+		breakers = *input.CircuitBreakers
+	}
+
+	spreadsheetsRateLimit := DefaultSpreadsheetsRateLimit
+	if input.SpreadsheetsRateLimit != nil {
+		spreadsheetsRateLimit = *input.SpreadsheetsRateLimit
+	}
+
+	spreadsheetsBatching := DefaultSpreadsheetsBatching
+	if input.SpreadsheetsBatching != nil {
+		spreadsheetsBatching = *input.SpreadsheetsBatching
+	}
+
+	processedMessagesCleanup := DefaultProcessedMessagesCleanupPolicy
+	if input.ProcessedMessagesCleanup != nil {
+		processedMessagesCleanup = *input.ProcessedMessagesCleanup
+	}
+
+	// handlers get the clients wrapped in circuit breakers, Dependencies keep the given ones;
+	// calls refused by an open circuit don't use up the rate limit
+	receiptsClient := NewReceiptsClientWithBreaker(input.ReceiptsClient, breakers.Receipts)
+	spreadsheetsClient := NewBatchingSpreadsheetsClient(
+		NewSpreadsheetsClientWithBreaker(
+			NewRateLimitedSpreadsheetsClient(input.SpreadsheetsClient, spreadsheetsRateLimit),
+			breakers.Spreadsheets,
+		),
+		spreadsheetsBatching,
+	)
+	filesClient := NewFilesClientWithBreaker(input.FilesClient, breakers.Files)
 
 	watermillLogger := log.NewWatermill(logrus.NewEntry(logrus.StandardLogger()))
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr: os.Getenv("REDIS_ADDR"),
+	tracesExporter, err := ParseTracesExporter(os.Getenv("TRACES_EXPORTER"))
+	if err != nil {
+		return err
+	}
+
+	tracerProvider, err := NewTracerProvider(context.Background(), NewTracerProviderInput{
+		Exporter: tracesExporter,
+		FilePath: os.Getenv("TRACES_FILE"),
 	})
+	if err != nil {
+		return err
+	}
+	SetupTracing(tracerProvider)
+
+	events, err := NewEventRegistry()
+	if err != nil {
+		return err
+	}
+
+	commands, err := NewCommandRegistry()
+	if err != nil {
+		return err
+	}
 
-	pub, err := redisstream.NewPublisher(redisstream.PublisherConfig{
-		Client: rdb,
-	}, watermillLogger)
+	topics := TopicStrategy{
+		Prefix:   os.Getenv("TOPIC_PREFIX"),
+		Events:   events,
+		Commands: commands,
+	}
+
+	redisReclaim, err := RedisReclaimConfigFromEnv(MaxHandlerBudget(breakers))
 	if err != nil {
 		return err
 	}
 
+	redisRetention, err := StreamRetentionFromEnv(topics)
+	if err != nil {
+		return err
+	}
+
+	pubSub, err := NewPubSub(NewPubSubInput{
+		Backend:          input.PubSubBackend,
+		RedisAddr:        os.Getenv("REDIS_ADDR"),
+		RedisReclaim:     redisReclaim,
+		RedisRetention:   redisRetention,
+		DB:               db,
+		PoisonQueueTopic: topics.PoisonQueueTopic(),
+		Logger:           watermillLogger,
+	})
+	if err != nil {
+		return err
+	}
+	pub := NewTracingPublisher(pubSub.Publisher)
+
+	if db != nil {
+		err = metrics.Register(collectors.NewDBStatsCollector(db.DB, "tickets"))
+		if err != nil {
+			return err
+		}
+	}
+	if pubSub.StreamJanitor != nil {
+		err = metrics.Register(redisstreams.NewStatsCollector(pubSub.StreamJanitor, metrics.Namespace))
+		if err != nil {
+			return err
+		}
+	}
+
+	eventMarshaler := pii.Marshaler{
+		CommandEventMarshaler: cqrs.JSONMarshaler{GenerateName: events.Name},
+		Keyring:               input.PIIKeyring,
+	}
+	commandMarshaler := pii.Marshaler{
+		CommandEventMarshaler: cqrs.JSONMarshaler{GenerateName: commands.Name},
+		Keyring:               input.PIIKeyring,
+	}
+
 	bus, err := cqrs.NewEventBusWithConfig(pub, cqrs.EventBusConfig{
-		Marshaler: cqrs.JSONMarshaler{GenerateName: cqrs.StructName},
+		Marshaler: eventMarshaler,
 		GeneratePublishTopic: func(params cqrs.GenerateEventPublishTopicParams) (string, error) {
-			return params.EventName, nil
+			return topics.EventTopic(params.EventName)
+		},
+		OnPublish: func(params cqrs.OnEventSendParams) error {
+			params.Message.Metadata.Set(MessageTypeKey, params.EventName)
+			return setCorrelationIdMetadata(params.Event, params.Message)
+		},
+		Logger: watermillLogger,
+	})
+	if err != nil {
+		return err
+	}
+
+	commandBus, err := cqrs.NewCommandBusWithConfig(pub, cqrs.CommandBusConfig{
+		Marshaler: commandMarshaler,
+		GeneratePublishTopic: func(params cqrs.CommandBusGeneratePublishTopicParams) (string, error) {
+			return topics.CommandTopic(params.CommandName)
+		},
+		OnSend: func(params cqrs.CommandBusOnSendParams) error {
+			params.Message.Metadata.Set(MessageTypeKey, params.CommandName)
+			return setCorrelationIdMetadata(params.Command, params.Message)
 		},
 		Logger: watermillLogger,
 	})
+	if err != nil {
+		return err
+	}
+
+	poisonService := poison.NewService(poison.NewServiceInput{
+		Queue:     pubSub.PoisonQueue,
+		Publisher: pub,
+		AuditLog:  auditLogRepo,
+	})
+
+	webhooksService := webhooks.NewService(webhooks.NewServiceInput{
+		Repo: webhooksRepo,
+		SupportedEvents: []string{
+			events.Name(TicketBookingConfirmed{}),
+			events.Name(TicketPrinted{}),
+			events.Name(TicketCanceledEvent{}),
+		},
+	})
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		logrus.Warn("ADMIN_TOKEN is not set, the admin and webhook endpoints reject every request")
+	}
 
 	server := NewServer(NewServerInput{
 		EventBus:       bus,
+		CommandBus:     commandBus,
 		Logger:         watermillLogger,
 		TicketsService: ticketsService,
+		PoisonService:  poisonService,
+		Webhooks:       webhooksService,
+		StreamJanitor:  pubSub.StreamJanitor,
+		AdminToken:     adminToken,
 	})
 
 	router, err := NewRouter(NewRouterInput{
@@ -123,23 +412,84 @@ func (d *Dependencies) build(input BuildInput) error {
 		return err
 	}
 
-	InjectMiddlewares(InjectMiddlewaresInput{
-		Router: router,
-		Logger: watermillLogger,
+	bookingSaga := NewBookingSaga(NewBookingSagaInput{
+		Sagas:              ticketSagasRepo,
+		TicketsRepo:        ticketsRepo,
+		ReceiptsClient:     receiptsClient,
+		SpreadsheetsClient: spreadsheetsClient,
+		EventBus:           bus,
+		Marshaler:          eventMarshaler,
 	})
 
+	policies := NewHandlerPolicies(DefaultHandlerPolicy)
+
+	unknownTypePolicy, err := ParseUnknownTypePolicy(os.Getenv("UNKNOWN_MESSAGE_TYPE_POLICY"))
+	if err != nil {
+		return err
+	}
+
+	quarantineTopic := os.Getenv("UNKNOWN_MESSAGE_TYPE_TOPIC")
+	if quarantineTopic == "" {
+		quarantineTopic = topics.PoisonQueueTopic()
+	}
+
+	logLevels, err := ParseHandlerLogLevels(os.Getenv("HANDLER_LOG_LEVELS"))
+	if err != nil {
+		return err
+	}
+
+	unknownTypes, err := NewUnknownTypeFilter(NewUnknownTypeFilterInput{
+		Policy:          unknownTypePolicy,
+		Registries:      []*MessageRegistry{events, commands},
+		Publisher:       pub,
+		QuarantineTopic: quarantineTopic,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = InjectMiddlewares(InjectMiddlewaresInput{
+		Router:           router,
+		Logger:           watermillLogger,
+		Publisher:        pub,
+		PoisonQueueTopic: topics.PoisonQueueTopic(),
+		BookingSaga:      bookingSaga,
+		Policies:         policies,
+		LogLevels:        logLevels,
+		Registries:       []*MessageRegistry{events, commands},
+		UnknownTypes:     unknownTypes,
+		Normalizer:       NewTicketPayloadNormalizer(events),
+	})
+	if err != nil {
+		return err
+	}
+
+	newSubscriber := func(handlerName string) (message.Subscriber, error) {
+		return pubSub.NewSubscriber(handlerName)
+	}
+
 	ep, err := cqrs.NewEventProcessorWithConfig(router, cqrs.EventProcessorConfig{
 		SubscriberConstructor: func(params cqrs.EventProcessorSubscriberConstructorParams) (message.Subscriber, error) {
-			return redisstream.NewSubscriber(redisstream.SubscriberConfig{
-				Client:        rdb,
-				ConsumerGroup: "svc-tickets." + params.HandlerName,
-			}, watermillLogger)
-		},
-		Marshaler: cqrs.JSONMarshaler{
-			GenerateName: cqrs.StructName,
+			return newSubscriber(params.HandlerName)
 		},
+		Marshaler: eventMarshaler,
 		GenerateSubscribeTopic: func(params cqrs.EventProcessorGenerateSubscribeTopicParams) (string, error) {
-			return params.EventName, nil
+			return topics.EventTopic(params.EventName)
+		},
+		Logger: watermillLogger,
+	})
+	if err != nil {
+		return err
+	}
+
+	// command handlers are added to the same router, so they get the same middlewares as event handlers
+	cp, err := cqrs.NewCommandProcessorWithConfig(router, cqrs.CommandProcessorConfig{
+		SubscriberConstructor: func(params cqrs.CommandProcessorSubscriberConstructorParams) (message.Subscriber, error) {
+			return newSubscriber(params.HandlerName)
+		},
+		Marshaler: commandMarshaler,
+		GenerateSubscribeTopic: func(params cqrs.CommandProcessorGenerateSubscribeTopicParams) (string, error) {
+			return topics.CommandTopic(params.CommandName)
 		},
 		Logger: watermillLogger,
 	})
@@ -151,19 +501,56 @@ func (d *Dependencies) build(input BuildInput) error {
 		receiptsClient:     receiptsClient,
 		ticketsRepo:        ticketsRepo,
 		spreadsheetsClient: spreadsheetsClient,
-		filesClient:        input.FilesClient,
+		filesClient:        filesClient,
+		processedMessages:  processedMessagesRepo,
 		eventBus:           bus,
+		events:             events,
+		webhooks:           webhooksService,
+		policies:           policies,
 	}, ep)
 	if err != nil {
 		return err
 	}
 
+	err = ep.AddHandlers(bookingSaga.Handlers()...)
+	if err != nil {
+		return err
+	}
+
+	err = injectCommandHandlers(injectCommandHandlersInput{
+		receiptsClient:     receiptsClient,
+		ticketsRepo:        ticketsRepo,
+		spreadsheetsClient: spreadsheetsClient,
+		filesClient:        filesClient,
+		processedMessages:  processedMessagesRepo,
+		eventBus:           bus,
+		policies:           policies,
+	}, cp)
+	if err != nil {
+		return err
+	}
+
 	d.Router = router
+	d.EventBus = bus
+	d.CommandBus = commandBus
 	d.Server = server
-	d.ReceiptsClient = receiptsClient
-	d.SpreadsheetsClient = spreadsheetsClient
+	d.ReceiptsClient = input.ReceiptsClient
+	d.FilesClient = input.FilesClient
+	d.SpreadsheetsClient = input.SpreadsheetsClient
 	d.db = db
+	d.ProcessedMessagesCleaner = NewProcessedMessagesCleaner(processedMessagesCleanup, processedMessagesRepo)
+	d.BookingSaga = bookingSaga
+	d.Webhooks = webhooksService
+	d.StreamJanitor = pubSub.StreamJanitor
+	d.TracerProvider = tracerProvider
+	d.Scheduler = NewScheduler(NewSchedulerInput{
+		Marshaler:         eventMarshaler,
+		Topics:            topics,
+		Publisher:         pub,
+		ScheduledMessages: scheduledMessagesRepo,
+	})
 	d.EventProcessor = ep
+	d.CommandProcessor = cp
 
 	return nil
 }
@@ -1,29 +1,65 @@
 package app
 
 import (
-	"github.com/google/uuid"
 	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// EventSource identifies this service as the producer of the events and commands it publishes.
+	EventSource = "svc-tickets"
+
+	// EventHeaderSchemaVersion is bumped every time the layout of EventHeader changes,
+	// version 1 had no causation data and a string published_at.
+	EventHeaderSchemaVersion = 2
 )
 
 type EventHeader struct {
-	ID             string `json:"id"`
-	PublishedAt    string `json:"published_at"`
-	IdempotencyKey string `json:"idempotency_key"`
+	ID             string    `json:"id"`
+	PublishedAt    time.Time `json:"published_at"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	// CorrelationID is shared by every message caused, directly or not, by the same request.
+	CorrelationID string `json:"correlation_id"`
+	// CausationID is the ID of the message which caused this one, it's empty for messages started by a request.
+	CausationID   string `json:"causation_id"`
+	Source        string `json:"source"`
+	SchemaVersion int    `json:"schema_version"`
 }
 
-func NewEventHandlerWithIdempotencyKey(key string) EventHeader {
+func NewEventHeader(correlationID string, idempotencyKey string) EventHeader {
 	return EventHeader{
 		ID:             uuid.NewString(),
-		PublishedAt:    time.Now().Format(time.RFC3339),
-		IdempotencyKey: key,
+		PublishedAt:    time.Now().UTC(),
+		IdempotencyKey: idempotencyKey,
+		CorrelationID:  correlationID,
+		Source:         EventSource,
+		SchemaVersion:  EventHeaderSchemaVersion,
 	}
 }
 
+// NewChildEventHeader derives the header of a message published while handling the parent message.
+func NewChildEventHeader(parent EventHeader) EventHeader {
+	header := NewEventHeader(parent.CorrelationID, parent.IdempotencyKey)
+	header.CausationID = parent.ID
+
+	return header
+}
+
+// eventWithHeader is implemented by every event and command, so the header can be read without knowing the type.
+type eventWithHeader interface {
+	GetHeader() EventHeader
+}
+
 type TicketEvent struct {
 	*Ticket
 	Header EventHeader `json:"header"`
 }
 
+func (e *TicketEvent) GetHeader() EventHeader {
+	return e.Header
+}
+
 type TicketBookingConfirmed struct {
 	*TicketEvent
 }
@@ -38,3 +74,41 @@ type TicketPrinted struct {
 	TicketID string `json:"ticket_id"`
 	FileName string `json:"file_name"`
 }
+
+func (e TicketPrinted) GetHeader() EventHeader {
+	return e.Header
+}
+
+// BookingSagaFailed is published when a step of the booking saga failed for good or timed out,
+// the steps which already succeeded are compensated.
+type BookingSagaFailed struct {
+	Header EventHeader `json:"header"`
+
+	TicketID   string `json:"ticket_id"`
+	FailedStep string `json:"failed_step"`
+	Reason     string `json:"reason"`
+}
+
+func (e BookingSagaFailed) GetHeader() EventHeader {
+	return e.Header
+}
+
+// NewEventRegistry registers the wire name of every event, changing a name or a version changes its topic.
+// The events published before the registry keep their struct names as legacy names, until their version is bumped.
+func NewEventRegistry() (*MessageRegistry, error) {
+	registry := NewMessageRegistry()
+
+	for event, definition := range map[any]MessageDefinition{
+		TicketBookingConfirmed{}: {Name: "TicketBookingConfirmed", Version: 1, LegacyName: "TicketBookingConfirmed"},
+		TicketCanceledEvent{}:    {Name: "TicketBookingCanceled", Version: 1, LegacyName: "TicketCanceledEvent"},
+		TicketPrinted{}:          {Name: "TicketPrinted", Version: 1, LegacyName: "TicketPrinted"},
+		BookingSagaFailed{}:      {Name: "BookingSagaFailed", Version: 1},
+	} {
+		err := registry.Register(event, definition)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
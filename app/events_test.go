@@ -0,0 +1,32 @@
+package app_test
+
+import (
+	"encoding/json"
+	"testing"
+	"tickets/app"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewChildEventHeader(t *testing.T) {
+	parent := app.NewEventHeader("correlation-id", "idempotency-key")
+	child := app.NewChildEventHeader(parent)
+
+	assert.NotEqual(t, parent.ID, child.ID)
+	assert.Equal(t, parent.ID, child.CausationID)
+	assert.Equal(t, parent.CorrelationID, child.CorrelationID)
+	assert.Equal(t, parent.IdempotencyKey, child.IdempotencyKey)
+	assert.Equal(t, app.EventSource, child.Source)
+	assert.False(t, child.PublishedAt.Before(parent.PublishedAt))
+}
+
+func TestEventHeaderReadsStringPublishedAt(t *testing.T) {
+	// headers published before PublishedAt became a time.Time are still in the streams
+	header := app.EventHeader{}
+
+	err := json.Unmarshal([]byte(`{"id":"1","published_at":"2023-08-01T10:00:00Z","idempotency_key":"key"}`), &header)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2023, header.PublishedAt.Year())
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+)
+
+// NewExactlyOnceEventHandler works like cqrs.NewEventHandler, but skips events already processed by the handler.
+// Writes done through the repositories with the handler's ctx are committed together with the processed mark,
+// effects outside the database are applied at most once per successful commit.
+// The transaction is open while handleFunc runs, so its external calls keep a database connection busy,
+// see ProcessedMessagesRepository.RunOnce.
+func NewExactlyOnceEventHandler[T any](
+	handlerName string,
+	processedMessages repositories.ProcessedMessagesRepository,
+	handleFunc func(ctx context.Context, event *T) error,
+) cqrs.EventHandler {
+	return cqrs.NewEventHandler[T](handlerName, runOnce(handlerName, processedMessages, handleFunc))
+}
+
+// NewExactlyOnceCommandHandler works like cqrs.NewCommandHandler, but skips commands already processed by the handler,
+// see NewExactlyOnceEventHandler.
+func NewExactlyOnceCommandHandler[T any](
+	handlerName string,
+	processedMessages repositories.ProcessedMessagesRepository,
+	handleFunc func(ctx context.Context, command *T) error,
+) cqrs.CommandHandler {
+	return cqrs.NewCommandHandler[T](handlerName, runOnce(handlerName, processedMessages, handleFunc))
+}
+
+// runOnce runs handleFunc once per ID of the message header.
+func runOnce[T any](
+	handlerName string,
+	processedMessages repositories.ProcessedMessagesRepository,
+	handleFunc func(ctx context.Context, msg *T) error,
+) func(ctx context.Context, msg *T) error {
+	return func(ctx context.Context, msg *T) error {
+		m, ok := any(msg).(eventWithHeader)
+		if !ok {
+			return fmt.Errorf("message %T has no header", msg)
+		}
+
+		messageID := m.GetHeader().ID
+		if messageID == "" {
+			return fmt.Errorf("message %T has no ID", msg)
+		}
+
+		return processedMessages.RunOnce(ctx, handlerName, messageID, func(ctx context.Context) error {
+			return handleFunc(ctx, msg)
+		})
+	}
+}
+
+// ProcessedMessagesCleanupPolicy removes processed marks older than Retention.
+// Retention must be longer than the time a message can wait for redelivery, or duplicates are not detected anymore.
+type ProcessedMessagesCleanupPolicy struct {
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+var DefaultProcessedMessagesCleanupPolicy = ProcessedMessagesCleanupPolicy{
+	Retention: time.Hour * 24 * 7,
+	Interval:  time.Hour,
+}
+
+// ParseProcessedMessagesCleanupPolicy reads the PROCESSED_MESSAGES_RETENTION and PROCESSED_MESSAGES_CLEANUP_INTERVAL
+// settings, durations like "168h". Empty ones are taken from DefaultProcessedMessagesCleanupPolicy.
+func ParseProcessedMessagesCleanupPolicy(retention string, interval string) (ProcessedMessagesCleanupPolicy, error) {
+	policy := DefaultProcessedMessagesCleanupPolicy
+
+	for _, setting := range []struct {
+		name  string
+		value string
+		into  *time.Duration
+	}{
+		{name: "retention", value: retention, into: &policy.Retention},
+		{name: "cleanup interval", value: interval, into: &policy.Interval},
+	} {
+		if setting.value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(setting.value)
+		if err != nil || duration <= 0 {
+			return ProcessedMessagesCleanupPolicy{}, fmt.Errorf("invalid processed messages %s %q, expected a positive duration", setting.name, setting.value)
+		}
+		*setting.into = duration
+	}
+
+	return policy, nil
+}
+
+type ProcessedMessagesCleaner struct {
+	policy            ProcessedMessagesCleanupPolicy
+	processedMessages repositories.ProcessedMessagesRepository
+}
+
+func NewProcessedMessagesCleaner(policy ProcessedMessagesCleanupPolicy, processedMessages repositories.ProcessedMessagesRepository) *ProcessedMessagesCleaner {
+	return &ProcessedMessagesCleaner{
+		policy:            policy,
+		processedMessages: processedMessages,
+	}
+}
+
+func (c *ProcessedMessagesCleaner) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		deleted, err := c.processedMessages.DeleteProcessedBefore(ctx, time.Now().Add(-c.policy.Retention))
+		if err != nil {
+			log.FromContext(ctx).WithError(err).Error("Could not clean up processed messages")
+			continue
+		}
+
+		log.FromContext(ctx).WithField("deleted", deleted).Debug("Cleaned up processed messages")
+	}
+}
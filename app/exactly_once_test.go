@@ -0,0 +1,34 @@
+package app_test
+
+import (
+	"testing"
+	"time"
+
+	"tickets/app"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcessedMessagesCleanupPolicy(t *testing.T) {
+	policy, err := app.ParseProcessedMessagesCleanupPolicy("", "")
+	require.NoError(t, err)
+	assert.Equal(t, app.DefaultProcessedMessagesCleanupPolicy, policy)
+
+	policy, err = app.ParseProcessedMessagesCleanupPolicy("720h", "")
+	require.NoError(t, err)
+	assert.Equal(t, app.ProcessedMessagesCleanupPolicy{
+		Retention: 720 * time.Hour,
+		Interval:  app.DefaultProcessedMessagesCleanupPolicy.Interval,
+	}, policy)
+
+	policy, err = app.ParseProcessedMessagesCleanupPolicy("48h", "10m")
+	require.NoError(t, err)
+	assert.Equal(t, app.ProcessedMessagesCleanupPolicy{Retention: 48 * time.Hour, Interval: 10 * time.Minute}, policy)
+
+	_, err = app.ParseProcessedMessagesCleanupPolicy("a week", "")
+	assert.Error(t, err)
+
+	_, err = app.ParseProcessedMessagesCleanupPolicy("", "0s")
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/clients/files"
+)
+
+type FilesClientMock struct {
+	Files map[string]string // map[file_id]content
+	lock  sync.Mutex
+}
+
+func NewFilesClientMock() *FilesClientMock {
+	return &FilesClientMock{
+		Files: make(map[string]string),
+	}
+}
+
+func (c *FilesClientMock) GetFilesWithResponse(ctx context.Context, reqEditors ...files.RequestEditorFn) (*files.GetFilesResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fileIDs := make([]string, 0, len(c.Files))
+	for fileID := range c.Files {
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Strings(fileIDs)
+
+	response := &files.GetFilesResponse{
+		HTTPResponse: &http.Response{StatusCode: http.StatusOK},
+	}
+	response.JSON200 = &struct {
+		Files []string `json:"files"`
+	}{Files: fileIDs}
+
+	return response, nil
+}
+
+func (c *FilesClientMock) GetFilesFileIdContentWithResponse(ctx context.Context, fileId string, reqEditors ...files.RequestEditorFn) (*files.GetFilesFileIdContentResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	content, ok := c.Files[fileId]
+	if !ok {
+		return &files.GetFilesFileIdContentResponse{
+			HTTPResponse: &http.Response{StatusCode: http.StatusNotFound},
+		}, nil
+	}
+
+	return &files.GetFilesFileIdContentResponse{
+		Body:         []byte(content),
+		HTTPResponse: &http.Response{StatusCode: http.StatusOK},
+	}, nil
+}
+
+func (c *FilesClientMock) PutFilesFileIdContentWithBodyWithResponse(ctx context.Context, fileId string, contentType string, body io.Reader, reqEditors ...files.RequestEditorFn) (*files.PutFilesFileIdContentResponse, error) {
+	content := bytes.Buffer{}
+	_, err := content.ReadFrom(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.PutFilesFileIdContentWithTextBodyWithResponse(ctx, fileId, content.String(), reqEditors...)
+}
+
+func (c *FilesClientMock) PutFilesFileIdContentWithTextBodyWithResponse(ctx context.Context, fileId string, body files.PutFilesFileIdContentTextRequestBody, reqEditors ...files.RequestEditorFn) (*files.PutFilesFileIdContentResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.Files[fileId]; ok {
+		return &files.PutFilesFileIdContentResponse{
+			HTTPResponse: &http.Response{StatusCode: http.StatusConflict},
+		}, nil
+	}
+
+	c.Files[fileId] = body
+
+	return &files.PutFilesFileIdContentResponse{
+		HTTPResponse: &http.Response{StatusCode: http.StatusCreated},
+	}, nil
+}
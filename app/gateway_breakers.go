@@ -0,0 +1,260 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"tickets/app/circuitbreaker"
+	"tickets/app/receipts"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/clients/files"
+)
+
+// GatewayCircuitBreakers configures a circuit breaker per gateway client, so one service being down
+// doesn't stop calls to the others.
+type GatewayCircuitBreakers struct {
+	Receipts     circuitbreaker.Config
+	Spreadsheets circuitbreaker.Config
+	Files        circuitbreaker.Config
+}
+
+var DefaultGatewayCircuitBreakers = GatewayCircuitBreakers{
+	Receipts:     withBreakerName(circuitbreaker.DefaultConfig, "receipts"),
+	Spreadsheets: withBreakerName(circuitbreaker.DefaultConfig, "spreadsheets"),
+	Files:        withBreakerName(circuitbreaker.DefaultConfig, "files"),
+}
+
+// GatewayCircuitBreakersFromEnv reads the settings of every client from <CLIENT>_BREAKER_FAILURE_THRESHOLD,
+// <CLIENT>_BREAKER_OPEN_TIMEOUT (a duration like "30s") and <CLIENT>_BREAKER_HALF_OPEN_REQUESTS,
+// where CLIENT is RECEIPTS, SPREADSHEETS or FILES. Empty ones are taken from DefaultGatewayCircuitBreakers.
+func GatewayCircuitBreakersFromEnv() (GatewayCircuitBreakers, error) {
+	breakers := DefaultGatewayCircuitBreakers
+
+	for prefix, config := range map[string]*circuitbreaker.Config{
+		"RECEIPTS":     &breakers.Receipts,
+		"SPREADSHEETS": &breakers.Spreadsheets,
+		"FILES":        &breakers.Files,
+	} {
+		for _, setting := range []struct {
+			name string
+			into *int
+		}{
+			{name: prefix + "_BREAKER_FAILURE_THRESHOLD", into: &config.FailureThreshold},
+			{name: prefix + "_BREAKER_HALF_OPEN_REQUESTS", into: &config.HalfOpenMaxRequests},
+		} {
+			value := os.Getenv(setting.name)
+			if value == "" {
+				continue
+			}
+
+			number, err := strconv.Atoi(value)
+			if err != nil || number <= 0 {
+				return GatewayCircuitBreakers{}, fmt.Errorf("invalid %s %q, expected a positive number", setting.name, value)
+			}
+			*setting.into = number
+		}
+
+		name := prefix + "_BREAKER_OPEN_TIMEOUT"
+		if value := os.Getenv(name); value != "" {
+			openTimeout, err := time.ParseDuration(value)
+			if err != nil || openTimeout <= 0 {
+				return GatewayCircuitBreakers{}, fmt.Errorf("invalid %s %q, expected a positive duration", name, value)
+			}
+			config.OpenTimeout = openTimeout
+		}
+	}
+
+	return breakers, nil
+}
+
+func withBreakerName(config circuitbreaker.Config, name string) circuitbreaker.Config {
+	config.Name = name
+
+	return config
+}
+
+// reportCall records the outcome of a call let through by the breaker. Only transport errors and server errors
+// are failures: a client error is an answer of a working service, and a call which was canceled by the caller,
+// or never sent because it was invalid or ran out of time waiting for the rate limit, says nothing about the service.
+func reportCall(breaker *circuitbreaker.Breaker, statusCode int, err error) {
+	if statusCode == 0 {
+		statusCode = errorStatusCode(err)
+	}
+
+	switch {
+	case statusCode >= http.StatusInternalServerError:
+		breaker.Failure()
+	case statusCode != 0 || err == nil:
+		breaker.Success()
+	case isTransportError(err):
+		breaker.Failure()
+	default:
+		breaker.Ignore()
+	}
+}
+
+// errorStatusCode returns the status code of the errors of the receipts and spreadsheets clients, 0 for other errors.
+func errorStatusCode(err error) int {
+	var receiptsErr *receipts.UnexpectedStatusError
+	if errors.As(err, &receiptsErr) {
+		return receiptsErr.StatusCode
+	}
+
+	var spreadsheetsErr *UnexpectedStatusError
+	if errors.As(err, &spreadsheetsErr) {
+		return spreadsheetsErr.StatusCode
+	}
+
+	if errors.Is(err, ErrRateLimited) {
+		return http.StatusTooManyRequests
+	}
+
+	return 0
+}
+
+// isTransportError tells whether the request failed on its way to the service, unless the caller canceled it.
+// Requests which timed out count, a service which doesn't answer is failing.
+func isTransportError(err error) bool {
+	var urlErr *url.Error
+
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled)
+}
+
+// statusCode returns the status code of a files client response, which is nil when the request failed.
+func statusCode[R any, PR interface {
+	*R
+	StatusCode() int
+}](resp PR) int {
+	if resp == nil {
+		return 0
+	}
+
+	return resp.StatusCode()
+}
+
+type receiptsClientWithBreaker struct {
+	client  receipts.ReceiptsClientInterface
+	breaker *circuitbreaker.Breaker
+}
+
+func NewReceiptsClientWithBreaker(client receipts.ReceiptsClientInterface, config circuitbreaker.Config) receipts.ReceiptsClientInterface {
+	return receiptsClientWithBreaker{
+		client:  client,
+		breaker: circuitbreaker.New(config),
+	}
+}
+
+func (c receiptsClientWithBreaker) IssueReceipt(ctx context.Context, request receipts.IssueReceiptRequest) error {
+	err := c.breaker.Allow()
+	if err != nil {
+		return err
+	}
+
+	err = c.client.IssueReceipt(ctx, request)
+	reportCall(c.breaker, 0, err)
+
+	return err
+}
+
+func (c receiptsClientWithBreaker) VoidReceipt(ctx context.Context, request receipts.VoidReceiptRequest) error {
+	err := c.breaker.Allow()
+	if err != nil {
+		return err
+	}
+
+	err = c.client.VoidReceipt(ctx, request)
+	reportCall(c.breaker, 0, err)
+
+	return err
+}
+
+type spreadsheetsClientWithBreaker struct {
+	client  SpreadsheetsClientInterface
+	breaker *circuitbreaker.Breaker
+}
+
+func NewSpreadsheetsClientWithBreaker(client SpreadsheetsClientInterface, config circuitbreaker.Config) SpreadsheetsClientInterface {
+	return spreadsheetsClientWithBreaker{
+		client:  client,
+		breaker: circuitbreaker.New(config),
+	}
+}
+
+func (c spreadsheetsClientWithBreaker) AppendRow(ctx context.Context, spreadsheetName string, row []string) error {
+	err := c.breaker.Allow()
+	if err != nil {
+		return err
+	}
+
+	err = c.client.AppendRow(ctx, spreadsheetName, row)
+	reportCall(c.breaker, 0, err)
+
+	return err
+}
+
+type filesClientWithBreaker struct {
+	client  files.ClientWithResponsesInterface
+	breaker *circuitbreaker.Breaker
+}
+
+func NewFilesClientWithBreaker(client files.ClientWithResponsesInterface, config circuitbreaker.Config) files.ClientWithResponsesInterface {
+	return filesClientWithBreaker{
+		client:  client,
+		breaker: circuitbreaker.New(config),
+	}
+}
+
+func (c filesClientWithBreaker) GetFilesWithResponse(ctx context.Context, reqEditors ...files.RequestEditorFn) (*files.GetFilesResponse, error) {
+	err := c.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.GetFilesWithResponse(ctx, reqEditors...)
+	reportCall(c.breaker, statusCode(resp), err)
+
+	return resp, err
+}
+
+func (c filesClientWithBreaker) GetFilesFileIdContentWithResponse(ctx context.Context, fileId string, reqEditors ...files.RequestEditorFn) (*files.GetFilesFileIdContentResponse, error) {
+	err := c.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.GetFilesFileIdContentWithResponse(ctx, fileId, reqEditors...)
+	reportCall(c.breaker, statusCode(resp), err)
+
+	return resp, err
+}
+
+func (c filesClientWithBreaker) PutFilesFileIdContentWithBodyWithResponse(ctx context.Context, fileId string, contentType string, body io.Reader, reqEditors ...files.RequestEditorFn) (*files.PutFilesFileIdContentResponse, error) {
+	err := c.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.PutFilesFileIdContentWithBodyWithResponse(ctx, fileId, contentType, body, reqEditors...)
+	reportCall(c.breaker, statusCode(resp), err)
+
+	return resp, err
+}
+
+func (c filesClientWithBreaker) PutFilesFileIdContentWithTextBodyWithResponse(ctx context.Context, fileId string, body files.PutFilesFileIdContentTextRequestBody, reqEditors ...files.RequestEditorFn) (*files.PutFilesFileIdContentResponse, error) {
+	err := c.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.PutFilesFileIdContentWithTextBodyWithResponse(ctx, fileId, body, reqEditors...)
+	reportCall(c.breaker, statusCode(resp), err)
+
+	return resp, err
+}
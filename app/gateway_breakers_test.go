@@ -0,0 +1,136 @@
+package app_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"tickets/app"
+	"tickets/app/circuitbreaker"
+	"tickets/app/receipts"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingReceiptsClient struct {
+	err   error
+	calls int
+}
+
+func (c *failingReceiptsClient) IssueReceipt(ctx context.Context, request receipts.IssueReceiptRequest) error {
+	c.calls++
+	return c.err
+}
+
+func (c *failingReceiptsClient) VoidReceipt(ctx context.Context, request receipts.VoidReceiptRequest) error {
+	c.calls++
+	return c.err
+}
+
+func TestReceiptsClientWithBreaker(t *testing.T) {
+	failing := &failingReceiptsClient{err: &receipts.UnexpectedStatusError{StatusCode: http.StatusServiceUnavailable}}
+	client := app.NewReceiptsClientWithBreaker(failing, circuitbreaker.Config{
+		Name:             "receipts",
+		FailureThreshold: 2,
+		OpenTimeout:      time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		err := client.IssueReceipt(context.Background(), receipts.IssueReceiptRequest{TicketID: "ticket-1"})
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, circuitbreaker.ErrOpen)
+	}
+
+	err := client.VoidReceipt(context.Background(), receipts.VoidReceiptRequest{TicketID: "ticket-1"})
+	require.ErrorIs(t, err, circuitbreaker.ErrOpen)
+	assert.Equal(t, 2, failing.calls, "no call is made while the circuit is open")
+
+	var openErr *circuitbreaker.OpenError
+	require.ErrorAs(t, err, &openErr)
+	assert.Equal(t, "receipts", openErr.Name)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), openErr.RetryAt, time.Second)
+}
+
+func TestReceiptsClientWithBreakerCountsOnlyServiceFailures(t *testing.T) {
+	config := circuitbreaker.Config{FailureThreshold: 1, OpenTimeout: time.Minute}
+
+	for name, err := range map[string]error{
+		"client error": &receipts.UnexpectedStatusError{StatusCode: http.StatusBadRequest},
+		"canceled":     &url.Error{Op: "Put", URL: "http://gateway/receipts", Err: context.Canceled},
+		"invalid":      errors.New("json: unsupported value"),
+	} {
+		failing := &failingReceiptsClient{err: err}
+		client := app.NewReceiptsClientWithBreaker(failing, config)
+
+		for i := 0; i < 3; i++ {
+			err := client.IssueReceipt(context.Background(), receipts.IssueReceiptRequest{TicketID: "ticket-1"})
+			assert.NotErrorIs(t, err, circuitbreaker.ErrOpen, name)
+		}
+		assert.Equal(t, 3, failing.calls, name)
+	}
+
+	for name, err := range map[string]error{
+		"server error": &receipts.UnexpectedStatusError{StatusCode: http.StatusBadGateway},
+		"transport":    &url.Error{Op: "Put", URL: "http://gateway/receipts", Err: errors.New("connection refused")},
+		"timed out":    &url.Error{Op: "Put", URL: "http://gateway/receipts", Err: context.DeadlineExceeded},
+	} {
+		client := app.NewReceiptsClientWithBreaker(&failingReceiptsClient{err: err}, config)
+
+		_ = client.IssueReceipt(context.Background(), receipts.IssueReceiptRequest{TicketID: "ticket-1"})
+		err := client.IssueReceipt(context.Background(), receipts.IssueReceiptRequest{TicketID: "ticket-1"})
+		assert.ErrorIs(t, err, circuitbreaker.ErrOpen, name)
+	}
+}
+
+func TestSpreadsheetsClientWithBreakerIgnoresRateLimitWaits(t *testing.T) {
+	spreadsheets := &app.SpreadsheetsClientMock{Sheets: make(map[string][][]string)}
+	client := app.NewSpreadsheetsClientWithBreaker(
+		app.NewRateLimitedSpreadsheetsClient(spreadsheets, app.SpreadsheetsRateLimit{RequestsPerSecond: 0.1, Burst: 1}),
+		circuitbreaker.Config{FailureThreshold: 1, OpenTimeout: time.Minute},
+	)
+
+	require.NoError(t, client.AppendRow(context.Background(), "tickets-to-print", []string{"ticket-1"}))
+
+	// the next call would wait 10s for the rate limit, past the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.AppendRow(ctx, "tickets-to-print", []string{"ticket-2"})
+	require.Error(t, err)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.AppendRow(canceled, "tickets-to-print", []string{"ticket-3"})
+	require.Error(t, err)
+
+	err = client.AppendRow(ctx, "tickets-to-print", []string{"ticket-4"})
+	assert.NotErrorIs(t, err, circuitbreaker.ErrOpen, "calls which were never made opened the circuit")
+}
+
+func TestGatewayCircuitBreakersFromEnv(t *testing.T) {
+	breakers, err := app.GatewayCircuitBreakersFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, app.DefaultGatewayCircuitBreakers, breakers)
+
+	t.Setenv("SPREADSHEETS_BREAKER_FAILURE_THRESHOLD", "20")
+	t.Setenv("SPREADSHEETS_BREAKER_OPEN_TIMEOUT", "1m")
+	t.Setenv("FILES_BREAKER_HALF_OPEN_REQUESTS", "3")
+
+	breakers, err = app.GatewayCircuitBreakersFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, app.DefaultGatewayCircuitBreakers.Receipts, breakers.Receipts)
+	assert.Equal(t, circuitbreaker.Config{
+		Name:                "spreadsheets",
+		FailureThreshold:    20,
+		OpenTimeout:         time.Minute,
+		HalfOpenMaxRequests: circuitbreaker.DefaultConfig.HalfOpenMaxRequests,
+	}, breakers.Spreadsheets)
+	assert.Equal(t, 3, breakers.Files.HalfOpenMaxRequests)
+
+	t.Setenv("RECEIPTS_BREAKER_OPEN_TIMEOUT", "soon")
+	_, err = app.GatewayCircuitBreakersFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tickets/app/metrics"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/clients"
+)
+
+type instrumentedHTTPClient struct {
+	doer clients.HttpDoer
+}
+
+// NewInstrumentedHTTPClient reports the latency and the status code of every gateway call
+// in metrics.GatewayRequestDuration, and traces the call.
+func NewInstrumentedHTTPClient(doer clients.HttpDoer) clients.HttpDoer {
+	return instrumentedHTTPClient{doer: doer}
+}
+
+func (c instrumentedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	client := gatewayClientName(req.URL.Path)
+
+	req, span := traceGatewayCall(req, client)
+	start := time.Now()
+
+	resp, err := c.doer.Do(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	metrics.GatewayRequestDuration.
+		WithLabelValues(client, req.Method, status).
+		Observe(time.Since(start).Seconds())
+	endGatewaySpan(span, resp, err)
+
+	return resp, err
+}
+
+// gatewayClientName returns the client from the first segment of the path, for example "receipts" for "/receipts-api/...".
+// The rest of the path is not used, as it contains IDs.
+func gatewayClientName(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+
+	return strings.TrimSuffix(segment, "-api")
+}
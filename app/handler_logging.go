@@ -0,0 +1,233 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"tickets/app/pii"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/sirupsen/logrus"
+)
+
+// maxTrackedDeliveries caps the messages whose failed deliveries are counted, the counts are reset past it.
+const maxTrackedDeliveries = 10000
+
+// HandlerLogLevels maps handler names to log levels, "*" sets the level of the other handlers.
+// Handlers without a level log at the level of the standard logger.
+type HandlerLogLevels map[string]logrus.Level
+
+// ParseHandlerLogLevels reads the HANDLER_LOG_LEVELS setting, levels by handler name separated by ",",
+// for example "*=warning,store-confirmed=debug".
+func ParseHandlerLogLevels(value string) (HandlerLogLevels, error) {
+	levels := HandlerLogLevels{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		handlerName, rawLevel, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid handler log level %q, expected <handler>=<level>", entry)
+		}
+
+		level, err := logrus.ParseLevel(strings.TrimSpace(rawLevel))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level of handler %s: %w", handlerName, err)
+		}
+
+		levels[strings.TrimSpace(handlerName)] = level
+	}
+
+	return levels, nil
+}
+
+type NewLogMiddlewareInput struct {
+	OkMessage  string
+	ErrMessage string
+	Levels     HandlerLogLevels
+	// Registries resolve the Go types of messages, so the PII of payloads logged at debug level can be masked.
+	Registries []*MessageRegistry
+}
+
+// LogMiddleware logs every delivery of a message with the handler, topic, event name, ticket ID,
+// delivery attempt, duration and outcome. The logger in the message context carries the same fields
+// and the level of the handler, so the logs of handlers have them too.
+//
+// Handlers logging at debug level log the payloads of messages, with PII masked.
+type LogMiddleware struct {
+	okMessage  string
+	errMessage string
+	levels     HandlerLogLevels
+	loggers    map[logrus.Level]*logrus.Logger
+	registries []*MessageRegistry
+	attempts   *deliveryAttempts
+}
+
+func NewLogMiddleware(input NewLogMiddlewareInput) *LogMiddleware {
+	loggers := make(map[logrus.Level]*logrus.Logger)
+	for _, level := range input.Levels {
+		loggers[level] = newLeveledLogger(level)
+	}
+
+	return &LogMiddleware{
+		okMessage:  input.OkMessage,
+		errMessage: input.ErrMessage,
+		levels:     input.Levels,
+		loggers:    loggers,
+		registries: input.Registries,
+		attempts:   newDeliveryAttempts(),
+	}
+}
+
+// newLeveledLogger returns a logger which writes like the standard logger, at its own level.
+func newLeveledLogger(level logrus.Level) *logrus.Logger {
+	std := logrus.StandardLogger()
+
+	return &logrus.Logger{
+		Out:          std.Out,
+		Hooks:        std.Hooks,
+		Formatter:    std.Formatter,
+		ReportCaller: std.ReportCaller,
+		Level:        level,
+		ExitFunc:     std.ExitFunc,
+	}
+}
+
+func (m *LogMiddleware) Middleware(next message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		start := time.Now()
+
+		handlerName := message.HandlerNameFromCtx(msg.Context())
+		messageType := MessageTypeFromMetadata(msg)
+		deliveryKey := handlerName + "/" + msg.UUID
+
+		fields := logrus.Fields{
+			"message_uuid": msg.UUID,
+			"handler":      handlerName,
+			"topic":        message.SubscribeTopicFromCtx(msg.Context()),
+			"event_name":   messageType,
+			"attempt":      m.attempts.current(deliveryKey),
+		}
+		if ticketID := ticketIDFromPayload(msg.Payload); ticketID != "" {
+			fields["ticket_id"] = ticketID
+		}
+
+		logger := m.handlerLogger(handlerName, log.FromContext(msg.Context())).WithFields(fields)
+		msg.SetContext(log.ToContext(msg.Context(), logger))
+
+		logger.Info(m.okMessage)
+		if logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			logger.WithField("payload", m.maskedPayload(messageType, msg.Payload)).Debug("Message payload")
+		}
+
+		messages, err := next(msg)
+
+		logger = logger.WithField("duration", time.Since(start).String())
+		if err != nil {
+			m.attempts.failed(deliveryKey)
+
+			logger.
+				WithField("outcome", "failure").
+				WithField("error", err).
+				Error(m.errMessage)
+
+			return messages, err
+		}
+
+		m.attempts.succeeded(deliveryKey)
+		logger.WithField("outcome", "success").Info("Message handled")
+
+		return messages, nil
+	}
+}
+
+// handlerLogger moves the fields of the entry to the logger at the level of the handler.
+func (m *LogMiddleware) handlerLogger(handlerName string, entry *logrus.Entry) *logrus.Entry {
+	level, ok := m.levels[handlerName]
+	if !ok {
+		level, ok = m.levels["*"]
+	}
+	if !ok {
+		return entry
+	}
+
+	return logrus.NewEntry(m.loggers[level]).WithFields(entry.Data)
+}
+
+// maskedPayload returns the payload with its PII masked, payloads of unknown types are not logged,
+// as there's no way to tell their PII.
+func (m *LogMiddleware) maskedPayload(messageType string, payload []byte) string {
+	for _, registry := range m.registries {
+		t, ok := registry.Type(messageType)
+		if !ok {
+			continue
+		}
+
+		masked, err := pii.MaskFields(payload, t)
+		if err != nil {
+			return fmt.Sprintf("(not logged, could not mask PII: %s)", err)
+		}
+
+		return string(masked)
+	}
+
+	return "(not logged, unknown message type)"
+}
+
+// ticketIDFromPayload returns the ticket ID of events and commands about a ticket.
+func ticketIDFromPayload(payload []byte) string {
+	var ticket struct {
+		TicketID string `json:"ticket_id"`
+	}
+	if err := json.Unmarshal(payload, &ticket); err != nil {
+		return ""
+	}
+
+	return ticket.TicketID
+}
+
+// deliveryAttempts counts failed deliveries of messages, so the log tells which attempt a redelivery is.
+// Only deliveries to this replica are counted.
+type deliveryAttempts struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func newDeliveryAttempts() *deliveryAttempts {
+	return &deliveryAttempts{
+		failures: make(map[string]int),
+	}
+}
+
+func (a *deliveryAttempts) current(key string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.failures[key] + 1
+}
+
+func (a *deliveryAttempts) failed(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.failures) >= maxTrackedDeliveries {
+		// messages which failed here and were then handled by another replica are never removed
+		a.failures = make(map[string]int)
+	}
+
+	a.failures[key]++
+}
+
+func (a *deliveryAttempts) succeeded(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.failures, key)
+}
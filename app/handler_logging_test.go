@@ -0,0 +1,125 @@
+package app_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tickets/app"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHandlerLogLevels(t *testing.T) {
+	levels, err := app.ParseHandlerLogLevels(" *=warning, store-confirmed=debug,")
+	require.NoError(t, err)
+	assert.Equal(t, app.HandlerLogLevels{"*": logrus.WarnLevel, "store-confirmed": logrus.DebugLevel}, levels)
+
+	_, err = app.ParseHandlerLogLevels("store-confirmed")
+	assert.Error(t, err)
+
+	_, err = app.ParseHandlerLogLevels("store-confirmed=loud")
+	assert.Error(t, err)
+}
+
+func TestLogMiddleware(t *testing.T) {
+	hook := test.NewLocal(logrus.StandardLogger())
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+
+	logMiddleware := app.NewLogMiddleware(app.NewLogMiddlewareInput{
+		OkMessage:  "Handling a message",
+		ErrMessage: "Message handling error",
+		Levels:     app.HandlerLogLevels{"verbose": logrus.DebugLevel, "quiet": logrus.WarnLevel},
+		Registries: []*app.MessageRegistry{events},
+	})
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	router.AddMiddleware(logMiddleware.Middleware)
+
+	handled := make(chan string, 3)
+	failed := false
+	router.AddNoPublisherHandler("store", "events", pubSub, func(msg *message.Message) error {
+		if !failed {
+			failed = true
+			return errors.New("database is down")
+		}
+
+		log.FromContext(msg.Context()).Info("Storing the ticket")
+		handled <- "store"
+		return nil
+	})
+	for _, handlerName := range []string{"verbose", "quiet"} {
+		handlerName := handlerName
+		router.AddNoPublisherHandler(handlerName, "events", pubSub, func(msg *message.Message) error {
+			handled <- handlerName
+			return nil
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = router.Run(ctx)
+	}()
+	<-router.Running()
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte(`{"ticket_id":"ticket-1","customer_email":"alice@example.com"}`))
+	msg.Metadata.Set(app.MessageTypeKey, "TicketBookingConfirmed")
+	require.NoError(t, pubSub.Publish("events", msg))
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second * 5):
+			t.Fatal("message was not handled")
+		}
+	}
+
+	entries := map[string][]*logrus.Entry{}
+	for _, entry := range hook.AllEntries() {
+		handlerName, _ := entry.Data["handler"].(string)
+		entries[handlerName] = append(entries[handlerName], entry)
+	}
+
+	store := entries["store"]
+	require.Len(t, store, 5)
+	assert.Equal(t, "Handling a message", store[0].Message)
+	assert.Equal(t, "Message handling error", store[1].Message)
+	assert.Equal(t, "failure", store[1].Data["outcome"])
+	assert.Equal(t, 1, store[1].Data["attempt"])
+	assert.Equal(t, "Storing the ticket", store[3].Message)
+	assert.Equal(t, "Message handled", store[4].Message)
+	assert.Equal(t, "success", store[4].Data["outcome"])
+	assert.Equal(t, 2, store[4].Data["attempt"])
+
+	for _, entry := range store {
+		assert.Equal(t, msg.UUID, entry.Data["message_uuid"])
+		assert.Equal(t, "events", entry.Data["topic"])
+		assert.Equal(t, "TicketBookingConfirmed", entry.Data["event_name"])
+		assert.Equal(t, "ticket-1", entry.Data["ticket_id"])
+	}
+	assert.NotEmpty(t, store[4].Data["duration"])
+
+	verbose := entries["verbose"]
+	require.Len(t, verbose, 3)
+	assert.Equal(t, logrus.DebugLevel, verbose[1].Level)
+	assert.Contains(t, verbose[1].Data["payload"], `"ticket_id":"ticket-1"`)
+	assert.NotContains(t, verbose[1].Data["payload"], "alice@example.com")
+
+	assert.Empty(t, entries["quiet"])
+}
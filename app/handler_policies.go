@@ -0,0 +1,192 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"tickets/app/circuitbreaker"
+	"tickets/app/metrics"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+)
+
+// PoisonBehaviour is what happens to a message which still fails after all retries.
+type PoisonBehaviour string
+
+const (
+	// PoisonToQueue moves the message to the poison queue, where it can be requeued or discarded by admins.
+	PoisonToQueue PoisonBehaviour = "queue"
+	// PoisonDrop acks the message after logging the error, for work which can be lost.
+	PoisonDrop PoisonBehaviour = "drop"
+	// PoisonRedeliver nacks the message, so it's redelivered until it succeeds and blocks the messages behind it.
+	PoisonRedeliver PoisonBehaviour = "redeliver"
+)
+
+// HandlerPolicy is how the router runs the messages of a handler.
+type HandlerPolicy struct {
+	// MaxRetries is the number of retries after the first attempt, retries back off exponentially
+	// from InitialInterval up to MaxInterval.
+	MaxRetries      int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// Timeout is the deadline of every attempt, 0 means no deadline.
+	Timeout time.Duration
+	Poison  PoisonBehaviour
+}
+
+// Budget is the longest a handler with the policy can take to process a delivery: every attempt running
+// until its timeout, with the backoff between them. It's 0 when attempts have no timeout, as they can take any time.
+func (p HandlerPolicy) Budget() time.Duration {
+	if p.Timeout <= 0 {
+		return 0
+	}
+
+	budget := time.Duration(p.MaxRetries+1) * p.Timeout
+
+	// the backoff of RetryMiddleware, without randomization
+	interval := p.InitialInterval
+	for i := 0; i < p.MaxRetries; i++ {
+		if interval > p.MaxInterval {
+			interval = p.MaxInterval
+		}
+		budget += interval
+		interval *= 2
+	}
+
+	return budget
+}
+
+// DefaultHandlerPolicy is used by handlers without a policy of their own.
+var DefaultHandlerPolicy = HandlerPolicy{
+	MaxRetries:      10,
+	InitialInterval: time.Millisecond * 100,
+	MaxInterval:     time.Second,
+	// no handler should hang forever on a call which never returns
+	Timeout: time.Second * 30,
+	Poison:  PoisonToQueue,
+}
+
+// HandlerPolicies holds the policy of every handler, the router middlewares look them up by handler name.
+// Policies are set while building the handlers, before the router runs.
+// They don't limit concurrency: the subscriber of a handler delivers its next message only after the previous one
+// is acked, which keeps the messages of a topic in order, so a handler processes one message at a time per replica.
+type HandlerPolicies struct {
+	defaultPolicy HandlerPolicy
+	policies      map[string]HandlerPolicy
+}
+
+func NewHandlerPolicies(defaultPolicy HandlerPolicy) *HandlerPolicies {
+	return &HandlerPolicies{
+		defaultPolicy: defaultPolicy,
+		policies:      make(map[string]HandlerPolicy),
+	}
+}
+
+func (p *HandlerPolicies) Set(handlerName string, policy HandlerPolicy) {
+	if policy.Poison == "" {
+		policy.Poison = PoisonToQueue
+	}
+
+	p.policies[handlerName] = policy
+}
+
+func (p *HandlerPolicies) Get(handlerName string) HandlerPolicy {
+	policy, ok := p.policies[handlerName]
+	if !ok {
+		return p.defaultPolicy
+	}
+
+	return policy
+}
+
+// PoisonMiddleware applies the poison behaviour of the handler to the messages which failed after all retries,
+// poisonQueue is the middleware publishing them to the poison queue.
+func (p *HandlerPolicies) PoisonMiddleware(poisonQueue message.HandlerMiddleware) message.HandlerMiddleware {
+	return func(next message.HandlerFunc) message.HandlerFunc {
+		queued := poisonQueue(next)
+
+		return func(msg *message.Message) ([]*message.Message, error) {
+			switch p.Get(message.HandlerNameFromCtx(msg.Context())).Poison {
+			case PoisonDrop:
+				messages, err := next(msg)
+				if err == nil || errors.Is(err, circuitbreaker.ErrOpen) {
+					return messages, err
+				}
+
+				log.FromContext(msg.Context()).
+					WithError(err).
+					WithField("message_uuid", msg.UUID).
+					Error("Dropping message which failed after all retries")
+
+				return nil, nil
+			case PoisonRedeliver:
+				return next(msg)
+			default:
+				return queued(msg)
+			}
+		}
+	}
+}
+
+// RetryMiddleware retries failed messages as the policy of the handler says, see retryUnlessCircuitOpen.
+// Retries are counted in metrics.HandlerRetries.
+func (p *HandlerPolicies) RetryMiddleware(logger watermill.LoggerAdapter) message.HandlerMiddleware {
+	return func(next message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			handlerName := message.HandlerNameFromCtx(msg.Context())
+
+			policy := p.Get(handlerName)
+			if policy.MaxRetries <= 0 {
+				return next(msg)
+			}
+
+			retry := middleware.Retry{
+				MaxRetries:      policy.MaxRetries,
+				InitialInterval: policy.InitialInterval,
+				MaxInterval:     policy.MaxInterval,
+				Multiplier:      2,
+				Logger:          logger,
+				OnRetryHook: func(int, time.Duration) {
+					metrics.HandlerRetries.WithLabelValues(handlerName).Inc()
+				},
+			}
+
+			return retryUnlessCircuitOpen(retry)(next)(msg)
+		}
+	}
+}
+
+// TimeoutMiddleware sets the deadline of the handler on the message context for a single attempt,
+// the context is restored afterwards, so a retry gets a deadline of its own.
+// Attempts which ran out of time are counted in metrics.HandlerTimeouts.
+func (p *HandlerPolicies) TimeoutMiddleware(next message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		handlerName := message.HandlerNameFromCtx(msg.Context())
+
+		timeout := p.Get(handlerName).Timeout
+		if timeout <= 0 {
+			return next(msg)
+		}
+
+		parent := msg.Context()
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+
+		msg.SetContext(ctx)
+		defer msg.SetContext(parent)
+
+		messages, err := next(msg)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+			metrics.HandlerTimeouts.WithLabelValues(handlerName).Inc()
+
+			return messages, fmt.Errorf("handler %s timed out after %s: %w", handlerName, timeout, err)
+		}
+
+		return messages, err
+	}
+}
@@ -0,0 +1,183 @@
+package app_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tickets/app"
+	"tickets/app/metrics"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerPolicies(t *testing.T) {
+	policies := app.NewHandlerPolicies(app.DefaultHandlerPolicy)
+	policies.Set("local-write", app.HandlerPolicy{
+		Timeout: time.Second,
+		Poison:  app.PoisonDrop,
+	})
+	policies.Set("remote-call", app.HandlerPolicy{
+		MaxRetries:      2,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+		Poison:          app.PoisonDrop,
+	})
+
+	poisoned := atomic.Int64{}
+	poisonQueue := func(next message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			poisoned.Add(1)
+			return next(msg)
+		}
+	}
+
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	router.AddMiddleware(
+		policies.PoisonMiddleware(poisonQueue),
+		policies.RetryMiddleware(nil),
+		policies.TimeoutMiddleware,
+	)
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+
+	attempts := map[string]*atomic.Int64{}
+	deadlines := map[string]*atomic.Bool{}
+	for _, name := range []string{"local-write", "remote-call"} {
+		name := name
+		attempts[name] = &atomic.Int64{}
+		deadlines[name] = &atomic.Bool{}
+
+		router.AddNoPublisherHandler(name, name, pubSub, func(msg *message.Message) error {
+			attempts[name].Add(1)
+			_, ok := msg.Context().Deadline()
+			deadlines[name].Store(ok)
+
+			return errors.New("failed")
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = router.Run(ctx)
+	}()
+	<-router.Running()
+
+	for _, name := range []string{"local-write", "remote-call"} {
+		require.NoError(t, pubSub.Publish(name, message.NewMessage(watermill.NewUUID(), []byte("{}"))))
+	}
+
+	assert.Eventually(t, func() bool {
+		return attempts["local-write"].Load() == 1 && attempts["remote-call"].Load() == 3
+	}, time.Second*5, time.Millisecond*10)
+
+	// dropped messages are acked, so they are not redelivered
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int64(1), attempts["local-write"].Load())
+	assert.Equal(t, int64(3), attempts["remote-call"].Load())
+	assert.Equal(t, int64(0), poisoned.Load())
+
+	assert.True(t, deadlines["local-write"].Load())
+	assert.False(t, deadlines["remote-call"].Load())
+
+	assert.Equal(t, app.DefaultHandlerPolicy, policies.Get("unknown"))
+}
+
+func TestHandlerPoliciesTimeout(t *testing.T) {
+	policies := app.NewHandlerPolicies(app.DefaultHandlerPolicy)
+	policies.Set("create-file", app.HandlerPolicy{
+		Timeout: time.Millisecond * 20,
+	})
+
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+
+	handlerErr := make(chan error, 1)
+	router.AddMiddleware(
+		func(next message.HandlerFunc) message.HandlerFunc {
+			return func(msg *message.Message) ([]*message.Message, error) {
+				_, err := next(msg)
+				handlerErr <- err
+				return nil, nil
+			}
+		},
+		policies.RetryMiddleware(nil),
+		policies.TimeoutMiddleware,
+	)
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+
+	router.AddNoPublisherHandler("create-file", "create-file", pubSub, func(msg *message.Message) error {
+		// a call which never returns on its own
+		<-msg.Context().Done()
+		return msg.Context().Err()
+	})
+
+	timeoutsBefore := testutil.ToFloat64(metrics.HandlerTimeouts.WithLabelValues("create-file"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = router.Run(ctx)
+	}()
+	<-router.Running()
+
+	require.NoError(t, pubSub.Publish("create-file", message.NewMessage(watermill.NewUUID(), []byte("{}"))))
+
+	select {
+	case err := <-handlerErr:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorContains(t, err, "handler create-file timed out after 20ms")
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler did not time out")
+	}
+
+	assert.Equal(t, timeoutsBefore+1, testutil.ToFloat64(metrics.HandlerTimeouts.WithLabelValues("create-file")))
+}
+
+func TestHandlerPolicyBudget(t *testing.T) {
+	policy := app.HandlerPolicy{
+		MaxRetries:      8,
+		InitialInterval: time.Millisecond * 500,
+		MaxInterval:     time.Second * 10,
+		Timeout:         time.Second * 15,
+	}
+
+	// 9 attempts, and the backoff of 0.5s, 1s, 2s, 4s and 8s capped at 10s
+	assert.Equal(t, 9*15*time.Second+45500*time.Millisecond, policy.Budget())
+
+	policy.Timeout = 0
+	assert.Zero(t, policy.Budget(), "attempts without a timeout have no budget")
+}
+
+func TestRedisReclaimMinIdleIsLongerThanHandlers(t *testing.T) {
+	t.Setenv("REDIS_CLAIM_MIN_IDLE", "")
+
+	budget := app.MaxHandlerBudget(app.DefaultGatewayCircuitBreakers)
+	// messages held while the circuit is open wait for the breaker after their handler gave up
+	assert.GreaterOrEqual(t, budget, app.DefaultHandlerPolicy.Budget()+app.DefaultGatewayCircuitBreakers.Spreadsheets.OpenTimeout)
+
+	config, err := app.RedisReclaimConfigFromEnv(budget)
+	require.NoError(t, err)
+	assert.Greater(t, config.MinIdle, budget)
+
+	t.Setenv("REDIS_CLAIM_MIN_IDLE", "1m")
+	_, err = app.RedisReclaimConfigFromEnv(budget)
+	assert.Error(t, err, "messages would be reclaimed while their handler retries them")
+
+	t.Setenv("REDIS_CLAIM_MIN_IDLE", "1h")
+	config, err = app.RedisReclaimConfigFromEnv(budget)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, config.MinIdle)
+}
@@ -4,25 +4,76 @@ import (
 	"context"
 	"fmt"
 	"github.com/ThreeDotsLabs/go-event-driven/common/clients/files"
-	"strconv"
+	"net/http"
+	"tickets/app/circuitbreaker"
+	"tickets/app/money"
 	"tickets/app/receipts"
+	"tickets/app/webhooks"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill/components/cqrs"
 	"tickets/app/repositories"
 )
 
+// localWritePolicy is for handlers which only write to the database, their failures are rare and short.
+var localWritePolicy = HandlerPolicy{
+	MaxRetries:      3,
+	InitialInterval: time.Millisecond * 50,
+	MaxInterval:     time.Millisecond * 500,
+	Timeout:         time.Second * 5,
+}
+
+// remoteCallPolicy is for handlers calling the gateway, retries back off longer to wait out short outages,
+// longer ones open the circuit breaker of the client.
+var remoteCallPolicy = HandlerPolicy{
+	MaxRetries:      8,
+	InitialInterval: time.Millisecond * 500,
+	MaxInterval:     time.Second * 10,
+	Timeout:         time.Second * 15,
+}
+
+// MaxHandlerBudget is the longest a delivery can take in any handler of the app, see HandlerPolicy.Budget,
+// including the delay of a message held by delayWhenCircuitOpen while the breaker of its client is open.
+func MaxHandlerBudget(breakers GatewayCircuitBreakers) time.Duration {
+	var budget time.Duration
+	for _, policy := range []HandlerPolicy{DefaultHandlerPolicy, localWritePolicy, remoteCallPolicy} {
+		if policy.Budget() > budget {
+			budget = policy.Budget()
+		}
+	}
+
+	var circuitOpenDelay time.Duration
+	for _, config := range []circuitbreaker.Config{breakers.Receipts, breakers.Spreadsheets, breakers.Files} {
+		openTimeout := config.OpenTimeout
+		if openTimeout <= 0 {
+			openTimeout = circuitbreaker.DefaultConfig.OpenTimeout
+		}
+		if openTimeout > circuitOpenDelay {
+			circuitOpenDelay = openTimeout
+		}
+	}
+
+	return budget + circuitOpenDelay
+}
+
 type injectHandlersInput struct {
 	receiptsClient     receipts.ReceiptsClientInterface
 	ticketsRepo        repositories.TicketsRepository
 	spreadsheetsClient SpreadsheetsClientInterface
 	filesClient        files.ClientWithResponsesInterface
+	processedMessages  repositories.ProcessedMessagesRepository
 	eventBus           *cqrs.EventBus
+	events             *MessageRegistry
+	webhooks           *webhooks.Service
+	policies           *HandlerPolicies
 }
 
 func injectHandlers(input injectHandlersInput, ep *cqrs.EventProcessor) error {
 	receiptsClient := input.receiptsClient
 	ticketsRepo := input.ticketsRepo
 	spreadsheetsClient := input.spreadsheetsClient
+	processedMessages := input.processedMessages
+	policies := input.policies
 
 	issuesReceipt := cqrs.NewEventHandler[TicketBookingConfirmed]("issues-receipt", func(ctx context.Context, event *TicketBookingConfirmed) error {
 		return receiptsClient.IssueReceipt(ctx, receipts.IssueReceiptRequest{
@@ -30,76 +81,158 @@ func injectHandlers(input injectHandlersInput, ep *cqrs.EventProcessor) error {
 			Status:        event.Status.String(),
 			CustomerEmail: event.CustomerEmail,
 			Price: receipts.Price{
-				Amount:   event.Price.Amount,
-				Currency: event.Price.Currency,
+				Amount:   event.Price.Amount(),
+				Currency: event.Price.Currency(),
 			},
 			IdempotencyKey: event.Header.IdempotencyKey,
 		})
 	})
+	policies.Set(issuesReceipt.HandlerName(), remoteCallPolicy)
 
 	storeConfirmed := cqrs.NewEventHandler[TicketBookingConfirmed]("store-confirmed", func(ctx context.Context, event *TicketBookingConfirmed) error {
-		priceAmount, err := strconv.ParseFloat(event.Price.Amount, 64)
-		if err != nil {
-			return err
-		}
-
 		return ticketsRepo.Put(ctx, repositories.Ticket{
 			TicketID:      event.TicketID,
-			PriceAmount:   priceAmount,
-			PriceCurrency: event.Price.Currency,
+			Price:         event.Price,
 			CustomerEmail: event.CustomerEmail,
+			LastEventAt:   event.Header.PublishedAt,
 		})
 	})
+	policies.Set(storeConfirmed.HandlerName(), localWritePolicy)
 
-	deleteCanceled := cqrs.NewEventHandler[TicketCanceledEvent]("remove-canceled", func(ctx context.Context, event *TicketCanceledEvent) error {
-		return ticketsRepo.Delete(ctx, event.TicketID)
+	// the handler name is kept, so it keeps its consumer group
+	cancelTicket := cqrs.NewEventHandler[TicketCanceledEvent]("remove-canceled", func(ctx context.Context, event *TicketCanceledEvent) error {
+		return ticketsRepo.Cancel(ctx, event.TicketID, event.Header.PublishedAt)
 	})
+	policies.Set(cancelTicket.HandlerName(), localWritePolicy)
 
-	printTicket := cqrs.NewEventHandler[TicketBookingConfirmed]("print-ticket", func(ctx context.Context, event *TicketBookingConfirmed) error {
+	printTicket := NewExactlyOnceEventHandler[TicketBookingConfirmed]("print-ticket", processedMessages, func(ctx context.Context, event *TicketBookingConfirmed) error {
 		ticket := event.Ticket
 
 		return spreadsheetsClient.AppendRow(ctx, "tickets-to-print", []string{
 			ticket.TicketID,
 			ticket.CustomerEmail,
-			ticket.Price.Amount,
-			ticket.Price.Currency,
+			ticket.Price.Amount(),
+			ticket.Price.Currency(),
 		})
 	})
+	policies.Set(printTicket.HandlerName(), remoteCallPolicy)
 
-	appendCanceledTicket := cqrs.NewEventHandler[TicketCanceledEvent]("append-canceled", func(ctx context.Context, event *TicketCanceledEvent) error {
+	appendCanceledTicket := NewExactlyOnceEventHandler[TicketCanceledEvent]("append-canceled", processedMessages, func(ctx context.Context, event *TicketCanceledEvent) error {
 		ticket := event.Ticket
 
 		return spreadsheetsClient.AppendRow(ctx, "tickets-to-refund", []string{
 			ticket.TicketID,
 			ticket.CustomerEmail,
-			ticket.Price.Amount,
-			ticket.Price.Currency,
+			ticket.Price.Amount(),
+			ticket.Price.Currency(),
 		})
 	})
+	policies.Set(appendCanceledTicket.HandlerName(), remoteCallPolicy)
 
-	createConfirmationFile := cqrs.NewEventHandler[TicketBookingConfirmed]("create-confirmation-file", func(ctx context.Context, event *TicketBookingConfirmed) error {
-		fileName := fmt.Sprintf("%s-ticket.html", event.TicketID)
-		_, err := input.filesClient.PutFilesFileIdContentWithTextBodyWithResponse(
-			ctx,
-			fileName,
-			"hi")
+	createConfirmationFile := NewExactlyOnceEventHandler[TicketBookingConfirmed]("create-confirmation-file", processedMessages, func(ctx context.Context, event *TicketBookingConfirmed) error {
+		fileName := ticketFileName(event.TicketID)
+		err := createTicketFile(ctx, input.filesClient, fileName)
 		if err != nil {
 			return err
 		}
 
 		return input.eventBus.Publish(ctx, TicketPrinted{
-			Header:   event.Header,
+			Header:   NewChildEventHeader(event.Header),
 			TicketID: event.TicketID,
 			FileName: fileName,
 		})
 	})
+	policies.Set(createConfirmationFile.HandlerName(), remoteCallPolicy)
+
+	// deliveries are only stored here, they are sent by the webhooks worker
+	notifyConfirmed := newNotifyWebhooksHandler("notify-webhooks-confirmed", input, func(event *TicketBookingConfirmed) any {
+		return newTicketWebhookData(event.TicketEvent)
+	})
+	policies.Set(notifyConfirmed.HandlerName(), localWritePolicy)
+	notifyPrinted := newNotifyWebhooksHandler("notify-webhooks-printed", input, func(event *TicketPrinted) any {
+		return TicketPrintedWebhookData{TicketID: event.TicketID, FileName: event.FileName}
+	})
+	policies.Set(notifyPrinted.HandlerName(), localWritePolicy)
+	notifyCanceled := newNotifyWebhooksHandler("notify-webhooks-canceled", input, func(event *TicketCanceledEvent) any {
+		return newTicketWebhookData(event.TicketEvent)
+	})
+	policies.Set(notifyCanceled.HandlerName(), localWritePolicy)
 
 	return ep.AddHandlers(
 		storeConfirmed,
 		issuesReceipt,
 		printTicket,
 		appendCanceledTicket,
-		deleteCanceled,
+		cancelTicket,
 		createConfirmationFile,
+		notifyConfirmed,
+		notifyPrinted,
+		notifyCanceled,
 	)
 }
+
+// newNotifyWebhooksHandler enqueues webhook deliveries of the event, they are sent by the webhooks worker.
+// Only what data returns is sent and stored with the deliveries, never the event itself, as it contains PII.
+func newNotifyWebhooksHandler[T any](handlerName string, input injectHandlersInput, data func(event *T) any) cqrs.EventHandler {
+	return cqrs.NewEventHandler[T](handlerName, func(ctx context.Context, event *T) error {
+		e, ok := any(event).(eventWithHeader)
+		if !ok {
+			return fmt.Errorf("event %T has no header", event)
+		}
+		header := e.GetHeader()
+
+		return input.webhooks.Notify(ctx, webhooks.NotifyInput{
+			EventName:  input.events.Name(event),
+			EventID:    header.ID,
+			OccurredAt: header.PublishedAt,
+			Data:       data(event),
+		})
+	})
+}
+
+// TicketWebhookData is the data of ticket webhooks, it leaves out the customer email.
+type TicketWebhookData struct {
+	TicketID string      `json:"ticket_id"`
+	Status   string      `json:"status"`
+	Price    money.Money `json:"price"`
+}
+
+func newTicketWebhookData(event *TicketEvent) any {
+	if event == nil || event.Ticket == nil {
+		return TicketWebhookData{}
+	}
+
+	return TicketWebhookData{
+		TicketID: event.TicketID,
+		Status:   event.Status.String(),
+		Price:    event.Price,
+	}
+}
+
+type TicketPrintedWebhookData struct {
+	TicketID string `json:"ticket_id"`
+	FileName string `json:"file_name"`
+}
+
+func ticketFileName(ticketID string) string {
+	return fmt.Sprintf("%s-ticket.html", ticketID)
+}
+
+// createTicketFile creates the file once, the files API doesn't overwrite files:
+// 409 means the file was already created by a previous delivery of the message.
+func createTicketFile(ctx context.Context, filesClient files.ClientWithResponsesInterface, fileName string) error {
+	resp, err := filesClient.PutFilesFileIdContentWithTextBodyWithResponse(
+		ctx,
+		fileName,
+		"hi")
+	if err != nil {
+		return err
+	}
+
+	statusCode := resp.StatusCode()
+	if statusCode != http.StatusConflict && (statusCode < 200 || statusCode > 299) {
+		return fmt.Errorf("could not create file %s, unexpected status code: %d", fileName, statusCode)
+	}
+
+	return nil
+}
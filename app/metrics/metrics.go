@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Namespace prefixes the names of all metrics of the service.
+const Namespace = "tickets"
+
+var MessagesReclaimed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "messages_reclaimed_total",
+	Help:      "Messages claimed from the pending list of another, or a restarted, consumer.",
+}, []string{"handler"})
+
+var HandlerTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "handler_timeouts_total",
+	Help:      "Handler attempts which ran out of their deadline.",
+}, []string{"handler"})
+
+var HandlerInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: Namespace,
+	Name:      "handler_in_flight_messages",
+	Help:      "Messages processed at the moment, per handler.",
+}, []string{"handler"})
+
+var UnknownTypeMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "unknown_type_messages_total",
+	Help:      "Messages with a missing or unregistered type, by the policy applied to them.",
+}, []string{"handler", "policy"})
+
+var HandlerRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "handler_retries_total",
+	Help:      "Retries of failed messages, per handler.",
+}, []string{"handler"})
+
+var HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: Namespace,
+	Name:      "http_request_duration_seconds",
+	Help:      "Latency of the HTTP API, by route template and status code.",
+}, []string{"method", "route", "status"})
+
+var GatewayRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: Namespace,
+	Name:      "gateway_request_duration_seconds",
+	Help:      "Latency of the calls to the gateway, by client and status code, the status is \"error\" when no response came.",
+}, []string{"client", "method", "status"})
+
+// Register registers a collector in the default registry. A collector which is already registered
+// is replaced, so dependencies built again (as in tests) report their own state.
+func Register(collector prometheus.Collector) error {
+	err := prometheus.Register(collector)
+
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		prometheus.Unregister(alreadyRegistered.ExistingCollector)
+		return prometheus.Register(collector)
+	}
+
+	return err
+}
@@ -1,75 +1,89 @@
 package app
 
 import (
-	"encoding/json"
+	"errors"
+	"tickets/app/circuitbreaker"
+	"tickets/app/metrics"
+	"tickets/app/poison"
+	"time"
 
 	"github.com/ThreeDotsLabs/go-event-driven/common/log"
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
 	"github.com/sirupsen/logrus"
 )
 
-type LogMiddleware struct {
-	OkMessage  string
-	ErrMessage string
-}
+// minCircuitOpenDelay is how long a message waits when the circuit is half open and its probing call is in progress.
+const minCircuitOpenDelay = time.Second
 
-func (m LogMiddleware) Middleware(next message.HandlerFunc) message.HandlerFunc {
+// delayWhenCircuitOpen holds a message which failed because a circuit breaker is open until the breaker
+// lets calls through again, and only then nacks it. Otherwise it would be redelivered right away and fail the same way.
+func delayWhenCircuitOpen(next message.HandlerFunc) message.HandlerFunc {
 	return func(msg *message.Message) ([]*message.Message, error) {
-		logger := log.FromContext(msg.Context())
+		messages, err := next(msg)
 
-		logger.
-			WithField("message_uuid", msg.UUID).
-			Info(m.OkMessage)
+		var openErr *circuitbreaker.OpenError
+		if !errors.As(err, &openErr) {
+			return messages, err
+		}
 
-		messages, err := next(msg)
-		if err != nil {
-			logger.
-				WithField("message_uuid", msg.UUID).
-				WithField("error", err).
-				Error(m.ErrMessage)
+		delay := time.Until(openErr.RetryAt)
+		if delay < minCircuitOpenDelay {
+			delay = minCircuitOpenDelay
 		}
 
-		return messages, err
-	}
-}
+		log.FromContext(msg.Context()).
+			WithField("message_uuid", msg.UUID).
+			WithField("delay", delay.String()).
+			Warn("Circuit is open, nacking the message with a delay")
 
-// fixCurrency is a middleware that fixes the currency of the ticket price.
-// we get a bug report that sometimes the currency is empty, but we know that
-// the default currency is USD, so we can fix it here.
-func fixCurrency(next message.HandlerFunc) message.HandlerFunc {
-	return func(msg *message.Message) ([]*message.Message, error) {
-		ticket := Ticket{}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
 
-		err := json.Unmarshal(msg.Payload, &ticket)
-		if err != nil {
-			return nil, err
+		select {
+		case <-timer.C:
+		case <-msg.Context().Done():
 		}
 
-		if ticket.Price.Currency == "" {
-			ticket.Price.Currency = "USD"
-		}
+		return nil, err
+	}
+}
 
-		payload, err := json.Marshal(ticket)
-		if err != nil {
-			return nil, err
+// retryUnlessCircuitOpen retries failed messages, except when the circuit is open: the calls would be refused
+// the same way until the breaker's timeout, see delayWhenCircuitOpen.
+func retryUnlessCircuitOpen(retry middleware.Retry) message.HandlerMiddleware {
+	return func(next message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			var openErr error
+
+			// the open circuit is reported to Retry as a success, so it stops retrying
+			retried := retry.Middleware(func(msg *message.Message) ([]*message.Message, error) {
+				messages, err := next(msg)
+				if errors.Is(err, circuitbreaker.ErrOpen) {
+					openErr = err
+					return nil, nil
+				}
+
+				return messages, err
+			})
+
+			messages, err := retried(msg)
+			if openErr != nil {
+				return nil, openErr
+			}
+
+			return messages, err
 		}
-
-		msg.Payload = payload
-
-		return next(msg)
 	}
 }
 
-// skipMessagesWithEmptyType is a middleware that skips messages that don't have a type because
-// we can't process them.
-func skipMessagesWithEmptyType(next message.HandlerFunc) message.HandlerFunc {
+// countInFlight reports the messages a handler is processing in metrics.HandlerInFlight.
+func countInFlight(next message.HandlerFunc) message.HandlerFunc {
 	return func(msg *message.Message) ([]*message.Message, error) {
-		messageType := msg.Metadata.Get("type")
-		if messageType == "" {
-			logrus.WithField("message_uuid", msg.UUID).Error("skipping message due to missing message type")
-			return nil, nil
-		}
+		inFlight := metrics.HandlerInFlight.WithLabelValues(message.HandlerNameFromCtx(msg.Context()))
+		inFlight.Inc()
+		defer inFlight.Dec()
 
 		return next(msg)
 	}
@@ -88,3 +102,48 @@ func injectCorrelationId(next message.HandlerFunc) message.HandlerFunc {
 		return next(msg)
 	}
 }
+
+// RenameLegacyMessages sets the registered name on messages still named after a legacy name,
+// so the middlewares and the processors handle them like the messages published since.
+func RenameLegacyMessages(registries []*MessageRegistry) message.HandlerMiddleware {
+	return func(next message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			name := MessageTypeFromMetadata(msg)
+			for _, registry := range registries {
+				if current := registry.CurrentName(name); current != name {
+					msg.Metadata.Set("name", current)
+					msg.Metadata.Set(MessageTypeKey, current)
+					break
+				}
+			}
+
+			return next(msg)
+		}
+	}
+}
+
+// skipRequeuedForOtherHandlers acks messages that were requeued from the poison queue for a single handler,
+// so the remaining consumer groups of the topic don't process them twice.
+func skipRequeuedForOtherHandlers(next message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		handler := msg.Metadata.Get(poison.RequeueHandlerKey)
+		if handler != "" && handler != message.HandlerNameFromCtx(msg.Context()) {
+			return nil, nil
+		}
+
+		return next(msg)
+	}
+}
+
+// setCorrelationIdMetadata copies the correlation ID from the event header to the message metadata,
+// where injectCorrelationId reads it on the consumer side.
+func setCorrelationIdMetadata(event any, msg *message.Message) error {
+	e, ok := event.(eventWithHeader)
+	if !ok || e.GetHeader().CorrelationID == "" {
+		return nil
+	}
+
+	msg.Metadata.Set("correlation_id", e.GetHeader().CorrelationID)
+
+	return nil
+}
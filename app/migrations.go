@@ -14,8 +14,173 @@ CREATE TABLE IF NOT EXISTS tickets (
 );
 `
 
+const createAuditLog = `
+CREATE TABLE IF NOT EXISTS audit_log (
+	id SERIAL PRIMARY KEY,
+	action VARCHAR(64) NOT NULL,
+	subject_id VARCHAR(255) NOT NULL,
+	actor VARCHAR(255) NOT NULL,
+	details JSONB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+`
+
+const createProcessedMessages = `
+CREATE TABLE IF NOT EXISTS processed_messages (
+	handler_name VARCHAR(255) NOT NULL,
+	event_id VARCHAR(255) NOT NULL,
+	processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (handler_name, event_id)
+);
+`
+
+const addTicketsLastEventAt = `
+ALTER TABLE tickets ADD COLUMN IF NOT EXISTS last_event_at TIMESTAMPTZ NOT NULL DEFAULT '1970-01-01T00:00:00Z';
+`
+
+const createTicketTombstones = `
+CREATE TABLE IF NOT EXISTS ticket_tombstones (
+	ticket_id UUID PRIMARY KEY,
+	canceled_at TIMESTAMPTZ NOT NULL
+);
+`
+
+// addTicketsStatus replaces deleting canceled tickets, the existing rows were all confirmed.
+const addTicketsStatus = `
+ALTER TABLE tickets ADD COLUMN IF NOT EXISTS status VARCHAR(32) NOT NULL DEFAULT 'confirmed';
+ALTER TABLE tickets ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+ALTER TABLE tickets ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+ALTER TABLE tickets ADD COLUMN IF NOT EXISTS canceled_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS tickets_status_idx ON tickets (status);
+`
+
+// alterTicketsPriceAmount drops the scale of price_amount, NUMERIC(10, 2) rounded currencies with 3 decimals.
+// The column is only altered while it has a precision, ALTER COLUMN TYPE rewrites the whole table under a lock.
+const alterTicketsPriceAmount = `
+DO $$
+BEGIN
+	IF EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema()
+			AND table_name = 'tickets'
+			AND column_name = 'price_amount'
+			AND (data_type <> 'numeric' OR numeric_precision IS NOT NULL)
+	) THEN
+		ALTER TABLE tickets ALTER COLUMN price_amount TYPE NUMERIC;
+	END IF;
+END $$;
+`
+
+const createScheduledMessages = `
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+	message_uuid VARCHAR(255) PRIMARY KEY,
+	topic VARCHAR(255) NOT NULL,
+	payload BYTEA NOT NULL,
+	metadata JSONB NOT NULL,
+	deliver_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_messages_deliver_at_idx ON scheduled_messages (deliver_at);
+`
+
+const createTicketSagas = `
+CREATE TABLE IF NOT EXISTS ticket_sagas (
+	ticket_id UUID PRIMARY KEY,
+	status VARCHAR(32) NOT NULL,
+	customer_email VARCHAR(255) NOT NULL,
+	price_amount VARCHAR(32) NOT NULL,
+	price_currency CHAR(3) NOT NULL,
+	idempotency_key VARCHAR(255) NOT NULL,
+	stored_at TIMESTAMPTZ,
+	receipt_issued_at TIMESTAMPTZ,
+	printed_at TIMESTAMPTZ,
+	file_created_at TIMESTAMPTZ,
+	receipt_voided_at TIMESTAMPTZ,
+	refund_appended_at TIMESTAMPTZ,
+	ticket_removed_at TIMESTAMPTZ,
+	failed_step VARCHAR(32),
+	failure_reason TEXT,
+	started_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ticket_sagas_in_progress_idx ON ticket_sagas (started_at) WHERE status = 'in_progress';
+`
+
+const addTicketSagasCorrelationID = `
+ALTER TABLE ticket_sagas ADD COLUMN IF NOT EXISTS correlation_id VARCHAR(255) NOT NULL DEFAULT '';
+`
+
+// alterTicketSagasPriceAmount stores the amount of sagas as NUMERIC like the one of tickets,
+// the column is only altered while it's still VARCHAR.
+const alterTicketSagasPriceAmount = `
+DO $$
+BEGIN
+	IF EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema()
+			AND table_name = 'ticket_sagas'
+			AND column_name = 'price_amount'
+			AND data_type <> 'numeric'
+	) THEN
+		ALTER TABLE ticket_sagas ALTER COLUMN price_amount TYPE NUMERIC USING price_amount::NUMERIC;
+	END IF;
+END $$;
+`
+
+const createWebhooks = `
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+	id UUID PRIMARY KEY,
+	url TEXT NOT NULL,
+	events TEXT[] NOT NULL,
+	secret VARCHAR(255) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id UUID PRIMARY KEY,
+	subscription_id UUID NOT NULL REFERENCES webhook_subscriptions (id),
+	event_id VARCHAR(255) NOT NULL,
+	event_name VARCHAR(255) NOT NULL,
+	payload JSONB NOT NULL,
+	status VARCHAR(32) NOT NULL,
+	attempts INT NOT NULL,
+	next_attempt_at TIMESTAMPTZ NOT NULL,
+	last_status_code INT,
+	last_error TEXT,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	delivered_at TIMESTAMPTZ,
+	UNIQUE (subscription_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, created_at);
+`
+
+var migrations = []string{
+	createTickets,
+	createAuditLog,
+	createProcessedMessages,
+	addTicketsLastEventAt,
+	createTicketTombstones,
+	createScheduledMessages,
+	createTicketSagas,
+	createWebhooks,
+	addTicketsStatus,
+	alterTicketsPriceAmount,
+	addTicketSagasCorrelationID,
+	alterTicketSagasPriceAmount,
+}
+
 func Migrate(db *sqlx.DB) error {
-	_, err := db.Exec(createTickets)
+	for _, migration := range migrations {
+		_, err := db.Exec(migration)
+		if err != nil {
+			return err
+		}
+	}
 
-	return err
+	return nil
 }
@@ -0,0 +1,219 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidAmount    = errors.New("invalid amount")
+	ErrInvalidCurrency  = errors.New("invalid currency")
+	ErrTooPrecise       = errors.New("amount has more decimals than its currency")
+	ErrCurrencyMismatch = errors.New("currencies don't match")
+	ErrOverflow         = errors.New("amount is out of range")
+)
+
+// DefaultScale is the number of decimals of currencies missing in scales.
+const DefaultScale = 2
+
+// scales are the ISO 4217 minor units of the currencies which don't use DefaultScale.
+var scales = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// Scale returns the number of decimals of the currency, for example 2 for USD and 0 for JPY.
+func Scale(currency string) int {
+	if scale, ok := scales[currency]; ok {
+		return scale
+	}
+
+	return DefaultScale
+}
+
+// Money is an exact amount in a currency, kept in minor units of the currency, for example cents.
+// The zero value has no currency, it's used for missing prices.
+type Money struct {
+	units    int64
+	currency string
+}
+
+// Parse reads a decimal amount like "-12.50". Decimals past the scale of the currency must be zeros,
+// amounts are never rounded.
+func Parse(amount string, currency string) (Money, error) {
+	if len(currency) != 3 || strings.IndexFunc(currency, notLetter) >= 0 {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+	}
+
+	digits := strings.TrimPrefix(amount, "-")
+	negative := len(digits) != len(amount)
+
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if whole == "" || strings.IndexFunc(whole, notDigit) >= 0 || strings.IndexFunc(fraction, notDigit) >= 0 ||
+		strings.HasSuffix(digits, ".") {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, amount)
+	}
+
+	scale := Scale(currency)
+	if len(fraction) > scale {
+		if strings.Trim(fraction[scale:], "0") != "" {
+			return Money{}, fmt.Errorf("%w: %q has %d decimals, %s has %d", ErrTooPrecise, amount, len(fraction), currency, scale)
+		}
+		fraction = fraction[:scale]
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+
+	minor := whole + fraction
+	if negative {
+		minor = "-" + minor
+	}
+
+	units, err := strconv.ParseInt(minor, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q", ErrOverflow, amount)
+	}
+
+	return Money{units: units, currency: currency}, nil
+}
+
+// MustParse is Parse for amounts known to be valid, it panics otherwise.
+func MustParse(amount string, currency string) Money {
+	m, err := Parse(amount, currency)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// FromMinorUnits returns the amount of units of the smallest denomination of the currency, for example 1050 cents.
+func FromMinorUnits(units int64, currency string) (Money, error) {
+	m, err := Parse("0", currency)
+	if err != nil {
+		return Money{}, err
+	}
+	m.units = units
+
+	return m, nil
+}
+
+func (m Money) MinorUnits() int64 {
+	return m.units
+}
+
+func (m Money) Currency() string {
+	return m.currency
+}
+
+func (m Money) IsZero() bool {
+	return m.units == 0
+}
+
+// Amount formats the amount with the decimals of its currency, for example "12.50" for USD and "1250" for JPY.
+func (m Money) Amount() string {
+	if m.currency == "" {
+		return ""
+	}
+
+	digits := strconv.FormatInt(m.units, 10)
+	sign := ""
+	if m.units < 0 {
+		sign = "-"
+		digits = digits[1:]
+	}
+
+	scale := Scale(m.currency)
+	if scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+func (m Money) String() string {
+	return m.Amount() + " " + m.currency
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.currency != other.currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.currency, other.currency)
+	}
+
+	if (other.units > 0 && m.units > math.MaxInt64-other.units) || (other.units < 0 && m.units < math.MinInt64-other.units) {
+		return Money{}, ErrOverflow
+	}
+
+	return Money{units: m.units + other.units, currency: m.currency}, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if other.units == math.MinInt64 {
+		return Money{}, ErrOverflow
+	}
+
+	return m.Add(Money{units: -other.units, currency: other.currency})
+}
+
+// Cmp returns -1, 0 or 1 when m is less than, equal to or greater than other.
+func (m Money) Cmp(other Money) (int, error) {
+	if m.currency != other.currency {
+		return 0, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.currency, other.currency)
+	}
+
+	switch {
+	case m.units < other.units:
+		return -1, nil
+	case m.units > other.units:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// jsonMoney keeps the amount a string, so it's not read as a float by clients.
+type jsonMoney struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMoney{Amount: m.Amount(), Currency: m.currency})
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var decoded jsonMoney
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	if decoded.Amount == "" && decoded.Currency == "" {
+		*m = Money{}
+		return nil
+	}
+
+	parsed, err := Parse(decoded.Amount, decoded.Currency)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+
+	return nil
+}
+
+func notDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+func notLetter(r rune) bool {
+	return r < 'A' || r > 'Z'
+}
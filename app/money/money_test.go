@@ -0,0 +1,112 @@
+package money_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"tickets/app/money"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		Amount     string
+		Currency   string
+		MinorUnits int64
+		Formatted  string
+	}{
+		{Amount: "50.00", Currency: "USD", MinorUnits: 5000, Formatted: "50.00"},
+		{Amount: "5", Currency: "USD", MinorUnits: 500, Formatted: "5.00"},
+		{Amount: "0.1", Currency: "EUR", MinorUnits: 10, Formatted: "0.10"},
+		{Amount: "-12.05", Currency: "EUR", MinorUnits: -1205, Formatted: "-12.05"},
+		{Amount: "1500", Currency: "JPY", MinorUnits: 1500, Formatted: "1500"},
+		{Amount: "1500.00", Currency: "JPY", MinorUnits: 1500, Formatted: "1500"},
+		{Amount: "1.005", Currency: "KWD", MinorUnits: 1005, Formatted: "1.005"},
+		{Amount: "0.001", Currency: "KWD", MinorUnits: 1, Formatted: "0.001"},
+		{Amount: "92233720368547758.07", Currency: "USD", MinorUnits: 9223372036854775807, Formatted: "92233720368547758.07"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Amount+" "+tc.Currency, func(t *testing.T) {
+			m, err := money.Parse(tc.Amount, tc.Currency)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.MinorUnits, m.MinorUnits())
+			assert.Equal(t, tc.Formatted, m.Amount())
+			assert.Equal(t, tc.Currency, m.Currency())
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := []struct {
+		Amount   string
+		Currency string
+		Err      error
+	}{
+		{Amount: "10.005", Currency: "USD", Err: money.ErrTooPrecise},
+		{Amount: "1500.5", Currency: "JPY", Err: money.ErrTooPrecise},
+		{Amount: "", Currency: "USD", Err: money.ErrInvalidAmount},
+		{Amount: "1e3", Currency: "USD", Err: money.ErrInvalidAmount},
+		{Amount: ".5", Currency: "USD", Err: money.ErrInvalidAmount},
+		{Amount: "5.", Currency: "USD", Err: money.ErrInvalidAmount},
+		{Amount: "1,50", Currency: "USD", Err: money.ErrInvalidAmount},
+		{Amount: "10.00", Currency: "usd", Err: money.ErrInvalidCurrency},
+		{Amount: "10.00", Currency: "", Err: money.ErrInvalidCurrency},
+		{Amount: "92233720368547758.08", Currency: "USD", Err: money.ErrOverflow},
+		{Amount: "1000000000000000000", Currency: "USD", Err: money.ErrOverflow},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Amount+" "+tc.Currency, func(t *testing.T) {
+			_, err := money.Parse(tc.Amount, tc.Currency)
+			assert.ErrorIs(t, err, tc.Err)
+		})
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	sum, err := money.MustParse("0.10", "USD").Add(money.MustParse("0.20", "USD"))
+	require.NoError(t, err)
+	assert.Equal(t, "0.30", sum.Amount())
+
+	difference, err := sum.Sub(money.MustParse("0.30", "USD"))
+	require.NoError(t, err)
+	assert.True(t, difference.IsZero())
+
+	cmp, err := money.MustParse("1.005", "KWD").Cmp(money.MustParse("1.01", "KWD"))
+	require.NoError(t, err)
+	assert.Equal(t, -1, cmp)
+
+	_, err = money.MustParse("1", "USD").Add(money.MustParse("1", "EUR"))
+	assert.ErrorIs(t, err, money.ErrCurrencyMismatch)
+
+	max, err := money.FromMinorUnits(9223372036854775807, "USD")
+	require.NoError(t, err)
+	_, err = max.Add(money.MustParse("0.01", "USD"))
+	assert.ErrorIs(t, err, money.ErrOverflow)
+}
+
+func TestJSON(t *testing.T) {
+	type ticket struct {
+		Price money.Money `json:"price"`
+	}
+
+	payload, err := json.Marshal(ticket{Price: money.MustParse("1500", "JPY")})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"price":{"amount":"1500","currency":"JPY"}}`, string(payload))
+
+	var decoded ticket
+	require.NoError(t, json.Unmarshal([]byte(`{"price":{"amount":"2.5","currency":"KWD"}}`), &decoded))
+	assert.Equal(t, "2.500", decoded.Price.Amount())
+
+	// missing prices stay missing
+	require.NoError(t, json.Unmarshal([]byte(`{"price":null}`), &decoded))
+	require.NoError(t, json.Unmarshal([]byte(`{"price":{}}`), &decoded))
+	assert.Equal(t, money.Money{}, decoded.Price)
+
+	err = json.Unmarshal([]byte(`{"price":{"amount":"2.5","currency":"JPY"}}`), &decoded)
+	assert.ErrorIs(t, err, money.ErrTooPrecise)
+}
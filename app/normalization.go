@@ -0,0 +1,182 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// PayloadFixer repairs a known defect of a message payload, and returns the payload as it is when there is nothing to fix.
+type PayloadFixer func(payload []byte) ([]byte, error)
+
+// DefaultCurrency is the currency of prices sent without one.
+// We get a bug report that sometimes the currency is empty, but we know that the default currency is USD.
+const DefaultCurrency = "USD"
+
+// DefaultPriceCurrency fills in the price currency of ticket payloads.
+var DefaultPriceCurrency = DefaultString(DefaultCurrency, "price", "currency")
+
+// PayloadNormalizer runs the fixers registered for the type of a message before it's handled.
+// Messages of types without fixers are not touched.
+type PayloadNormalizer struct {
+	fixers map[string][]PayloadFixer
+}
+
+func NewPayloadNormalizer() *PayloadNormalizer {
+	return &PayloadNormalizer{
+		fixers: make(map[string][]PayloadFixer),
+	}
+}
+
+// NewTicketPayloadNormalizer registers the fixers of the events of this service.
+func NewTicketPayloadNormalizer(events *MessageRegistry) *PayloadNormalizer {
+	normalizer := NewPayloadNormalizer()
+	normalizer.Register(events.Name(TicketBookingConfirmed{}), DefaultPriceCurrency)
+	normalizer.Register(events.Name(TicketCanceledEvent{}), DefaultPriceCurrency)
+
+	return normalizer
+}
+
+// Register adds fixers for messages of the given type, they run in the order they were registered.
+func (n *PayloadNormalizer) Register(messageType string, fixers ...PayloadFixer) {
+	n.fixers[messageType] = append(n.fixers[messageType], fixers...)
+}
+
+func (n *PayloadNormalizer) Normalize(messageType string, payload []byte) ([]byte, error) {
+	var err error
+	for _, fix := range n.fixers[messageType] {
+		payload, err = fix(payload)
+		if err != nil {
+			return nil, fmt.Errorf("could not normalize %s payload: %w", messageType, err)
+		}
+	}
+
+	return payload, nil
+}
+
+func (n *PayloadNormalizer) Middleware(next message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		payload, err := n.Normalize(MessageTypeFromMetadata(msg), msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Payload = payload
+
+		return next(msg)
+	}
+}
+
+// DefaultString sets the string at the path of JSON object keys when it's empty, null or missing.
+// Only the bytes of the fixed value change, the rest of the payload is kept byte for byte,
+// so fields unknown to this service and the formatting survive. A missing parent object is left missing.
+func DefaultString(value string, path ...string) PayloadFixer {
+	encoded, _ := json.Marshal(value)
+
+	return func(payload []byte) ([]byte, error) {
+		return defaultJSONString(payload, path, encoded)
+	}
+}
+
+func defaultJSONString(raw []byte, path []string, value []byte) ([]byte, error) {
+	if len(path) == 0 {
+		var current *string
+		err := json.Unmarshal(raw, &current)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && *current != "" {
+			return raw, nil
+		}
+
+		return value, nil
+	}
+
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return raw, nil
+	}
+
+	start, end, ok, err := jsonFieldBounds(raw, path[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if len(path) > 1 {
+			return raw, nil
+		}
+
+		return insertJSONField(raw, path[0], value)
+	}
+
+	fixed, err := defaultJSONString(raw[start:end], path[1:], value)
+	if err != nil {
+		return nil, err
+	}
+
+	return spliceBytes(raw, start, end, fixed), nil
+}
+
+// jsonFieldBounds returns where the value of a field of a JSON object starts and ends.
+// The last one wins when the field is repeated, like in encoding/json.
+func jsonFieldBounds(object []byte, name string) (start int, end int, ok bool, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(object))
+
+	token, err := decoder.Token()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if token != json.Delim('{') {
+		return 0, 0, false, fmt.Errorf("expected a JSON object, got %v", token)
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		var value json.RawMessage
+		err = decoder.Decode(&value)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		if key == name {
+			end = int(decoder.InputOffset())
+			start = end - len(value)
+			ok = true
+		}
+	}
+
+	return start, end, ok, nil
+}
+
+// insertJSONField adds the field at the beginning of the object.
+func insertJSONField(object []byte, name string, value []byte) ([]byte, error) {
+	key, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+
+	opening := bytes.IndexByte(object, '{')
+	if opening < 0 {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+
+	field := append(append(key, ':'), value...)
+	if !bytes.HasPrefix(bytes.TrimSpace(object[opening+1:]), []byte("}")) {
+		field = append(field, ',')
+	}
+
+	return spliceBytes(object, opening+1, opening+1, field), nil
+}
+
+func spliceBytes(b []byte, start int, end int, replacement []byte) []byte {
+	spliced := make([]byte, 0, len(b)-(end-start)+len(replacement))
+	spliced = append(spliced, b[:start]...)
+	spliced = append(spliced, replacement...)
+
+	return append(spliced, b[end:]...)
+}
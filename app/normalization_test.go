@@ -0,0 +1,102 @@
+package app_test
+
+import (
+	"testing"
+
+	"tickets/app"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadNormalizer(t *testing.T) {
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+
+	normalizer := app.NewTicketPayloadNormalizer(events)
+
+	testCases := []struct {
+		Name        string
+		MessageType string
+		Payload     string
+		Expected    string
+	}{
+		{
+			Name:        "empty currency",
+			MessageType: "TicketBookingConfirmed",
+			Payload:     `{"header": {"id": "1", "new_field": [1, 2]}, "ticket_id": "t1", "price": {"amount": "10.00", "currency": ""}}`,
+			Expected:    `{"header": {"id": "1", "new_field": [1, 2]}, "ticket_id": "t1", "price": {"amount": "10.00", "currency": "USD"}}`,
+		},
+		{
+			Name:        "missing currency",
+			MessageType: "TicketBookingCanceled",
+			Payload:     `{"ticket_id":"t1","price":{"amount":"10.00"},"z":1}`,
+			Expected:    `{"ticket_id":"t1","price":{"currency":"USD","amount":"10.00"},"z":1}`,
+		},
+		{
+			Name:        "empty price",
+			MessageType: "TicketBookingConfirmed",
+			Payload:     `{"price": { }}`,
+			Expected:    `{"price": {"currency":"USD" }}`,
+		},
+		{
+			Name:        "currency set",
+			MessageType: "TicketBookingConfirmed",
+			Payload:     `{"price": {"amount": "10.00", "currency": "EUR"}}`,
+			Expected:    `{"price": {"amount": "10.00", "currency": "EUR"}}`,
+		},
+		{
+			Name:        "no price",
+			MessageType: "TicketBookingConfirmed",
+			Payload:     `{"ticket_id": "t1", "price": null}`,
+			Expected:    `{"ticket_id": "t1", "price": null}`,
+		},
+		{
+			// it used to be rewritten into a ticket, losing the header and the file name
+			Name:        "ticket printed",
+			MessageType: "TicketPrinted",
+			Payload:     `{"header":{"id":"1","published_at":"2024-01-01T00:00:00Z"},  "ticket_id":"t1","file_name":"t1-ticket.html"}`,
+			Expected:    `{"header":{"id":"1","published_at":"2024-01-01T00:00:00Z"},  "ticket_id":"t1","file_name":"t1-ticket.html"}`,
+		},
+		{
+			Name:        "unknown type",
+			MessageType: "SomethingElse",
+			Payload:     `not even json`,
+			Expected:    `not even json`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			msg := message.NewMessage(watermill.NewUUID(), []byte(tc.Payload))
+			msg.Metadata.Set(app.MessageTypeKey, tc.MessageType)
+
+			var handled string
+			_, err := normalizer.Middleware(func(msg *message.Message) ([]*message.Message, error) {
+				handled = string(msg.Payload)
+				return nil, nil
+			})(msg)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.Expected, handled)
+		})
+	}
+}
+
+func TestPayloadNormalizerFallsBackToName(t *testing.T) {
+	normalizer := app.NewPayloadNormalizer()
+	normalizer.Register("TicketBookingConfirmed", app.DefaultPriceCurrency)
+
+	// published before the type metadata was set
+	msg := message.NewMessage(watermill.NewUUID(), []byte(`{"price":{"currency":""}}`))
+	msg.Metadata.Set("name", "TicketBookingConfirmed")
+
+	payload, err := normalizer.Normalize(app.MessageTypeFromMetadata(msg), msg.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, `{"price":{"currency":"USD"}}`, string(payload))
+
+	_, err = normalizer.Normalize("TicketBookingConfirmed", []byte(`{"price":{"currency":5}}`))
+	assert.Error(t, err)
+}
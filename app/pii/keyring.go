@@ -0,0 +1,221 @@
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedPrefix starts every encrypted value: "pii:v1:<key ID>:<wrapped data key>:<ciphertext>".
+	encryptedPrefix = "pii:v1:"
+
+	keySize = 32
+)
+
+var ErrUnknownKey = errors.New("unknown PII key")
+
+// keyringFile is the layout of the keyring file, keys are base64 encoded 256-bit AES keys:
+//
+//	{"primary": "2024-02", "keys": {"2024-01": "...", "2024-02": "..."}}
+type keyringFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// Keyring holds the key encryption keys by ID. New values are encrypted with the primary key,
+// the other keys are kept to decrypt messages published before a rotation.
+//
+// To rotate: add the new key to the file on all replicas first, then make it primary,
+// and remove the old key only after the messages encrypted with it are gone from the streams.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q is not in the keyring", primary)
+	}
+
+	keyring := &Keyring{
+		primary: primary,
+		keys:    make(map[string]cipher.AEAD, len(keys)),
+	}
+
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key ID %q", id)
+		}
+		if len(key) != keySize {
+			return nil, fmt.Errorf("key %q must have %d bytes", id, keySize)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[id] = aead
+	}
+
+	return keyring, nil
+}
+
+// LoadKeyring reads a keyring file, see keyringFile for its layout.
+func LoadKeyring(path string) (*Keyring, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyringFile
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring file %s: %w", path, err)
+	}
+
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not base64: %w", id, err)
+		}
+		keys[id] = key
+	}
+
+	return NewKeyring(file.Primary, keys)
+}
+
+// GenerateKeyring returns a keyring with a single random key, it's meant for running in memory,
+// where nothing outlives the process.
+func GenerateKeyring() (*Keyring, error) {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKeyring("generated", map[string][]byte{"generated": key})
+}
+
+// Encrypt seals the value with a fresh data key, and the data key with the primary key.
+func (k *Keyring) Encrypt(value string) (string, error) {
+	dataKey := make([]byte, keySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dataAEAD, []byte(value), nil)
+	if err != nil {
+		return "", err
+	}
+
+	// the key ID is authenticated, so a wrapped key can't be passed off as wrapped by another key
+	wrappedKey, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + k.primary +
+		":" + base64.RawURLEncoding.EncodeToString(wrappedKey) +
+		":" + base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt opens a value returned by Encrypt with the key it was encrypted with.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if !IsEncrypted(value) || len(parts) != 3 {
+		return "", errors.New("value is not encrypted PII")
+	}
+	keyID := parts[0]
+
+	keyAEAD, ok := k.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := open(keyAEAD, wrappedKey, []byte(keyID))
+	if err != nil {
+		return "", fmt.Errorf("could not unwrap data key of key %q: %w", keyID, err)
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataAEAD, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// IsEncrypted reports if the value was returned by Encrypt.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// KeyID returns the ID of the key an encrypted value was encrypted with.
+func KeyID(value string) (string, bool) {
+	if !IsEncrypted(value) {
+		return "", false
+	}
+
+	id, _, ok := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+
+	return id, ok
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal returns the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
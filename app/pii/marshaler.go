@@ -0,0 +1,251 @@
+package pii
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Marshaler encrypts the string fields tagged with `pii:"true"` in the payloads of the wrapped marshaler,
+// and decrypts them when unmarshaling. Only the tagged fields are touched, so the rest of the payload stays readable.
+//
+// Fields which are not encrypted are unmarshaled as they are, so messages published before the encryption
+// was enabled can still be processed. With a nil Keyring nothing is encrypted.
+type Marshaler struct {
+	cqrs.CommandEventMarshaler
+	Keyring *Keyring
+}
+
+func (m Marshaler) Marshal(v any) (*message.Message, error) {
+	msg, err := m.CommandEventMarshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Keyring == nil {
+		return msg, nil
+	}
+
+	msg.Payload, err = transformFields(msg.Payload, fieldPaths(reflect.TypeOf(v)), func(value string) (string, error) {
+		if value == "" || IsEncrypted(value) {
+			return value, nil
+		}
+
+		return m.Keyring.Encrypt(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Unmarshal leaves msg as it is, so a message sent to the poison queue keeps its fields encrypted.
+func (m Marshaler) Unmarshal(msg *message.Message, v any) error {
+	payload, err := transformFields(msg.Payload, fieldPaths(reflect.TypeOf(v)), func(value string) (string, error) {
+		if !IsEncrypted(value) {
+			return value, nil
+		}
+		if m.Keyring == nil {
+			return "", fmt.Errorf("%w: no keyring is configured", ErrUnknownKey)
+		}
+
+		return m.Keyring.Decrypt(value)
+	})
+	if err != nil {
+		return err
+	}
+
+	decrypted := message.NewMessage(msg.UUID, payload)
+	decrypted.Metadata = msg.Metadata
+	decrypted.SetContext(msg.Context())
+
+	return m.CommandEventMarshaler.Unmarshal(decrypted, v)
+}
+
+// Masked replaces PII in payloads masked by MaskFields.
+const Masked = "***"
+
+// MaskFields replaces the values of the tagged fields of a payload of type t with Masked, whether they are
+// encrypted or not, so the payload can be logged. The payload is re-encoded, so the order of fields may change.
+func MaskFields(payload []byte, t reflect.Type) ([]byte, error) {
+	return transformFields(payload, fieldPaths(t), func(value string) (string, error) {
+		if value == "" {
+			return value, nil
+		}
+
+		return Masked, nil
+	})
+}
+
+// MaskStrings replaces every non-empty string in a JSON payload with Masked, it's meant for payloads of unknown types,
+// whose PII fields can't be told. Keys, numbers and booleans are kept, so the shape of the payload stays visible.
+func MaskStrings(payload []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var value any
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(maskStrings(value))
+}
+
+func maskStrings(value any) any {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return v
+		}
+		return Masked
+	case map[string]any:
+		for key, field := range v {
+			v[key] = maskStrings(field)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = maskStrings(item)
+		}
+	}
+
+	return value
+}
+
+var fieldPathsCache sync.Map
+
+// fieldPaths returns the JSON paths of the tagged string fields of a struct type,
+// fields of embedded structs are promoted like encoding/json does.
+func fieldPaths(t reflect.Type) [][]string {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	if cached, ok := fieldPathsCache.Load(t); ok {
+		return cached.([][]string)
+	}
+
+	paths := structFieldPaths(t, map[reflect.Type]bool{})
+	fieldPathsCache.Store(t, paths)
+
+	return paths
+}
+
+func structFieldPaths(t reflect.Type, visiting map[reflect.Type]bool) [][]string {
+	if visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	var paths [][]string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+
+		name, named := jsonName(field)
+		if name == "-" {
+			continue
+		}
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+
+		if field.Tag.Get("pii") == "true" {
+			if fieldType.Kind() == reflect.String {
+				paths = append(paths, []string{name})
+			}
+			continue
+		}
+
+		if fieldType.Kind() != reflect.Struct {
+			continue
+		}
+
+		for _, path := range structFieldPaths(fieldType, visiting) {
+			if field.Anonymous && !named {
+				paths = append(paths, path)
+			} else {
+				paths = append(paths, append([]string{name}, path...))
+			}
+		}
+	}
+
+	return paths
+}
+
+// jsonName returns the name of the field in JSON, and if it's set by the json tag.
+func jsonName(field reflect.StructField) (string, bool) {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name, false
+	}
+
+	return name, true
+}
+
+func transformFields(payload []byte, paths [][]string, transform func(string) (string, error)) ([]byte, error) {
+	var err error
+	for _, path := range paths {
+		payload, err = transformField(payload, path, transform)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return payload, nil
+}
+
+func transformField(raw json.RawMessage, path []string, transform func(string) (string, error)) (json.RawMessage, error) {
+	if string(raw) == "null" {
+		return raw, nil
+	}
+
+	if len(path) == 0 {
+		var value string
+		err := json.Unmarshal(raw, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err = transform(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(value)
+	}
+
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	field, ok := fields[path[0]]
+	if !ok {
+		return raw, nil
+	}
+
+	fields[path[0]], err = transformField(field, path[1:], transform)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
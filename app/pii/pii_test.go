@@ -0,0 +1,162 @@
+package pii_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"tickets/app/pii"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Customer struct {
+	Email string `json:"customer_email" pii:"true"`
+	Name  string `json:"name"`
+}
+
+type booked struct {
+	*Customer
+	Billing  Customer `json:"billing"`
+	TicketID string   `json:"ticket_id"`
+}
+
+func TestMarshalerEncryptsTaggedFields(t *testing.T) {
+	keyring, err := pii.NewKeyring("2024-01", map[string][]byte{"2024-01": key(1)})
+	require.NoError(t, err)
+
+	marshaler := pii.Marshaler{
+		CommandEventMarshaler: cqrs.JSONMarshaler{},
+		Keyring:               keyring,
+	}
+
+	event := booked{
+		Customer: &Customer{Email: "alice@example.com", Name: "Alice"},
+		Billing:  Customer{Email: "billing@example.com"},
+		TicketID: "ticket-1",
+	}
+
+	msg, err := marshaler.Marshal(event)
+	require.NoError(t, err)
+
+	assert.NotContains(t, string(msg.Payload), "example.com")
+	assert.Contains(t, string(msg.Payload), `"ticket_id":"ticket-1"`)
+	assert.Contains(t, string(msg.Payload), `"name":"Alice"`)
+	// the event itself is not changed
+	assert.Equal(t, "alice@example.com", event.Email)
+
+	fields := map[string]any{}
+	require.NoError(t, json.Unmarshal(msg.Payload, &fields))
+	keyID, ok := pii.KeyID(fields["customer_email"].(string))
+	require.True(t, ok)
+	assert.Equal(t, "2024-01", keyID)
+
+	payload := bytes.Clone(msg.Payload)
+
+	var received booked
+	require.NoError(t, marshaler.Unmarshal(msg, &received))
+	assert.Equal(t, event, received)
+	assert.Equal(t, payload, []byte(msg.Payload), "the message keeps the encrypted payload")
+}
+
+func TestMarshalerDecryptsAfterRotation(t *testing.T) {
+	oldKeyring, err := pii.NewKeyring("2024-01", map[string][]byte{"2024-01": key(1)})
+	require.NoError(t, err)
+
+	event := booked{Customer: &Customer{Email: "alice@example.com"}}
+
+	msg, err := pii.Marshaler{CommandEventMarshaler: cqrs.JSONMarshaler{}, Keyring: oldKeyring}.Marshal(event)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	err = os.WriteFile(path, []byte(`{
+		"primary": "2024-02",
+		"keys": {
+			"2024-01": "`+base64.StdEncoding.EncodeToString(key(1))+`",
+			"2024-02": "`+base64.StdEncoding.EncodeToString(key(2))+`"
+		}
+	}`), 0o600)
+	require.NoError(t, err)
+
+	rotated, err := pii.LoadKeyring(path)
+	require.NoError(t, err)
+	marshaler := pii.Marshaler{CommandEventMarshaler: cqrs.JSONMarshaler{}, Keyring: rotated}
+
+	var received booked
+	require.NoError(t, marshaler.Unmarshal(msg, &received))
+	assert.Equal(t, "alice@example.com", received.Email)
+
+	encrypted, err := rotated.Encrypt("alice@example.com")
+	require.NoError(t, err)
+	keyID, _ := pii.KeyID(encrypted)
+	assert.Equal(t, "2024-02", keyID)
+
+	// once the old key is removed, its messages can't be read
+	withoutOldKey, err := pii.NewKeyring("2024-02", map[string][]byte{"2024-02": key(2)})
+	require.NoError(t, err)
+	err = pii.Marshaler{CommandEventMarshaler: cqrs.JSONMarshaler{}, Keyring: withoutOldKey}.Unmarshal(msg, &received)
+	assert.ErrorIs(t, err, pii.ErrUnknownKey)
+}
+
+func TestMarshalerReadsClearTextFields(t *testing.T) {
+	keyring, err := pii.GenerateKeyring()
+	require.NoError(t, err)
+
+	event := booked{Customer: &Customer{Email: "alice@example.com"}}
+
+	// published before the encryption was enabled
+	msg, err := pii.Marshaler{CommandEventMarshaler: cqrs.JSONMarshaler{}}.Marshal(event)
+	require.NoError(t, err)
+	assert.Contains(t, string(msg.Payload), "alice@example.com")
+
+	var received booked
+	require.NoError(t, pii.Marshaler{CommandEventMarshaler: cqrs.JSONMarshaler{}, Keyring: keyring}.Unmarshal(msg, &received))
+	assert.Equal(t, "alice@example.com", received.Email)
+}
+
+func TestMaskFields(t *testing.T) {
+	keyring, err := pii.GenerateKeyring()
+	require.NoError(t, err)
+
+	event := booked{
+		Customer: &Customer{Email: "alice@example.com", Name: "Alice"},
+		TicketID: "ticket-1",
+	}
+
+	clearText, err := pii.Marshaler{CommandEventMarshaler: cqrs.JSONMarshaler{}}.Marshal(event)
+	require.NoError(t, err)
+	encrypted, err := pii.Marshaler{CommandEventMarshaler: cqrs.JSONMarshaler{}, Keyring: keyring}.Marshal(event)
+	require.NoError(t, err)
+
+	for _, payload := range [][]byte{clearText.Payload, encrypted.Payload} {
+		masked, err := pii.MaskFields(payload, reflect.TypeOf(booked{}))
+		require.NoError(t, err)
+
+		fields := map[string]any{}
+		require.NoError(t, json.Unmarshal(masked, &fields))
+		assert.Equal(t, pii.Masked, fields["customer_email"])
+		assert.Equal(t, "Alice", fields["name"])
+		assert.Equal(t, "ticket-1", fields["ticket_id"])
+		// empty fields are not masked, so it's visible they are missing
+		assert.Equal(t, "", fields["billing"].(map[string]any)["customer_email"])
+	}
+}
+
+func TestMaskStrings(t *testing.T) {
+	masked, err := pii.MaskStrings([]byte(`{"email":"alice@example.com","tags":["vip",""],"seats":2,"paid":true,"note":null}`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"email":"***","tags":["***",""],"seats":2,"paid":true,"note":null}`, string(masked))
+
+	_, err = pii.MaskStrings([]byte("not json"))
+	assert.Error(t, err)
+}
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
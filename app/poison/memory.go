@@ -0,0 +1,83 @@
+package poison
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// MemoryQueue keeps the poisoned messages in memory. It's meant for the in-memory Pub/Sub,
+// which doesn't keep the messages anywhere it could be read from.
+type MemoryQueue struct {
+	lock     sync.Mutex
+	nextID   int64
+	messages []Message
+}
+
+// NewMemoryQueue consumes the poison queue topic until the subscriber is closed.
+func NewMemoryQueue(subscriber message.Subscriber, topic string) (*MemoryQueue, error) {
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &MemoryQueue{}
+
+	go func() {
+		for msg := range messages {
+			q.add(msg)
+			msg.Ack()
+		}
+	}()
+
+	return q, nil
+}
+
+func (q *MemoryQueue) List(_ context.Context, limit int64) ([]Message, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	count := len(q.messages)
+	if int64(count) > limit {
+		count = int(limit)
+	}
+
+	return append([]Message{}, q.messages[:count]...), nil
+}
+
+func (q *MemoryQueue) Get(_ context.Context, id string) (Message, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, msg := range q.messages {
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+
+	return Message{}, ErrMessageNotFound
+}
+
+func (q *MemoryQueue) Delete(_ context.Context, id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, msg := range q.messages {
+		if msg.ID == id {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrMessageNotFound
+}
+
+func (q *MemoryQueue) add(msg *message.Message) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.nextID++
+	q.messages = append(q.messages, newMessage(strconv.FormatInt(q.nextID, 10), msg))
+}
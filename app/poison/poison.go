@@ -0,0 +1,111 @@
+package poison
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrMessageNotFound = errors.New("poisoned message not found")
+
+type Message struct {
+	ID          string            `json:"id"`
+	MessageUUID string            `json:"message_uuid"`
+	Topic       string            `json:"topic"`
+	Handler     string            `json:"handler"`
+	Subscriber  string            `json:"subscriber"`
+	Error       string            `json:"error"`
+	Payload     string            `json:"payload"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+type Queue interface {
+	List(ctx context.Context, limit int64) ([]Message, error)
+	Get(ctx context.Context, id string) (Message, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// RedisQueue reads the poison queue straight from its redis stream, so entries can be
+// addressed by their stream ID.
+type RedisQueue struct {
+	client       redis.UniversalClient
+	stream       string
+	unmarshaller redisstream.Unmarshaller
+}
+
+func NewRedisQueue(client redis.UniversalClient, stream string) *RedisQueue {
+	return &RedisQueue{
+		client:       client,
+		stream:       stream,
+		unmarshaller: redisstream.DefaultMarshallerUnmarshaller{},
+	}
+}
+
+func (q *RedisQueue) List(ctx context.Context, limit int64) ([]Message, error) {
+	entries, err := q.client.XRangeN(ctx, q.stream, "-", "+", limit).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(entries))
+	for _, entry := range entries {
+		msg, err := q.toMessage(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+func (q *RedisQueue) Get(ctx context.Context, id string) (Message, error) {
+	entries, err := q.client.XRangeN(ctx, q.stream, id, id, 1).Result()
+	if err != nil {
+		return Message{}, err
+	}
+	if len(entries) == 0 {
+		return Message{}, ErrMessageNotFound
+	}
+
+	return q.toMessage(entries[0])
+}
+
+func (q *RedisQueue) Delete(ctx context.Context, id string) error {
+	deleted, err := q.client.XDel(ctx, q.stream, id).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func (q *RedisQueue) toMessage(entry redis.XMessage) (Message, error) {
+	msg, err := q.unmarshaller.Unmarshal(entry.Values)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return newMessage(entry.ID, msg), nil
+}
+
+func newMessage(id string, msg *message.Message) Message {
+	return Message{
+		ID:          id,
+		MessageUUID: msg.UUID,
+		Topic:       msg.Metadata.Get(middleware.PoisonedTopicKey),
+		Handler:     msg.Metadata.Get(middleware.PoisonedHandlerKey),
+		Subscriber:  msg.Metadata.Get(middleware.PoisonedSubscriberKey),
+		Error:       msg.Metadata.Get(middleware.ReasonForPoisonedKey),
+		Payload:     string(msg.Payload),
+		Metadata:    msg.Metadata,
+	}
+}
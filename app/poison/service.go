@@ -0,0 +1,155 @@
+package poison
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+)
+
+// RequeueHandlerKey marks a requeued message as addressed to a single handler,
+// every other consumer group of the topic acks it without processing.
+const RequeueHandlerKey = "requeue_handler"
+
+const (
+	AuditActionRequeue = "poison.requeue"
+	AuditActionDiscard = "poison.discard"
+)
+
+var ErrMissingTopic = errors.New("poisoned message has no original topic")
+
+type Service interface {
+	List(ctx context.Context, limit int64) ([]Message, error)
+	Requeue(ctx context.Context, input RequeueInput) error
+	Discard(ctx context.Context, input DiscardInput) error
+}
+
+type RequeueInput struct {
+	ID string
+	// Handler is optional, when empty the message is redelivered to every handler of the topic.
+	Handler string
+	Actor   string
+}
+
+type DiscardInput struct {
+	ID    string
+	Actor string
+}
+
+type NewServiceInput struct {
+	Queue     Queue
+	Publisher message.Publisher
+	AuditLog  repositories.AuditLogRepository
+}
+
+type service struct {
+	queue     Queue
+	publisher message.Publisher
+	auditLog  repositories.AuditLogRepository
+}
+
+func NewService(input NewServiceInput) Service {
+	return &service{
+		queue:     input.Queue,
+		publisher: input.Publisher,
+		auditLog:  input.AuditLog,
+	}
+}
+
+func (s *service) List(ctx context.Context, limit int64) ([]Message, error) {
+	return s.queue.List(ctx, limit)
+}
+
+func (s *service) Requeue(ctx context.Context, input RequeueInput) error {
+	poisoned, err := s.queue.Get(ctx, input.ID)
+	if err != nil {
+		return err
+	}
+	if poisoned.Topic == "" {
+		return ErrMissingTopic
+	}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte(poisoned.Payload))
+	for key, value := range poisoned.Metadata {
+		msg.Metadata.Set(key, value)
+	}
+	for _, key := range []string{
+		middleware.ReasonForPoisonedKey,
+		middleware.PoisonedTopicKey,
+		middleware.PoisonedHandlerKey,
+		middleware.PoisonedSubscriberKey,
+		RequeueHandlerKey,
+	} {
+		delete(msg.Metadata, key)
+	}
+	if input.Handler != "" {
+		msg.Metadata.Set(RequeueHandlerKey, input.Handler)
+	}
+
+	err = s.publisher.Publish(poisoned.Topic, msg)
+	if err != nil {
+		return err
+	}
+
+	err = s.queue.Delete(ctx, input.ID)
+	if err != nil {
+		return err
+	}
+
+	s.audit(ctx, AuditActionRequeue, input.ID, input.Actor, map[string]string{
+		"topic":            poisoned.Topic,
+		"handler":          input.Handler,
+		"message_uuid":     poisoned.MessageUUID,
+		"new_message_uuid": msg.UUID,
+	})
+
+	return nil
+}
+
+func (s *service) Discard(ctx context.Context, input DiscardInput) error {
+	poisoned, err := s.queue.Get(ctx, input.ID)
+	if err != nil {
+		return err
+	}
+
+	err = s.queue.Delete(ctx, input.ID)
+	if err != nil {
+		return err
+	}
+
+	// the payload is left out, without a keyring it has the PII of the customer in plain text
+	s.audit(ctx, AuditActionDiscard, input.ID, input.Actor, map[string]string{
+		"topic":        poisoned.Topic,
+		"message_uuid": poisoned.MessageUUID,
+		"error":        poisoned.Error,
+	})
+
+	return nil
+}
+
+// audit records an action which is already done, so a failure is logged instead of returned:
+// an error would make the admin retry, and requeue the message again.
+func (s *service) audit(ctx context.Context, action string, subjectID string, actor string, details map[string]string) {
+	payload, err := json.Marshal(details)
+	if err == nil {
+		err = s.auditLog.Add(ctx, repositories.AuditEntry{
+			Action:    action,
+			SubjectID: subjectID,
+			Actor:     actor,
+			Details:   payload,
+		})
+	}
+	if err != nil {
+		log.FromContext(ctx).
+			WithError(err).
+			WithField("action", action).
+			WithField("subject_id", subjectID).
+			WithField("actor", actor).
+			Error("Could not add the audit log entry of a poison queue action")
+	}
+}
@@ -0,0 +1,243 @@
+package poison_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"tickets/app/poison"
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const poisonTopic = "poison"
+
+func TestListPoisoned(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	defer pubSub.Close()
+
+	queue, err := poison.NewMemoryQueue(pubSub, poisonTopic)
+	require.NoError(t, err)
+	service := poison.NewService(poison.NewServiceInput{
+		Queue:     queue,
+		Publisher: pubSub,
+		AuditLog:  repositories.NewMemoryAuditLogRepository(),
+	})
+
+	first := publishPoisoned(t, pubSub, "events.TicketBookingConfirmed", "print-ticket")
+	publishPoisoned(t, pubSub, "events.TicketCanceled", "append-canceled")
+
+	messages := waitForPoisoned(t, service, 2)
+
+	var listed poison.Message
+	for _, msg := range messages {
+		if msg.MessageUUID == first.UUID {
+			listed = msg
+		}
+	}
+	require.NotEmpty(t, listed.ID)
+	assert.Equal(t, "events.TicketBookingConfirmed", listed.Topic)
+	assert.Equal(t, "print-ticket", listed.Handler)
+	assert.Equal(t, "spreadsheets are down", listed.Error)
+	assert.Equal(t, string(first.Payload), listed.Payload)
+
+	limited, err := service.List(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Len(t, limited, 1)
+}
+
+func TestRequeuePoisoned(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	defer pubSub.Close()
+
+	queue, err := poison.NewMemoryQueue(pubSub, poisonTopic)
+	require.NoError(t, err)
+	auditLog := repositories.NewMemoryAuditLogRepository()
+	service := poison.NewService(poison.NewServiceInput{
+		Queue:     queue,
+		Publisher: pubSub,
+		AuditLog:  auditLog,
+	})
+
+	requeued, err := pubSub.Subscribe(context.Background(), "events.TicketBookingConfirmed")
+	require.NoError(t, err)
+
+	poisoned := publishPoisoned(t, pubSub, "events.TicketBookingConfirmed", "print-ticket")
+	queued := waitForPoisoned(t, service, 1)[0]
+
+	err = service.Requeue(context.Background(), poison.RequeueInput{
+		ID:      queued.ID,
+		Handler: "print-ticket",
+		Actor:   "admin",
+	})
+	require.NoError(t, err)
+
+	select {
+	case msg := <-requeued:
+		msg.Ack()
+		assert.NotEqual(t, poisoned.UUID, msg.UUID, "requeued messages get a new UUID")
+		assert.Equal(t, poisoned.Payload, msg.Payload)
+		assert.Equal(t, "corr-1", msg.Metadata.Get("correlation_id"))
+		assert.Equal(t, "print-ticket", msg.Metadata.Get(poison.RequeueHandlerKey))
+		assert.Empty(t, msg.Metadata.Get(middleware.ReasonForPoisonedKey))
+		assert.Empty(t, msg.Metadata.Get(middleware.PoisonedTopicKey))
+	case <-time.After(time.Second):
+		t.Fatal("message not requeued")
+	}
+
+	_, err = queue.Get(context.Background(), queued.ID)
+	assert.ErrorIs(t, err, poison.ErrMessageNotFound)
+
+	require.Len(t, auditLog.Entries, 1)
+	entry := auditLog.Entries[0]
+	assert.Equal(t, poison.AuditActionRequeue, entry.Action)
+	assert.Equal(t, queued.ID, entry.SubjectID)
+	assert.Equal(t, "admin", entry.Actor)
+
+	details := map[string]string{}
+	require.NoError(t, json.Unmarshal(entry.Details, &details))
+	assert.Equal(t, "events.TicketBookingConfirmed", details["topic"])
+	assert.Equal(t, poisoned.UUID, details["message_uuid"])
+
+	err = service.Requeue(context.Background(), poison.RequeueInput{ID: queued.ID})
+	assert.ErrorIs(t, err, poison.ErrMessageNotFound)
+}
+
+func TestRequeuePoisonedWhenAuditLogFails(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	defer pubSub.Close()
+
+	queue, err := poison.NewMemoryQueue(pubSub, poisonTopic)
+	require.NoError(t, err)
+	service := poison.NewService(poison.NewServiceInput{
+		Queue:     queue,
+		Publisher: pubSub,
+		AuditLog:  failingAuditLog{},
+	})
+
+	requeued, err := pubSub.Subscribe(context.Background(), "events.TicketBookingConfirmed")
+	require.NoError(t, err)
+
+	publishPoisoned(t, pubSub, "events.TicketBookingConfirmed", "print-ticket")
+	queued := waitForPoisoned(t, service, 1)[0]
+
+	// the message is already published, an error would make the admin requeue it twice
+	err = service.Requeue(context.Background(), poison.RequeueInput{ID: queued.ID, Actor: "admin"})
+	require.NoError(t, err)
+
+	select {
+	case msg := <-requeued:
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not requeued")
+	}
+
+	_, err = queue.Get(context.Background(), queued.ID)
+	assert.ErrorIs(t, err, poison.ErrMessageNotFound)
+}
+
+func TestRequeuePoisonedWithoutTopic(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	defer pubSub.Close()
+
+	queue, err := poison.NewMemoryQueue(pubSub, poisonTopic)
+	require.NoError(t, err)
+	service := poison.NewService(poison.NewServiceInput{
+		Queue:     queue,
+		Publisher: pubSub,
+		AuditLog:  repositories.NewMemoryAuditLogRepository(),
+	})
+
+	publishPoisoned(t, pubSub, "", "print-ticket")
+	queued := waitForPoisoned(t, service, 1)[0]
+
+	err = service.Requeue(context.Background(), poison.RequeueInput{ID: queued.ID})
+	assert.ErrorIs(t, err, poison.ErrMissingTopic)
+
+	// it stays in the queue, so it can still be discarded
+	waitForPoisoned(t, service, 1)
+}
+
+func TestDiscardPoisoned(t *testing.T) {
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	defer pubSub.Close()
+
+	queue, err := poison.NewMemoryQueue(pubSub, poisonTopic)
+	require.NoError(t, err)
+	auditLog := repositories.NewMemoryAuditLogRepository()
+	service := poison.NewService(poison.NewServiceInput{
+		Queue:     queue,
+		Publisher: pubSub,
+		AuditLog:  auditLog,
+	})
+
+	poisoned := publishPoisoned(t, pubSub, "events.TicketBookingConfirmed", "print-ticket")
+	queued := waitForPoisoned(t, service, 1)[0]
+
+	err = service.Discard(context.Background(), poison.DiscardInput{ID: queued.ID, Actor: "admin"})
+	require.NoError(t, err)
+
+	_, err = queue.Get(context.Background(), queued.ID)
+	assert.ErrorIs(t, err, poison.ErrMessageNotFound)
+
+	require.Len(t, auditLog.Entries, 1)
+	entry := auditLog.Entries[0]
+	assert.Equal(t, poison.AuditActionDiscard, entry.Action)
+	assert.Equal(t, queued.ID, entry.SubjectID)
+	assert.Equal(t, "admin", entry.Actor)
+
+	details := map[string]string{}
+	require.NoError(t, json.Unmarshal(entry.Details, &details))
+	assert.Equal(t, "events.TicketBookingConfirmed", details["topic"])
+	assert.Equal(t, poisoned.UUID, details["message_uuid"])
+	assert.Equal(t, "spreadsheets are down", details["error"])
+	assert.NotContains(t, details, "payload")
+
+	err = service.Discard(context.Background(), poison.DiscardInput{ID: queued.ID, Actor: "admin"})
+	assert.ErrorIs(t, err, poison.ErrMessageNotFound)
+}
+
+// publishPoisoned publishes a message to the poison queue like the poison queue middleware does.
+func publishPoisoned(t *testing.T, publisher message.Publisher, topic string, handler string) *message.Message {
+	t.Helper()
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte(`{"ticket_id":"`+watermill.NewShortUUID()+`"}`))
+	msg.Metadata.Set("correlation_id", "corr-1")
+	msg.Metadata.Set(middleware.PoisonedTopicKey, topic)
+	msg.Metadata.Set(middleware.PoisonedHandlerKey, handler)
+	msg.Metadata.Set(middleware.PoisonedSubscriberKey, "subscriber")
+	msg.Metadata.Set(middleware.ReasonForPoisonedKey, "spreadsheets are down")
+
+	require.NoError(t, publisher.Publish(poisonTopic, msg))
+
+	return msg
+}
+
+func waitForPoisoned(t *testing.T, service poison.Service, count int) []poison.Message {
+	t.Helper()
+
+	var messages []poison.Message
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		var err error
+		messages, err = service.List(context.Background(), 100)
+		if assert.NoError(collectT, err) {
+			assert.Len(collectT, messages, count)
+		}
+	}, time.Second, 5*time.Millisecond)
+
+	return messages
+}
+
+type failingAuditLog struct{}
+
+func (failingAuditLog) Add(context.Context, repositories.AuditEntry) error {
+	return errors.New("database is down")
+}
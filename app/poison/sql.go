@@ -0,0 +1,122 @@
+package poison
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// SQLQueue reads the poison queue from the table watermill-sql publishes the topic to,
+// entries are addressed by their offset.
+type SQLQueue struct {
+	db    *sqlx.DB
+	table string
+}
+
+func NewSQLQueue(db *sqlx.DB, topic string) *SQLQueue {
+	return &SQLQueue{
+		db: db,
+		// the same name as sql.DefaultPostgreSQLSchema uses
+		table: fmt.Sprintf(`"watermill_%s"`, topic),
+	}
+}
+
+type sqlMessage struct {
+	Offset   int64  `db:"offset"`
+	UUID     string `db:"uuid"`
+	Payload  []byte `db:"payload"`
+	Metadata []byte `db:"metadata"`
+}
+
+func (q *SQLQueue) List(ctx context.Context, limit int64) ([]Message, error) {
+	var rows []sqlMessage
+	err := q.db.SelectContext(ctx, &rows, `SELECT "offset", uuid, payload, metadata FROM `+q.table+` ORDER BY "offset" LIMIT $1`, limit)
+	if isUndefinedTable(err) {
+		// nothing was poisoned yet
+		return []Message{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(rows))
+	for _, row := range rows {
+		msg, err := row.toMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+func (q *SQLQueue) Get(ctx context.Context, id string) (Message, error) {
+	offset, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Message{}, ErrMessageNotFound
+	}
+
+	var row sqlMessage
+	err = q.db.GetContext(ctx, &row, `SELECT "offset", uuid, payload, metadata FROM `+q.table+` WHERE "offset" = $1`, offset)
+	if errors.Is(err, sql.ErrNoRows) || isUndefinedTable(err) {
+		return Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	return row.toMessage()
+}
+
+func (q *SQLQueue) Delete(ctx context.Context, id string) error {
+	offset, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return ErrMessageNotFound
+	}
+
+	res, err := q.db.ExecContext(ctx, `DELETE FROM `+q.table+` WHERE "offset" = $1`, offset)
+	if isUndefinedTable(err) {
+		return ErrMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func (m sqlMessage) toMessage() (Message, error) {
+	msg := message.NewMessage(m.UUID, m.Payload)
+
+	if len(m.Metadata) > 0 {
+		err := json.Unmarshal(m.Metadata, &msg.Metadata)
+		if err != nil {
+			return Message{}, err
+		}
+	}
+
+	return newMessage(strconv.FormatInt(m.Offset, 10), msg), nil
+}
+
+func isUndefinedTable(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == "42P01"
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"tickets/app/metrics"
+	"tickets/app/poison"
+	"tickets/app/redisstreams"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	watermillSQL "github.com/ThreeDotsLabs/watermill-sql/v3/pkg/sql"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+type PubSubBackend string
+
+const (
+	PubSubBackendRedis     PubSubBackend = "redis"
+	PubSubBackendPostgres  PubSubBackend = "postgres"
+	PubSubBackendGoChannel PubSubBackend = "gochannel"
+)
+
+var PubSubBackends = []PubSubBackend{
+	PubSubBackendRedis,
+	PubSubBackendPostgres,
+	PubSubBackendGoChannel,
+}
+
+// ParsePubSubBackend reads the PUBSUB_BACKEND setting, redis streams are used when it's empty.
+func ParsePubSubBackend(value string) (PubSubBackend, error) {
+	if value == "" {
+		return PubSubBackendRedis, nil
+	}
+
+	for _, backend := range PubSubBackends {
+		if string(backend) == value {
+			return backend, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown pub/sub backend %q", value)
+}
+
+// reclaimMargin keeps a message from being reclaimed while its handler is still finishing up after the budget.
+const reclaimMargin = time.Minute
+
+// RedisReclaimConfigFromEnv reads REDIS_CONSUMER_NAME (the hostname by default), REDIS_CLAIM_MIN_IDLE
+// and REDIS_CLAIM_INTERVAL, the durations use time.ParseDuration format.
+// REDIS_CLAIM_MIN_IDLE defaults to a minute more than handlerBudget, see MaxHandlerBudget, and can't be shorter:
+// messages would be reclaimed and handled twice while their handler is still retrying them.
+func RedisReclaimConfigFromEnv(handlerBudget time.Duration) (redisstreams.ReclaimConfig, error) {
+	config := redisstreams.ReclaimConfig{
+		Consumer: os.Getenv("REDIS_CONSUMER_NAME"),
+	}
+	if config.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return redisstreams.ReclaimConfig{}, err
+		}
+		config.Consumer = hostname
+	}
+
+	var err error
+	config.MinIdle, err = durationFromEnv("REDIS_CLAIM_MIN_IDLE")
+	if err != nil {
+		return redisstreams.ReclaimConfig{}, err
+	}
+	if config.MinIdle == 0 {
+		config.MinIdle = handlerBudget + reclaimMargin
+	} else if config.MinIdle <= handlerBudget {
+		return redisstreams.ReclaimConfig{}, fmt.Errorf(
+			"REDIS_CLAIM_MIN_IDLE %s is not longer than handlers can take to process a message, %s",
+			config.MinIdle,
+			handlerBudget,
+		)
+	}
+
+	config.Interval, err = durationFromEnv("REDIS_CLAIM_INTERVAL")
+	if err != nil {
+		return redisstreams.ReclaimConfig{}, err
+	}
+
+	return config, nil
+}
+
+// durationFromEnv returns 0 when the variable is not set, so the default is used.
+func durationFromEnv(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	return duration, nil
+}
+
+type NewPubSubInput struct {
+	Backend PubSubBackend
+	// RedisAddr, RedisReclaim and RedisRetention are used by the redis backend.
+	RedisAddr      string
+	RedisReclaim   redisstreams.ReclaimConfig
+	RedisRetention map[string]redisstreams.RetentionPolicy
+	// DB is used by the postgres backend.
+	DB               *sqlx.DB
+	PoisonQueueTopic string
+	Logger           watermill.LoggerAdapter
+}
+
+// PubSub is the transport of events and commands. Every handler gets its own consumer group,
+// so each of them receives all messages of its topic, in order.
+type PubSub struct {
+	Publisher   message.Publisher
+	PoisonQueue poison.Queue
+	// StreamJanitor trims the streams of the redis backend, it's nil for other backends.
+	StreamJanitor *redisstreams.Janitor
+
+	newSubscriber func(handlerName string, consumerGroup string) (message.Subscriber, error)
+}
+
+func (p PubSub) NewSubscriber(handlerName string) (message.Subscriber, error) {
+	return p.newSubscriber(handlerName, "svc-tickets."+handlerName)
+}
+
+func NewPubSub(input NewPubSubInput) (PubSub, error) {
+	switch input.Backend {
+	case PubSubBackendRedis:
+		return newRedisPubSub(input)
+	case PubSubBackendPostgres:
+		return newPostgresPubSub(input)
+	case PubSubBackendGoChannel:
+		return newGoChannelPubSub(input)
+	default:
+		return PubSub{}, fmt.Errorf("unknown pub/sub backend %q", input.Backend)
+	}
+}
+
+func newRedisPubSub(input NewPubSubInput) (PubSub, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: input.RedisAddr,
+	})
+
+	pub, err := redisstream.NewPublisher(redisstream.PublisherConfig{
+		Client: rdb,
+	}, input.Logger)
+	if err != nil {
+		return PubSub{}, err
+	}
+
+	return PubSub{
+		Publisher:   pub,
+		PoisonQueue: poison.NewRedisQueue(rdb, input.PoisonQueueTopic),
+		StreamJanitor: redisstreams.NewJanitor(redisstreams.NewJanitorInput{
+			Client:  rdb,
+			Streams: input.RedisRetention,
+			Logger:  input.Logger,
+		}),
+		newSubscriber: func(handlerName string, consumerGroup string) (message.Subscriber, error) {
+			return redisstreams.NewSubscriber(redisstreams.NewSubscriberInput{
+				Client:        rdb,
+				ConsumerGroup: consumerGroup,
+				Config:        input.RedisReclaim,
+				OnReclaimed: func() {
+					metrics.MessagesReclaimed.WithLabelValues(handlerName).Inc()
+				},
+				Logger: input.Logger,
+			})
+		},
+	}, nil
+}
+
+func newPostgresPubSub(input NewPubSubInput) (PubSub, error) {
+	pub, err := watermillSQL.NewPublisher(input.DB.DB, watermillSQL.PublisherConfig{
+		SchemaAdapter:        watermillSQL.DefaultPostgreSQLSchema{},
+		AutoInitializeSchema: true,
+	}, input.Logger)
+	if err != nil {
+		return PubSub{}, err
+	}
+
+	return PubSub{
+		Publisher:   pub,
+		PoisonQueue: poison.NewSQLQueue(input.DB, input.PoisonQueueTopic),
+		newSubscriber: func(_ string, consumerGroup string) (message.Subscriber, error) {
+			return watermillSQL.NewSubscriber(input.DB.DB, watermillSQL.SubscriberConfig{
+				ConsumerGroup:    consumerGroup,
+				SchemaAdapter:    watermillSQL.DefaultPostgreSQLSchema{},
+				OffsetsAdapter:   watermillSQL.DefaultPostgreSQLOffsetsAdapter{},
+				InitializeSchema: true,
+			}, input.Logger)
+		},
+	}, nil
+}
+
+func newGoChannelPubSub(input NewPubSubInput) (PubSub, error) {
+	pubSub := gochannel.NewGoChannel(gochannel.Config{
+		// gochannel sends every message in its own goroutine, waiting for the ack keeps the messages of a topic in order
+		BlockPublishUntilSubscriberAck: true,
+	}, input.Logger)
+
+	poisonQueue, err := poison.NewMemoryQueue(pubSub, input.PoisonQueueTopic)
+	if err != nil {
+		return PubSub{}, err
+	}
+
+	return PubSub{
+		Publisher:   pubSub,
+		PoisonQueue: poisonQueue,
+		newSubscriber: func(string, string) (message.Subscriber, error) {
+			// every subscription gets all messages, the router subscribes once per handler
+			return pubSub, nil
+		},
+	}, nil
+}
@@ -11,6 +11,7 @@ import (
 
 type ReceiptsClientInterface interface {
 	IssueReceipt(ctx context.Context, request IssueReceiptRequest) error
+	VoidReceipt(ctx context.Context, request VoidReceiptRequest) error
 }
 
 type ReceiptsClient struct {
@@ -30,6 +31,21 @@ type IssueReceiptRequest struct {
 	IdempotencyKey string `json:"idempotency_kesy"`
 }
 
+type VoidReceiptRequest struct {
+	TicketID       string `json:"ticket_id"`
+	Reason         string `json:"reason"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// UnexpectedStatusError is returned when the receipts API answered with a status other than 200.
+type UnexpectedStatusError struct {
+	StatusCode int
+}
+
+func (e *UnexpectedStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %v", e.StatusCode)
+}
+
 func NewReceiptsClient(clients *clients.Clients) ReceiptsClientInterface {
 	return ReceiptsClient{
 		clients: clients,
@@ -52,7 +68,26 @@ func (c ReceiptsClient) IssueReceipt(ctx context.Context, request IssueReceiptRe
 		return err
 	}
 	if receiptsResp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %v", receiptsResp.StatusCode())
+		return &UnexpectedStatusError{StatusCode: receiptsResp.StatusCode()}
+	}
+
+	return nil
+}
+
+func (c ReceiptsClient) VoidReceipt(ctx context.Context, request VoidReceiptRequest) error {
+	idempotencyKey := fmt.Sprintf("%s%s", request.IdempotencyKey, request.TicketID)
+	body := receipts.PutVoidReceiptJSONRequestBody{
+		IdempotentId: &idempotencyKey,
+		Reason:       request.Reason,
+		TicketId:     request.TicketID,
+	}
+
+	voidResp, err := c.clients.Receipts.PutVoidReceiptWithResponse(ctx, body)
+	if err != nil {
+		return err
+	}
+	if voidResp.StatusCode() != http.StatusOK {
+		return &UnexpectedStatusError{StatusCode: voidResp.StatusCode()}
 	}
 
 	return nil
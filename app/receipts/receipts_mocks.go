@@ -17,6 +17,7 @@ type Service interface {
 
 type ServiceMock struct {
 	IssuedReceipts []IssueReceiptRequest
+	VoidedReceipts []VoidReceiptRequest
 
 	receiptLock sync.Mutex
 }
@@ -30,3 +31,13 @@ func (mock *ServiceMock) IssueReceipt(ctx context.Context, request IssueReceiptR
 
 	return nil
 }
+
+func (mock *ServiceMock) VoidReceipt(ctx context.Context, request VoidReceiptRequest) error {
+	defer mock.receiptLock.Unlock()
+
+	mock.receiptLock.Lock()
+
+	mock.VoidedReceipts = append(mock.VoidedReceipts, request)
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package redisstreams
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statsTimeout bounds a scrape, so a slow redis doesn't hold the metrics endpoint.
+const statsTimeout = time.Second * 5
+
+// StatsCollector exports the stream stats of the janitor on every scrape:
+// the length of every stream, and the lag and pending entries of its consumer groups.
+type StatsCollector struct {
+	janitor *Janitor
+
+	length  *prometheus.Desc
+	lag     *prometheus.Desc
+	pending *prometheus.Desc
+}
+
+func NewStatsCollector(janitor *Janitor, namespace string) *StatsCollector {
+	return &StatsCollector{
+		janitor: janitor,
+		length: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "redis_stream", "length"),
+			"Entries in the stream.",
+			[]string{"stream"}, nil,
+		),
+		lag: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "redis_stream", "group_lag"),
+			fmt.Sprintf("Entries not delivered to the consumer group yet, counted up to %d.", maxLagCount),
+			[]string{"stream", "group"}, nil,
+		),
+		pending: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "redis_stream", "group_pending"),
+			"Entries delivered to the consumer group and not acked yet.",
+			[]string{"stream", "group"}, nil,
+		),
+	}
+}
+
+func (c *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.length
+	ch <- c.lag
+	ch <- c.pending
+}
+
+func (c *StatsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), statsTimeout)
+	defer cancel()
+
+	streams, err := c.janitor.Stats(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.lag, err)
+		return
+	}
+
+	for _, stream := range streams {
+		ch <- prometheus.MustNewConstMetric(c.length, prometheus.GaugeValue, float64(stream.Length), stream.Stream)
+
+		for _, group := range stream.Groups {
+			ch <- prometheus.MustNewConstMetric(c.lag, prometheus.GaugeValue, float64(group.Lag), stream.Stream, group.Name)
+			ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(group.Pending), stream.Stream, group.Name)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package redisstreams
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultReclaimMinIdle suits handlers which finish within a minute, the app sets MinIdle from its handler policies.
+	DefaultReclaimMinIdle   = time.Minute
+	DefaultReclaimInterval  = time.Second * 10
+	DefaultReclaimBatchSize = 100
+
+	// disabledClaimIdleTime turns off the claiming built into redisstream.Subscriber,
+	// it deletes the consumer it claims from, which drops the rest of its pending messages.
+	disabledClaimIdleTime = time.Hour * 24 * 365
+)
+
+type ReclaimConfig struct {
+	// Consumer is the name of this replica in the consumer groups. It should survive restarts,
+	// so a restarted replica is the same consumer as before.
+	Consumer string
+	// MinIdle is how long a message has to stay pending before another consumer takes it over.
+	// It must be longer than a handler can take to process a message, including retries.
+	MinIdle time.Duration
+	// Interval is how often the pending messages are checked.
+	Interval  time.Duration
+	BatchSize int64
+}
+
+func (c *ReclaimConfig) setDefaults() {
+	if c.Consumer == "" {
+		c.Consumer = watermill.NewShortUUID()
+	}
+	if c.MinIdle == 0 {
+		c.MinIdle = DefaultReclaimMinIdle
+	}
+	if c.Interval == 0 {
+		c.Interval = DefaultReclaimInterval
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = DefaultReclaimBatchSize
+	}
+}
+
+type NewSubscriberInput struct {
+	Client        redis.UniversalClient
+	ConsumerGroup string
+	Config        ReclaimConfig
+	// OnReclaimed is called for every message taken over from the pending list.
+	OnReclaimed func()
+	Logger      watermill.LoggerAdapter
+}
+
+// Subscriber is a redisstream.Subscriber which also processes the messages left pending by consumers which
+// crashed or were restarted: every Interval it takes over the messages pending for longer than MinIdle with XAUTOCLAIM.
+type Subscriber struct {
+	subscriber    *redisstream.Subscriber
+	client        redis.UniversalClient
+	consumerGroup string
+	config        ReclaimConfig
+	unmarshaller  redisstream.Unmarshaller
+	onReclaimed   func()
+	logger        watermill.LoggerAdapter
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewSubscriber(input NewSubscriberInput) (*Subscriber, error) {
+	if input.ConsumerGroup == "" {
+		return nil, errors.New("consumer group is required to reclaim messages")
+	}
+	input.Config.setDefaults()
+	if input.OnReclaimed == nil {
+		input.OnReclaimed = func() {}
+	}
+	if input.Logger == nil {
+		input.Logger = watermill.NopLogger{}
+	}
+
+	subscriber, err := redisstream.NewSubscriber(redisstream.SubscriberConfig{
+		Client:        input.Client,
+		Consumer:      input.Config.Consumer,
+		ConsumerGroup: input.ConsumerGroup,
+		// it still checks the pending list on this interval, a long one would delay reading after an error
+		ClaimInterval: input.Config.Interval,
+		MaxIdleTime:   disabledClaimIdleTime,
+	}, input.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Subscriber{
+		subscriber:    subscriber,
+		client:        input.Client,
+		consumerGroup: input.ConsumerGroup,
+		config:        input.Config,
+		unmarshaller:  redisstream.DefaultMarshallerUnmarshaller{},
+		onReclaimed:   input.OnReclaimed,
+		logger:        input.Logger,
+		closing:       make(chan struct{}),
+	}, nil
+}
+
+func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	messages, err := s.subscriber.Subscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make(chan *message.Message)
+	// one message at a time, like redisstream.Subscriber does
+	inFlight := &sync.Mutex{}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		for msg := range messages {
+			inFlight.Lock()
+			s.send(ctx, output, msg)
+			inFlight.Unlock()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.closing:
+				return
+			case <-ticker.C:
+			}
+
+			err := s.reclaim(ctx, topic, output, inFlight)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Error("Could not reclaim pending messages", err, watermill.LogFields{
+					"topic":          topic,
+					"consumer_group": s.consumerGroup,
+				})
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(output)
+	}()
+
+	return output, nil
+}
+
+func (s *Subscriber) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+
+	return s.subscriber.Close()
+}
+
+func (s *Subscriber) reclaim(ctx context.Context, topic string, output chan<- *message.Message, inFlight *sync.Mutex) error {
+	start := "0-0"
+
+	for {
+		claimed, next, err := s.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   topic,
+			Group:    s.consumerGroup,
+			Consumer: s.config.Consumer,
+			MinIdle:  s.config.MinIdle,
+			Start:    start,
+			Count:    s.config.BatchSize,
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range claimed {
+			s.onReclaimed()
+
+			logFields := watermill.LogFields{
+				"topic":          topic,
+				"consumer_group": s.consumerGroup,
+				"entry_id":       entry.ID,
+			}
+
+			msg, err := s.unmarshaller.Unmarshal(entry.Values)
+			if err != nil {
+				// the entry was trimmed from the stream, or it can't be read at all: nobody can process it
+				s.logger.Error("Dropping pending message which can't be read", err, logFields)
+
+				err = s.client.XAck(ctx, topic, s.consumerGroup, entry.ID).Err()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			s.logger.Info("Reclaimed pending message", logFields.Add(watermill.LogFields{"message_uuid": msg.UUID}))
+
+			inFlight.Lock()
+			acked := s.send(ctx, output, msg)
+			inFlight.Unlock()
+
+			if !acked {
+				// stays pending, it's reclaimed again after MinIdle
+				continue
+			}
+
+			err = s.client.XAck(ctx, topic, s.consumerGroup, entry.ID).Err()
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == "0-0" || next == "" {
+			return nil
+		}
+		start = next
+	}
+}
+
+// send passes the message on and waits until it's processed, it reports if the message was acked.
+func (s *Subscriber) send(ctx context.Context, output chan<- *message.Message, msg *message.Message) bool {
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false
+	case <-s.closing:
+		return false
+	}
+
+	select {
+	case <-msg.Acked():
+		return true
+	case <-msg.Nacked():
+		return false
+	case <-ctx.Done():
+		return false
+	case <-s.closing:
+		return false
+	}
+}
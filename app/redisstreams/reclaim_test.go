@@ -0,0 +1,142 @@
+package redisstreams_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tickets/app/redisstreams"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriberReclaimsMessagesOfKilledConsumer(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	const (
+		topic = "TicketBookingConfirmed.v1"
+		group = "svc-tickets.store-confirmed"
+	)
+
+	publisher, err := redisstream.NewPublisher(redisstream.PublisherConfig{
+		Client: newClient(server),
+	}, watermill.NopLogger{})
+	require.NoError(t, err)
+
+	sent := message.NewMessage(watermill.NewUUID(), []byte(`{"ticket_id":"1"}`))
+	require.NoError(t, publisher.Publish(topic, sent))
+
+	config := redisstreams.ReclaimConfig{
+		MinIdle:  time.Millisecond * 200,
+		Interval: time.Millisecond * 50,
+	}
+
+	// the first consumer receives the message and dies before acking it
+	config.Consumer = "replica-1"
+	killed, err := redisstreams.NewSubscriber(redisstreams.NewSubscriberInput{
+		Client:        newClient(server),
+		ConsumerGroup: group,
+		Config:        config,
+	})
+	require.NoError(t, err)
+
+	messages, err := killed.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	received := receive(t, messages)
+	assert.Equal(t, sent.UUID, received.UUID)
+	require.NoError(t, killed.Close())
+
+	assert.Equal(t, int64(1), pendingCount(t, server, topic, group))
+
+	// another replica takes it over once it was idle for long enough
+	reclaimed := atomic.Int64{}
+	config.Consumer = "replica-2"
+	subscriber, err := redisstreams.NewSubscriber(redisstreams.NewSubscriberInput{
+		Client:        newClient(server),
+		ConsumerGroup: group,
+		Config:        config,
+		OnReclaimed: func() {
+			reclaimed.Add(1)
+		},
+	})
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, err = subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	received = receive(t, messages)
+	assert.Equal(t, sent.UUID, received.UUID)
+	assert.Equal(t, string(sent.Payload), string(received.Payload))
+	received.Ack()
+
+	assert.Eventually(t, func() bool {
+		return pendingCount(t, server, topic, group) == 0
+	}, time.Second*5, time.Millisecond*50)
+	assert.Equal(t, int64(1), reclaimed.Load())
+}
+
+func newClient(server *miniredis.Miniredis) redis.UniversalClient {
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	client.AddHook(emptyPendingHook{})
+
+	return client
+}
+
+// emptyPendingHook makes miniredis answer like Redis: it replies to XPENDING with no entries
+// with a nil array instead of an empty one, and redisstream.Subscriber doesn't start reading after an error.
+type emptyPendingHook struct{}
+
+func (emptyPendingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (emptyPendingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if _, ok := cmd.(*redis.XPendingExtCmd); ok && errors.Is(err, redis.Nil) {
+			cmd.SetErr(nil)
+			return nil
+		}
+
+		return err
+	}
+}
+
+func (emptyPendingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func receive(t *testing.T, messages <-chan *message.Message) *message.Message {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		require.NotNil(t, msg)
+		return msg
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+		return nil
+	}
+}
+
+func pendingCount(t *testing.T, server *miniredis.Miniredis, topic string, group string) int64 {
+	t.Helper()
+
+	client := newClient(server)
+	defer client.Close()
+
+	pending, err := client.XPending(context.Background(), topic, group).Result()
+	require.NoError(t, err)
+
+	return pending.Count
+}
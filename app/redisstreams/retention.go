@@ -0,0 +1,314 @@
+package redisstreams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	DefaultJanitorInterval = time.Minute
+
+	// maxLagCount caps how many entries are counted for the lag of a group, counting reads the entries.
+	maxLagCount = 10000
+)
+
+// RetentionPolicy limits how many entries a stream keeps, by count, by age or both.
+// Zero values mean no limit, a zero policy never trims.
+type RetentionPolicy struct {
+	MaxLen int64
+	MaxAge time.Duration
+}
+
+func (p RetentionPolicy) IsZero() bool {
+	return p.MaxLen == 0 && p.MaxAge == 0
+}
+
+type NewJanitorInput struct {
+	Client redis.UniversalClient
+	// Streams are the streams to trim with their policies, streams with a zero policy are only reported in Stats.
+	Streams  map[string]RetentionPolicy
+	Interval time.Duration
+	Logger   watermill.LoggerAdapter
+}
+
+// Janitor trims streams according to their retention policies.
+// Entries which any consumer group has not acknowledged yet are never trimmed, whatever the policy says:
+// a stream is only trimmed up to the oldest entry still pending or not yet delivered in any of its groups.
+type Janitor struct {
+	client   redis.UniversalClient
+	streams  map[string]RetentionPolicy
+	interval time.Duration
+	logger   watermill.LoggerAdapter
+	now      func() time.Time
+}
+
+func NewJanitor(input NewJanitorInput) *Janitor {
+	if input.Interval == 0 {
+		input.Interval = DefaultJanitorInterval
+	}
+	if input.Logger == nil {
+		input.Logger = watermill.NopLogger{}
+	}
+
+	return &Janitor{
+		client:   input.Client,
+		streams:  input.Streams,
+		interval: input.Interval,
+		logger:   input.Logger,
+		now:      time.Now,
+	}
+}
+
+// Run trims the streams every Interval until ctx is done.
+func (j *Janitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for _, stream := range j.streamNames() {
+			trimmed, err := j.Trim(ctx, stream)
+			if err != nil {
+				if ctx.Err() == nil {
+					j.logger.Error("Could not trim stream", err, watermill.LogFields{"stream": stream})
+				}
+				continue
+			}
+			if trimmed > 0 {
+				j.logger.Debug("Trimmed stream", watermill.LogFields{"stream": stream, "trimmed": trimmed})
+			}
+		}
+	}
+}
+
+// Trim removes the entries of the stream which are out of its retention policy and were acknowledged
+// by all consumer groups, it returns the number of removed entries.
+func (j *Janitor) Trim(ctx context.Context, stream string) (int64, error) {
+	policy := j.streams[stream]
+	if policy.IsZero() {
+		return 0, nil
+	}
+
+	length, err := j.client.XLen(ctx, stream).Result()
+	if err != nil || length == 0 {
+		// a stream without entries may not exist yet
+		return 0, err
+	}
+
+	minID, err := j.policyMinID(ctx, stream, length, policy)
+	if err != nil {
+		return 0, err
+	}
+	if minID == "" {
+		return 0, nil
+	}
+
+	groups, err := j.client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, group := range groups {
+		// entries up to the last delivered one were read by the group, the ones still pending are not processed yet
+		oldestUnacked := group.LastDeliveredID
+		if group.Pending > 0 {
+			pending, err := j.client.XPending(ctx, stream, group.Name).Result()
+			if err != nil {
+				return 0, err
+			}
+			oldestUnacked = pending.Lower
+		}
+
+		if compareIDs(oldestUnacked, minID) < 0 {
+			minID = oldestUnacked
+		}
+	}
+
+	return j.client.XTrimMinID(ctx, stream, minID).Result()
+}
+
+// policyMinID returns the oldest entry ID the policy keeps, or an empty string when nothing is out of the policy.
+func (j *Janitor) policyMinID(ctx context.Context, stream string, length int64, policy RetentionPolicy) (string, error) {
+	var minID string
+
+	if policy.MaxAge > 0 {
+		minID = fmt.Sprintf("%d-0", j.now().Add(-policy.MaxAge).UnixMilli())
+	}
+
+	if policy.MaxLen > 0 && length > policy.MaxLen {
+		kept, err := j.client.XRevRangeN(ctx, stream, "+", "-", policy.MaxLen).Result()
+		if err != nil {
+			return "", err
+		}
+		if len(kept) > 0 {
+			// the stricter of both limits wins
+			oldestKept := kept[len(kept)-1].ID
+			if minID == "" || compareIDs(oldestKept, minID) > 0 {
+				minID = oldestKept
+			}
+		}
+	}
+
+	return minID, nil
+}
+
+type StreamStats struct {
+	Stream string `json:"stream"`
+	MaxLen int64  `json:"max_len,omitempty"`
+	MaxAge string `json:"max_age,omitempty"`
+	Length int64  `json:"length"`
+	// OldestEntryID and OldestEntryAt are empty when the stream has no entries.
+	OldestEntryID string       `json:"oldest_entry_id,omitempty"`
+	OldestEntryAt *time.Time   `json:"oldest_entry_at,omitempty"`
+	Groups        []GroupStats `json:"groups"`
+}
+
+type GroupStats struct {
+	Name            string `json:"name"`
+	Consumers       int64  `json:"consumers"`
+	Pending         int64  `json:"pending"`
+	LastDeliveredID string `json:"last_delivered_id"`
+	// Lag is the number of entries not delivered to the group yet, it's counted up to maxLagCount.
+	Lag          int64 `json:"lag"`
+	LagTruncated bool  `json:"lag_truncated,omitempty"`
+}
+
+// Stats reports the length, the oldest entry and the consumer groups of every stream, sorted by name.
+// Streams which don't exist yet are reported as empty.
+func (j *Janitor) Stats(ctx context.Context) ([]StreamStats, error) {
+	result := make([]StreamStats, 0, len(j.streams))
+
+	for _, stream := range j.streamNames() {
+		stats, err := j.streamStats(ctx, stream)
+		if err != nil {
+			return nil, fmt.Errorf("could not get stats of stream %s: %w", stream, err)
+		}
+
+		result = append(result, stats)
+	}
+
+	return result, nil
+}
+
+func (j *Janitor) streamStats(ctx context.Context, stream string) (StreamStats, error) {
+	policy := j.streams[stream]
+	stats := StreamStats{
+		Stream: stream,
+		MaxLen: policy.MaxLen,
+		Groups: []GroupStats{},
+	}
+	if policy.MaxAge > 0 {
+		stats.MaxAge = policy.MaxAge.String()
+	}
+
+	length, err := j.client.XLen(ctx, stream).Result()
+	if err != nil {
+		return StreamStats{}, err
+	}
+	stats.Length = length
+	if length == 0 {
+		return stats, nil
+	}
+
+	oldest, err := j.client.XRangeN(ctx, stream, "-", "+", 1).Result()
+	if err != nil {
+		return StreamStats{}, err
+	}
+	if len(oldest) > 0 {
+		stats.OldestEntryID = oldest[0].ID
+		if ms, _, err := parseID(oldest[0].ID); err == nil {
+			oldestAt := time.UnixMilli(int64(ms)).UTC()
+			stats.OldestEntryAt = &oldestAt
+		}
+	}
+
+	groups, err := j.client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return StreamStats{}, err
+	}
+
+	for _, group := range groups {
+		notDelivered, err := j.client.XRangeN(ctx, stream, "("+group.LastDeliveredID, "+", maxLagCount).Result()
+		if err != nil {
+			return StreamStats{}, err
+		}
+
+		stats.Groups = append(stats.Groups, GroupStats{
+			Name:            group.Name,
+			Consumers:       group.Consumers,
+			Pending:         group.Pending,
+			LastDeliveredID: group.LastDeliveredID,
+			Lag:             int64(len(notDelivered)),
+			LagTruncated:    len(notDelivered) == maxLagCount,
+		})
+	}
+	sort.Slice(stats.Groups, func(a, b int) bool {
+		return stats.Groups[a].Name < stats.Groups[b].Name
+	})
+
+	return stats, nil
+}
+
+func (j *Janitor) streamNames() []string {
+	names := make([]string, 0, len(j.streams))
+	for name := range j.streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// compareIDs compares stream entry IDs ("<milliseconds>-<sequence>").
+func compareIDs(a string, b string) int {
+	aMs, aSeq, aErr := parseID(a)
+	bMs, bSeq, bErr := parseID(b)
+	if aErr != nil || bErr != nil {
+		return strings.Compare(a, b)
+	}
+
+	switch {
+	case aMs < bMs:
+		return -1
+	case aMs > bMs:
+		return 1
+	case aSeq < bSeq:
+		return -1
+	case aSeq > bSeq:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func parseID(id string) (uint64, uint64, error) {
+	msPart, seqPart, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, errors.New("invalid stream entry ID " + id)
+	}
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return ms, seq, nil
+}
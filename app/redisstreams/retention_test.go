@@ -0,0 +1,172 @@
+package redisstreams_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"tickets/app/redisstreams"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJanitorDoesNotTrimUnackedEntries(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := newClient(server)
+
+	const (
+		stream = "TicketBookingConfirmed.v1"
+		group  = "svc-tickets.store-confirmed"
+	)
+
+	addEntries(t, client, stream, 1, 5)
+	require.NoError(t, client.XGroupCreate(ctx, stream, group, "0").Err())
+
+	read, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: "replica-1",
+		Streams:  []string{stream, ">"},
+		Count:    3,
+	}).Result()
+	require.NoError(t, err)
+	require.Len(t, read[0].Messages, 3)
+
+	// 2-0 is still being processed
+	require.NoError(t, client.XAck(ctx, stream, group, "1-0", "3-0").Err())
+
+	janitor := redisstreams.NewJanitor(redisstreams.NewJanitorInput{
+		Client: client,
+		Streams: map[string]redisstreams.RetentionPolicy{
+			stream: {MaxLen: 1},
+		},
+	})
+
+	trimmed, err := janitor.Trim(ctx, stream)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), trimmed)
+
+	require.NoError(t, client.XAck(ctx, stream, group, "2-0").Err())
+
+	// 4-0 and 5-0 were not delivered to the group yet
+	trimmed, err = janitor.Trim(ctx, stream)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), trimmed)
+
+	stats, err := janitor.Stats(ctx)
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+
+	assert.Equal(t, stream, stats[0].Stream)
+	assert.Equal(t, int64(3), stats[0].Length)
+	assert.Equal(t, "3-0", stats[0].OldestEntryID)
+	require.Len(t, stats[0].Groups, 1)
+	assert.Equal(t, group, stats[0].Groups[0].Name)
+	assert.Equal(t, int64(0), stats[0].Groups[0].Pending)
+	assert.Equal(t, "3-0", stats[0].Groups[0].LastDeliveredID)
+	assert.Equal(t, int64(2), stats[0].Groups[0].Lag)
+}
+
+func TestJanitorTrimsByAge(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := newClient(server)
+
+	const stream = "TicketPrinted.v1"
+
+	addEntries(t, client, stream, time.Now().Add(-time.Hour*2).UnixMilli(), 3)
+	recent, err := client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]any{"payload": "recent"},
+	}).Result()
+	require.NoError(t, err)
+
+	janitor := redisstreams.NewJanitor(redisstreams.NewJanitorInput{
+		Client: client,
+		Streams: map[string]redisstreams.RetentionPolicy{
+			stream:                {MaxAge: time.Hour},
+			"TicketRefunded.v1":   {MaxAge: time.Hour},
+			"commands.NotTrimmed": {},
+		},
+	})
+
+	trimmed, err := janitor.Trim(ctx, stream)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), trimmed)
+
+	// the stream doesn't exist yet
+	trimmed, err = janitor.Trim(ctx, "TicketRefunded.v1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), trimmed)
+
+	stats, err := janitor.Stats(ctx)
+	require.NoError(t, err)
+	require.Len(t, stats, 3)
+
+	assert.Equal(t, stream, stats[0].Stream)
+	assert.Equal(t, int64(1), stats[0].Length)
+	assert.Equal(t, recent, stats[0].OldestEntryID)
+	assert.Equal(t, "TicketRefunded.v1", stats[1].Stream)
+	assert.Equal(t, int64(0), stats[1].Length)
+}
+
+func TestStatsCollector(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := newClient(server)
+
+	const (
+		stream = "TicketBookingConfirmed.v1"
+		group  = "svc-tickets.store-confirmed"
+	)
+
+	addEntries(t, client, stream, 1, 5)
+	require.NoError(t, client.XGroupCreate(ctx, stream, group, "0").Err())
+
+	_, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: "replica-1",
+		Streams:  []string{stream, ">"},
+		Count:    2,
+	}).Result()
+	require.NoError(t, err)
+
+	janitor := redisstreams.NewJanitor(redisstreams.NewJanitorInput{
+		Client:  client,
+		Streams: map[string]redisstreams.RetentionPolicy{stream: {}},
+	})
+
+	expected := `
+# HELP tickets_redis_stream_group_lag Entries not delivered to the consumer group yet, counted up to 10000.
+# TYPE tickets_redis_stream_group_lag gauge
+tickets_redis_stream_group_lag{group="svc-tickets.store-confirmed",stream="TicketBookingConfirmed.v1"} 3
+# HELP tickets_redis_stream_group_pending Entries delivered to the consumer group and not acked yet.
+# TYPE tickets_redis_stream_group_pending gauge
+tickets_redis_stream_group_pending{group="svc-tickets.store-confirmed",stream="TicketBookingConfirmed.v1"} 2
+# HELP tickets_redis_stream_length Entries in the stream.
+# TYPE tickets_redis_stream_length gauge
+tickets_redis_stream_length{stream="TicketBookingConfirmed.v1"} 5
+`
+	err = testutil.CollectAndCompare(redisstreams.NewStatsCollector(janitor, "tickets"), strings.NewReader(expected))
+	assert.NoError(t, err)
+}
+
+// addEntries adds entries with IDs from "<firstMs>-0", one millisecond apart.
+func addEntries(t *testing.T, client redis.UniversalClient, stream string, firstMs int64, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		err := client.XAdd(context.Background(), &redis.XAddArgs{
+			Stream: stream,
+			ID:     fmt.Sprintf("%d-0", firstMs+int64(i)),
+			Values: map[string]any{"payload": i},
+		}).Err()
+		require.NoError(t, err)
+	}
+}
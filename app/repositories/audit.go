@@ -0,0 +1,54 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+id SERIAL PRIMARY KEY,
+action VARCHAR(64) NOT NULL,
+subject_id VARCHAR(255) NOT NULL,
+actor VARCHAR(255) NOT NULL,
+details JSONB NOT NULL,
+created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+*/
+type AuditEntry struct {
+	ID        int64           `db:"id"`
+	Action    string          `db:"action"`
+	SubjectID string          `db:"subject_id"`
+	Actor     string          `db:"actor"`
+	Details   json.RawMessage `db:"details"`
+	CreatedAt time.Time       `db:"created_at"`
+}
+
+type AuditLogRepository interface {
+	Add(ctx context.Context, entry AuditEntry) error
+}
+
+func NewAuditLogRepository(db *sqlx.DB) AuditLogRepository {
+	return &auditLogRepository{
+		db,
+	}
+}
+
+type auditLogRepository struct {
+	db *sqlx.DB
+}
+
+func (r *auditLogRepository) Add(ctx context.Context, entry AuditEntry) error {
+	if entry.Details == nil {
+		entry.Details = json.RawMessage("{}")
+	}
+
+	_, err := r.db.NamedExecContext(ctx, `
+INSERT INTO audit_log
+    (action, subject_id, actor, details)
+VALUES (:action, :subject_id, :actor, :details)
+`, entry)
+
+	return err
+}
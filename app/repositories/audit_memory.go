@@ -0,0 +1,32 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type MemoryAuditLogRepository struct {
+	lock    sync.Mutex
+	Entries []AuditEntry
+}
+
+func NewMemoryAuditLogRepository() *MemoryAuditLogRepository {
+	return &MemoryAuditLogRepository{}
+}
+
+func (r *MemoryAuditLogRepository) Add(_ context.Context, entry AuditEntry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if entry.Details == nil {
+		entry.Details = json.RawMessage("{}")
+	}
+	entry.ID = int64(len(r.Entries) + 1)
+	entry.CreatedAt = time.Now().UTC()
+
+	r.Entries = append(r.Entries, entry)
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+handler_name VARCHAR(255) NOT NULL,
+event_id VARCHAR(255) NOT NULL,
+processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+PRIMARY KEY (handler_name, event_id)
+*/
+type ProcessedMessagesRepository interface {
+	// RunOnce calls fn unless the event was already processed by the handler.
+	// The event is marked as processed in the same transaction fn's repository writes use,
+	// so both are committed, or rolled back, together.
+	//
+	// The transaction stays open while fn runs, external calls included, and holds a connection and the lock
+	// of the mark meanwhile: a redelivery of the same event waits for it instead of running fn again.
+	// fn must be bounded in time, the handler timeout does it for handlers.
+	RunOnce(ctx context.Context, handlerName string, eventID string, fn func(ctx context.Context) error) error
+	DeleteProcessedBefore(ctx context.Context, before time.Time) (int64, error)
+}
+
+func NewProcessedMessagesRepository(db *sqlx.DB) ProcessedMessagesRepository {
+	return &processedMessagesRepository{
+		db,
+	}
+}
+
+type processedMessagesRepository struct {
+	db *sqlx.DB
+}
+
+func (r *processedMessagesRepository) RunOnce(ctx context.Context, handlerName string, eventID string, fn func(ctx context.Context) error) (err error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// when another consumer is processing the same event, the insert waits for its transaction to finish
+	res, err := tx.ExecContext(ctx, `
+INSERT INTO processed_messages
+    (handler_name, event_id)
+VALUES ($1, $2)
+ON CONFLICT DO NOTHING
+`, handlerName, eventID)
+	if err != nil {
+		return err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return tx.Rollback()
+	}
+
+	err = fn(ContextWithTx(ctx, tx))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit processed message: %w", err)
+	}
+
+	return nil
+}
+
+func (r *processedMessagesRepository) DeleteProcessedBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM processed_messages WHERE processed_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
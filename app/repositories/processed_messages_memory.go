@@ -0,0 +1,83 @@
+package repositories
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryProcessedMessagesRepository has no transactions: writes done by fn are not rolled back when it fails.
+type MemoryProcessedMessagesRepository struct {
+	lock      sync.Mutex
+	processed map[processedMessageKey]time.Time
+	running   map[processedMessageKey]*sync.Mutex
+}
+
+type processedMessageKey struct {
+	handlerName string
+	eventID     string
+}
+
+func NewMemoryProcessedMessagesRepository() *MemoryProcessedMessagesRepository {
+	return &MemoryProcessedMessagesRepository{
+		processed: make(map[processedMessageKey]time.Time),
+		running:   make(map[processedMessageKey]*sync.Mutex),
+	}
+}
+
+func (r *MemoryProcessedMessagesRepository) RunOnce(ctx context.Context, handlerName string, eventID string, fn func(ctx context.Context) error) error {
+	key := processedMessageKey{handlerName: handlerName, eventID: eventID}
+
+	// like the row lock in Postgres, a concurrent call for the same event waits for the running one
+	running := r.runningLock(key)
+	running.Lock()
+	defer running.Unlock()
+
+	r.lock.Lock()
+	_, processed := r.processed[key]
+	r.lock.Unlock()
+	if processed {
+		return nil
+	}
+
+	err := fn(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.processed[key] = time.Now()
+	delete(r.running, key)
+
+	return nil
+}
+
+func (r *MemoryProcessedMessagesRepository) DeleteProcessedBefore(_ context.Context, before time.Time) (int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	deleted := int64(0)
+	for key, processedAt := range r.processed {
+		if processedAt.Before(before) {
+			delete(r.processed, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (r *MemoryProcessedMessagesRepository) runningLock(key processedMessageKey) *sync.Mutex {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	running, ok := r.running[key]
+	if !ok {
+		running = &sync.Mutex{}
+		r.running[key] = running
+	}
+
+	return running
+}
@@ -0,0 +1,98 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+message_uuid VARCHAR(255) PRIMARY KEY,
+topic VARCHAR(255) NOT NULL,
+payload BYTEA NOT NULL,
+metadata JSONB NOT NULL,
+deliver_at TIMESTAMPTZ NOT NULL
+*/
+type ScheduledMessage struct {
+	MessageUUID string          `db:"message_uuid"`
+	Topic       string          `db:"topic"`
+	Payload     []byte          `db:"payload"`
+	Metadata    json.RawMessage `db:"metadata"`
+	DeliverAt   time.Time       `db:"deliver_at"`
+}
+
+type ScheduledMessagesRepository interface {
+	Add(ctx context.Context, msg ScheduledMessage) error
+	// DeliverDue calls deliver for up to limit messages due at now and removes the delivered ones.
+	// Messages being delivered are locked, so other replicas skip them instead of delivering them twice.
+	DeliverDue(ctx context.Context, now time.Time, limit int, deliver func(msg ScheduledMessage) error) (int, error)
+}
+
+func NewScheduledMessagesRepository(db *sqlx.DB) ScheduledMessagesRepository {
+	return &scheduledMessagesRepository{
+		db,
+	}
+}
+
+type scheduledMessagesRepository struct {
+	db *sqlx.DB
+}
+
+func (r *scheduledMessagesRepository) Add(ctx context.Context, msg ScheduledMessage) error {
+	_, err := r.db.NamedExecContext(ctx, `
+INSERT INTO scheduled_messages
+    (message_uuid, topic, payload, metadata, deliver_at)
+VALUES (:message_uuid, :topic, :payload, :metadata, :deliver_at)
+ON CONFLICT DO NOTHING
+`, msg)
+
+	return err
+}
+
+func (r *scheduledMessagesRepository) DeliverDue(ctx context.Context, now time.Time, limit int, deliver func(msg ScheduledMessage) error) (delivered int, err error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var due []ScheduledMessage
+	err = tx.SelectContext(ctx, &due, `
+SELECT * FROM scheduled_messages
+WHERE deliver_at <= $1
+ORDER BY deliver_at
+LIMIT $2
+FOR UPDATE SKIP LOCKED
+`, now, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var deliverErr error
+	for _, msg := range due {
+		deliverErr = deliver(msg)
+		if deliverErr != nil {
+			// messages delivered so far are still removed, the failed one is retried on the next poll
+			break
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM scheduled_messages WHERE message_uuid = $1", msg.MessageUUID)
+		if err != nil {
+			return 0, err
+		}
+		delivered++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return delivered, deliverErr
+}
@@ -0,0 +1,61 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MemoryScheduledMessagesRepository struct {
+	lock     sync.Mutex
+	messages map[string]ScheduledMessage
+}
+
+func NewMemoryScheduledMessagesRepository() *MemoryScheduledMessagesRepository {
+	return &MemoryScheduledMessagesRepository{
+		messages: make(map[string]ScheduledMessage),
+	}
+}
+
+func (r *MemoryScheduledMessagesRepository) Add(_ context.Context, msg ScheduledMessage) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.messages[msg.MessageUUID]; !ok {
+		r.messages[msg.MessageUUID] = msg
+	}
+
+	return nil
+}
+
+func (r *MemoryScheduledMessagesRepository) DeliverDue(_ context.Context, now time.Time, limit int, deliver func(msg ScheduledMessage) error) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var due []ScheduledMessage
+	for _, msg := range r.messages {
+		if !msg.DeliverAt.After(now) {
+			due = append(due, msg)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].DeliverAt.Before(due[j].DeliverAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	delivered := 0
+	for _, msg := range due {
+		err := deliver(msg)
+		if err != nil {
+			return delivered, err
+		}
+
+		delete(r.messages, msg.MessageUUID)
+		delivered++
+	}
+
+	return delivered, nil
+}
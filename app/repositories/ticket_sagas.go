@@ -0,0 +1,276 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrTicketSagaNotFound = errors.New("ticket saga not found")
+
+type TicketSagaStatus string
+
+const (
+	TicketSagaStatusInProgress   TicketSagaStatus = "in_progress"
+	TicketSagaStatusCompleted    TicketSagaStatus = "completed"
+	TicketSagaStatusCompensating TicketSagaStatus = "compensating"
+	TicketSagaStatusCompensated  TicketSagaStatus = "compensated"
+)
+
+type TicketSagaStep string
+
+const (
+	TicketSagaStepStore   TicketSagaStep = "store"
+	TicketSagaStepReceipt TicketSagaStep = "receipt"
+	TicketSagaStepPrint   TicketSagaStep = "print"
+	TicketSagaStepFile    TicketSagaStep = "file"
+)
+
+// TicketSagaSteps are in the order used to report which step timed out.
+var TicketSagaSteps = []TicketSagaStep{
+	TicketSagaStepStore,
+	TicketSagaStepReceipt,
+	TicketSagaStepPrint,
+	TicketSagaStepFile,
+}
+
+var ticketSagaStepColumns = map[TicketSagaStep]string{
+	TicketSagaStepStore:   "stored_at",
+	TicketSagaStepReceipt: "receipt_issued_at",
+	TicketSagaStepPrint:   "printed_at",
+	TicketSagaStepFile:    "file_created_at",
+}
+
+type TicketSagaCompensation string
+
+const (
+	TicketSagaCompensationVoidReceipt  TicketSagaCompensation = "void_receipt"
+	TicketSagaCompensationAppendRefund TicketSagaCompensation = "append_refund"
+	TicketSagaCompensationRemoveTicket TicketSagaCompensation = "remove_ticket"
+)
+
+var ticketSagaCompensationColumns = map[TicketSagaCompensation]string{
+	TicketSagaCompensationVoidReceipt:  "receipt_voided_at",
+	TicketSagaCompensationAppendRefund: "refund_appended_at",
+	TicketSagaCompensationRemoveTicket: "ticket_removed_at",
+}
+
+/*
+ticket_id UUID PRIMARY KEY,
+status VARCHAR(32) NOT NULL,
+customer_email VARCHAR(255) NOT NULL,
+price_amount NUMERIC NOT NULL,
+price_currency CHAR(3) NOT NULL,
+idempotency_key VARCHAR(255) NOT NULL,
+correlation_id VARCHAR(255) NOT NULL,
+stored_at, receipt_issued_at, printed_at, file_created_at TIMESTAMPTZ,
+receipt_voided_at, refund_appended_at, ticket_removed_at TIMESTAMPTZ,
+failed_step VARCHAR(32),
+failure_reason TEXT,
+started_at TIMESTAMPTZ NOT NULL,
+updated_at TIMESTAMPTZ NOT NULL
+*/
+type TicketSaga struct {
+	TicketID      string           `db:"ticket_id"`
+	Status        TicketSagaStatus `db:"status"`
+	CustomerEmail string           `db:"customer_email"`
+	// PriceAmount is read as a string, so the NUMERIC amount stays exact.
+	PriceAmount    string `db:"price_amount"`
+	PriceCurrency  string `db:"price_currency"`
+	IdempotencyKey string `db:"idempotency_key"`
+	// CorrelationID is the one of the confirmation, it's empty for sagas started before it was stored.
+	CorrelationID string `db:"correlation_id"`
+
+	StoredAt        *time.Time `db:"stored_at"`
+	ReceiptIssuedAt *time.Time `db:"receipt_issued_at"`
+	PrintedAt       *time.Time `db:"printed_at"`
+	FileCreatedAt   *time.Time `db:"file_created_at"`
+
+	ReceiptVoidedAt  *time.Time `db:"receipt_voided_at"`
+	RefundAppendedAt *time.Time `db:"refund_appended_at"`
+	TicketRemovedAt  *time.Time `db:"ticket_removed_at"`
+
+	FailedStep    *string `db:"failed_step"`
+	FailureReason *string `db:"failure_reason"`
+
+	StartedAt time.Time `db:"started_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func (s TicketSaga) StepCompleted(step TicketSagaStep) bool {
+	switch step {
+	case TicketSagaStepStore:
+		return s.StoredAt != nil
+	case TicketSagaStepReceipt:
+		return s.ReceiptIssuedAt != nil
+	case TicketSagaStepPrint:
+		return s.PrintedAt != nil
+	case TicketSagaStepFile:
+		return s.FileCreatedAt != nil
+	default:
+		return false
+	}
+}
+
+// TicketSagaStart is the ticket data the compensations need.
+type TicketSagaStart struct {
+	TicketID       string `db:"ticket_id"`
+	CustomerEmail  string `db:"customer_email"`
+	PriceAmount    string `db:"price_amount"`
+	PriceCurrency  string `db:"price_currency"`
+	IdempotencyKey string `db:"idempotency_key"`
+	CorrelationID  string `db:"correlation_id"`
+}
+
+type TicketSagasRepository interface {
+	// Start creates the saga, it's a no-op when the saga already exists.
+	Start(ctx context.Context, start TicketSagaStart) error
+	Get(ctx context.Context, ticketID string) (TicketSaga, error)
+	// CompleteStep records the step and completes the saga when it was the last one missing.
+	CompleteStep(ctx context.Context, start TicketSagaStart, step TicketSagaStep) (TicketSaga, error)
+	// FailStep moves an in progress saga to compensating, failed reports if it was moved by this call.
+	FailStep(ctx context.Context, start TicketSagaStart, step TicketSagaStep, reason string) (saga TicketSaga, failed bool, err error)
+	MarkCompensated(ctx context.Context, ticketID string, compensation TicketSagaCompensation) error
+	// FinishCompensation moves a compensating saga to compensated.
+	FinishCompensation(ctx context.Context, ticketID string) error
+	FindTimedOut(ctx context.Context, startedBefore time.Time, limit int) ([]TicketSaga, error)
+}
+
+func NewTicketSagasRepository(db *sqlx.DB) TicketSagasRepository {
+	return &ticketSagasRepository{
+		db,
+	}
+}
+
+type ticketSagasRepository struct {
+	db *sqlx.DB
+}
+
+func (r *ticketSagasRepository) Start(ctx context.Context, start TicketSagaStart) error {
+	_, err := r.db.NamedExecContext(ctx, `
+INSERT INTO ticket_sagas
+    (ticket_id, status, customer_email, price_amount, price_currency, idempotency_key, correlation_id, started_at, updated_at)
+VALUES (:ticket_id, 'in_progress', :customer_email, CAST(:price_amount AS NUMERIC), :price_currency, :idempotency_key, :correlation_id, NOW(), NOW())
+ON CONFLICT DO NOTHING
+`, start)
+
+	return err
+}
+
+func (r *ticketSagasRepository) Get(ctx context.Context, ticketID string) (TicketSaga, error) {
+	saga := TicketSaga{}
+
+	err := r.db.GetContext(ctx, &saga, "SELECT * FROM ticket_sagas WHERE ticket_id = $1", ticketID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TicketSaga{}, ErrTicketSagaNotFound
+	}
+	if err != nil {
+		return TicketSaga{}, err
+	}
+
+	return saga, nil
+}
+
+func (r *ticketSagasRepository) CompleteStep(ctx context.Context, start TicketSagaStart, step TicketSagaStep) (TicketSaga, error) {
+	column, ok := ticketSagaStepColumns[step]
+	if !ok {
+		return TicketSaga{}, fmt.Errorf("unknown saga step %s", step)
+	}
+
+	err := r.Start(ctx, start)
+	if err != nil {
+		return TicketSaga{}, err
+	}
+
+	_, err = r.db.ExecContext(ctx, fmt.Sprintf(`
+UPDATE ticket_sagas SET %[1]s = COALESCE(%[1]s, NOW()), updated_at = NOW()
+WHERE ticket_id = $1
+`, column), start.TicketID)
+	if err != nil {
+		return TicketSaga{}, err
+	}
+
+	_, err = r.db.ExecContext(ctx, `
+UPDATE ticket_sagas SET status = 'completed', updated_at = NOW()
+WHERE ticket_id = $1 AND status = 'in_progress'
+    AND stored_at IS NOT NULL
+    AND receipt_issued_at IS NOT NULL
+    AND printed_at IS NOT NULL
+    AND file_created_at IS NOT NULL
+`, start.TicketID)
+	if err != nil {
+		return TicketSaga{}, err
+	}
+
+	return r.Get(ctx, start.TicketID)
+}
+
+func (r *ticketSagasRepository) FailStep(ctx context.Context, start TicketSagaStart, step TicketSagaStep, reason string) (TicketSaga, bool, error) {
+	err := r.Start(ctx, start)
+	if err != nil {
+		return TicketSaga{}, false, err
+	}
+
+	res, err := r.db.ExecContext(ctx, `
+UPDATE ticket_sagas SET status = 'compensating', failed_step = $2, failure_reason = $3, updated_at = NOW()
+WHERE ticket_id = $1 AND status = 'in_progress'
+`, start.TicketID, step, reason)
+	if err != nil {
+		return TicketSaga{}, false, err
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return TicketSaga{}, false, err
+	}
+
+	saga, err := r.Get(ctx, start.TicketID)
+	if err != nil {
+		return TicketSaga{}, false, err
+	}
+
+	return saga, updated > 0, nil
+}
+
+func (r *ticketSagasRepository) MarkCompensated(ctx context.Context, ticketID string, compensation TicketSagaCompensation) error {
+	column, ok := ticketSagaCompensationColumns[compensation]
+	if !ok {
+		return fmt.Errorf("unknown saga compensation %s", compensation)
+	}
+
+	_, err := r.db.ExecContext(ctx, fmt.Sprintf(`
+UPDATE ticket_sagas SET %[1]s = COALESCE(%[1]s, NOW()), updated_at = NOW()
+WHERE ticket_id = $1
+`, column), ticketID)
+
+	return err
+}
+
+func (r *ticketSagasRepository) FinishCompensation(ctx context.Context, ticketID string) error {
+	_, err := r.db.ExecContext(ctx, `
+UPDATE ticket_sagas SET status = 'compensated', updated_at = NOW()
+WHERE ticket_id = $1 AND status = 'compensating'
+`, ticketID)
+
+	return err
+}
+
+func (r *ticketSagasRepository) FindTimedOut(ctx context.Context, startedBefore time.Time, limit int) ([]TicketSaga, error) {
+	sagas := []TicketSaga{}
+
+	err := r.db.SelectContext(ctx, &sagas, `
+SELECT * FROM ticket_sagas
+WHERE status = 'in_progress' AND started_at < $1
+ORDER BY started_at
+LIMIT $2
+`, startedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return sagas, nil
+}
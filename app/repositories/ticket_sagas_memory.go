@@ -0,0 +1,191 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MemoryTicketSagasRepository struct {
+	lock  sync.Mutex
+	sagas map[string]TicketSaga
+}
+
+func NewMemoryTicketSagasRepository() *MemoryTicketSagasRepository {
+	return &MemoryTicketSagasRepository{
+		sagas: make(map[string]TicketSaga),
+	}
+}
+
+func (r *MemoryTicketSagasRepository) Start(_ context.Context, start TicketSagaStart) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.start(start)
+
+	return nil
+}
+
+func (r *MemoryTicketSagasRepository) Get(_ context.Context, ticketID string) (TicketSaga, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	saga, ok := r.sagas[ticketID]
+	if !ok {
+		return TicketSaga{}, ErrTicketSagaNotFound
+	}
+
+	return saga, nil
+}
+
+func (r *MemoryTicketSagasRepository) CompleteStep(_ context.Context, start TicketSagaStart, step TicketSagaStep) (TicketSaga, error) {
+	if _, ok := ticketSagaStepColumns[step]; !ok {
+		return TicketSaga{}, fmt.Errorf("unknown saga step %s", step)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.start(start)
+	saga := r.sagas[start.TicketID]
+
+	now := time.Now()
+	switch step {
+	case TicketSagaStepStore:
+		saga.StoredAt = coalesceTime(saga.StoredAt, now)
+	case TicketSagaStepReceipt:
+		saga.ReceiptIssuedAt = coalesceTime(saga.ReceiptIssuedAt, now)
+	case TicketSagaStepPrint:
+		saga.PrintedAt = coalesceTime(saga.PrintedAt, now)
+	case TicketSagaStepFile:
+		saga.FileCreatedAt = coalesceTime(saga.FileCreatedAt, now)
+	}
+	saga.UpdatedAt = now
+
+	completed := true
+	for _, sagaStep := range TicketSagaSteps {
+		completed = completed && saga.StepCompleted(sagaStep)
+	}
+	if completed && saga.Status == TicketSagaStatusInProgress {
+		saga.Status = TicketSagaStatusCompleted
+	}
+
+	r.sagas[start.TicketID] = saga
+
+	return saga, nil
+}
+
+func (r *MemoryTicketSagasRepository) FailStep(_ context.Context, start TicketSagaStart, step TicketSagaStep, reason string) (TicketSaga, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.start(start)
+	saga := r.sagas[start.TicketID]
+	if saga.Status != TicketSagaStatusInProgress {
+		return saga, false, nil
+	}
+
+	failedStep := string(step)
+	saga.Status = TicketSagaStatusCompensating
+	saga.FailedStep = &failedStep
+	saga.FailureReason = &reason
+	saga.UpdatedAt = time.Now()
+
+	r.sagas[start.TicketID] = saga
+
+	return saga, true, nil
+}
+
+func (r *MemoryTicketSagasRepository) MarkCompensated(_ context.Context, ticketID string, compensation TicketSagaCompensation) error {
+	if _, ok := ticketSagaCompensationColumns[compensation]; !ok {
+		return fmt.Errorf("unknown saga compensation %s", compensation)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	saga, ok := r.sagas[ticketID]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	switch compensation {
+	case TicketSagaCompensationVoidReceipt:
+		saga.ReceiptVoidedAt = coalesceTime(saga.ReceiptVoidedAt, now)
+	case TicketSagaCompensationAppendRefund:
+		saga.RefundAppendedAt = coalesceTime(saga.RefundAppendedAt, now)
+	case TicketSagaCompensationRemoveTicket:
+		saga.TicketRemovedAt = coalesceTime(saga.TicketRemovedAt, now)
+	}
+	saga.UpdatedAt = now
+
+	r.sagas[ticketID] = saga
+
+	return nil
+}
+
+func (r *MemoryTicketSagasRepository) FinishCompensation(_ context.Context, ticketID string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	saga, ok := r.sagas[ticketID]
+	if !ok || saga.Status != TicketSagaStatusCompensating {
+		return nil
+	}
+
+	saga.Status = TicketSagaStatusCompensated
+	saga.UpdatedAt = time.Now()
+	r.sagas[ticketID] = saga
+
+	return nil
+}
+
+func (r *MemoryTicketSagasRepository) FindTimedOut(_ context.Context, startedBefore time.Time, limit int) ([]TicketSaga, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var sagas []TicketSaga
+	for _, saga := range r.sagas {
+		if saga.Status == TicketSagaStatusInProgress && saga.StartedAt.Before(startedBefore) {
+			sagas = append(sagas, saga)
+		}
+	}
+	sort.Slice(sagas, func(i, j int) bool {
+		return sagas[i].StartedAt.Before(sagas[j].StartedAt)
+	})
+	if len(sagas) > limit {
+		sagas = sagas[:limit]
+	}
+
+	return sagas, nil
+}
+
+func (r *MemoryTicketSagasRepository) start(start TicketSagaStart) {
+	if _, ok := r.sagas[start.TicketID]; ok {
+		return
+	}
+
+	now := time.Now()
+	r.sagas[start.TicketID] = TicketSaga{
+		TicketID:       start.TicketID,
+		Status:         TicketSagaStatusInProgress,
+		CustomerEmail:  start.CustomerEmail,
+		PriceAmount:    start.PriceAmount,
+		PriceCurrency:  start.PriceCurrency,
+		IdempotencyKey: start.IdempotencyKey,
+		CorrelationID:  start.CorrelationID,
+		StartedAt:      now,
+		UpdatedAt:      now,
+	}
+}
+
+func coalesceTime(t *time.Time, now time.Time) *time.Time {
+	if t != nil {
+		return t
+	}
+
+	return &now
+}
@@ -2,26 +2,93 @@ package repositories
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tickets/app/money"
+
 	"github.com/jmoiron/sqlx"
 )
 
+var ErrTicketNotFound = errors.New("ticket not found")
+
+type TicketStatus string
+
+const (
+	TicketStatusConfirmed TicketStatus = "confirmed"
+	TicketStatusCanceled  TicketStatus = "canceled"
+)
+
 /*
 ticket_id UUID PRIMARY KEY,
-price_amount NUMERIC(10, 2) NOT NULL,
+price_amount NUMERIC NOT NULL,
 price_currency CHAR(3) NOT NULL,
-customer_email VARCHAR(255) NOT NULL
+customer_email VARCHAR(255) NOT NULL,
+last_event_at TIMESTAMPTZ NOT NULL,
+status VARCHAR(32) NOT NULL,
+created_at TIMESTAMPTZ NOT NULL,
+updated_at TIMESTAMPTZ NOT NULL,
+canceled_at TIMESTAMPTZ
 */
 type Ticket struct {
-	TicketID      string  `db:"ticket_id"`
-	PriceAmount   float64 `db:"price_amount"`
-	PriceCurrency string  `db:"price_currency"`
-	CustomerEmail string  `db:"customer_email"`
+	TicketID string `db:"ticket_id"`
+	// Price is stored in price_amount and price_currency, see ticketRow.
+	Price         money.Money `db:"-"`
+	CustomerEmail string      `db:"customer_email"`
+	// LastEventAt is the publish time of the newest event applied to the ticket,
+	// events are delivered out of order, so older ones must not override it.
+	LastEventAt time.Time `db:"last_event_at"`
+	// Status, CreatedAt, UpdatedAt and CanceledAt are set by the repository.
+	Status     TicketStatus `db:"status"`
+	CreatedAt  time.Time    `db:"created_at"`
+	UpdatedAt  time.Time    `db:"updated_at"`
+	CanceledAt *time.Time   `db:"canceled_at"`
+}
+
+// ticketRow reads price_amount as a string, so NUMERIC amounts stay exact.
+type ticketRow struct {
+	Ticket
+	PriceAmount   string `db:"price_amount"`
+	PriceCurrency string `db:"price_currency"`
+}
+
+func newTicketRow(ticket Ticket) ticketRow {
+	return ticketRow{
+		Ticket:        ticket,
+		PriceAmount:   ticket.Price.Amount(),
+		PriceCurrency: ticket.Price.Currency(),
+	}
+}
+
+func (r ticketRow) ticket() (Ticket, error) {
+	price, err := money.Parse(r.PriceAmount, strings.TrimSpace(r.PriceCurrency))
+	if err != nil {
+		return Ticket{}, fmt.Errorf("invalid price of ticket %s: %w", r.TicketID, err)
+	}
+
+	ticket := r.Ticket
+	ticket.Price = price
+
+	return ticket, nil
+}
+
+type TicketsFilter struct {
+	IncludeCanceled bool
 }
 
 type TicketsRepository interface {
+	// Put stores the ticket, unless it was updated by an event newer than ticket.LastEventAt.
+	// A ticket canceled after ticket.LastEventAt is stored as canceled.
 	Put(ctx context.Context, ticket Ticket) error
-	Delete(ctx context.Context, ticketID string) error
-	GetAll(ctx context.Context) ([]Ticket, error)
+	// Get returns canceled tickets too.
+	Get(ctx context.Context, ticketID string) (Ticket, error)
+	// Cancel marks the ticket as canceled, the ticket is kept for refunds. It leaves a tombstone, so confirmations
+	// published before canceledAt but delivered later store the ticket as canceled.
+	Cancel(ctx context.Context, ticketID string, canceledAt time.Time) error
+	GetAll(ctx context.Context, filter TicketsFilter) ([]Ticket, error)
 }
 
 func NewTicketsRepository(db *sqlx.DB) TicketsRepository {
@@ -35,29 +102,117 @@ type ticketsRepository struct {
 }
 
 func (r *ticketsRepository) Put(ctx context.Context, ticket Ticket) error {
-	_, err := r.db.NamedExec(`
+	return runInTx(ctx, r.db, func(ctx context.Context, tx sqlx.ExtContext) error {
+		err := lockTicket(ctx, tx, ticket.TicketID)
+		if err != nil {
+			return err
+		}
+
+		_, err = sqlx.NamedExecContext(ctx, tx, `
 INSERT INTO tickets 
-    (ticket_id, price_amount, price_currency, customer_email)
-VALUES  (:ticket_id, :price_amount, :price_currency, :customer_email)
-ON CONFLICT DO NOTHING
-`, ticket)
+    (ticket_id, price_amount, price_currency, customer_email, last_event_at, status, created_at, updated_at, canceled_at)
+SELECT
+    CAST(:ticket_id AS UUID),
+    CAST(:price_amount AS NUMERIC),
+    CAST(:price_currency AS CHAR(3)),
+    CAST(:customer_email AS VARCHAR(255)),
+    CAST(:last_event_at AS TIMESTAMPTZ),
+    CASE WHEN tombstone.canceled_at IS NULL THEN 'confirmed' ELSE 'canceled' END,
+    NOW(),
+    NOW(),
+    tombstone.canceled_at
+FROM (SELECT 1) AS ticket
+LEFT JOIN ticket_tombstones AS tombstone
+    ON tombstone.ticket_id = CAST(:ticket_id AS UUID) AND tombstone.canceled_at >= CAST(:last_event_at AS TIMESTAMPTZ)
+ON CONFLICT (ticket_id) DO UPDATE SET
+    price_amount = EXCLUDED.price_amount,
+    price_currency = EXCLUDED.price_currency,
+    customer_email = EXCLUDED.customer_email,
+    last_event_at = EXCLUDED.last_event_at,
+    status = EXCLUDED.status,
+    updated_at = EXCLUDED.updated_at,
+    canceled_at = EXCLUDED.canceled_at
+WHERE tickets.last_event_at < EXCLUDED.last_event_at
+`, newTicketRow(ticket))
 
-	return err
+		return err
+	})
 }
 
-func (r *ticketsRepository) Delete(ctx context.Context, ticketID string) error {
-	_, err := r.db.Exec("DELETE FROM tickets where ticket_id = $1", ticketID)
+func (r *ticketsRepository) Get(ctx context.Context, ticketID string) (Ticket, error) {
+	row := ticketRow{}
 
-	return err
+	err := r.db.GetContext(ctx, &row, "SELECT * FROM tickets WHERE ticket_id = $1", ticketID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Ticket{}, ErrTicketNotFound
+	}
+	if err != nil {
+		return Ticket{}, err
+	}
+
+	return row.ticket()
+}
+
+func (r *ticketsRepository) Cancel(ctx context.Context, ticketID string, canceledAt time.Time) error {
+	return runInTx(ctx, r.db, func(ctx context.Context, tx sqlx.ExtContext) error {
+		err := lockTicket(ctx, tx, ticketID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+INSERT INTO ticket_tombstones
+    (ticket_id, canceled_at)
+VALUES ($1, $2)
+ON CONFLICT (ticket_id) DO UPDATE SET
+    canceled_at = GREATEST(ticket_tombstones.canceled_at, EXCLUDED.canceled_at)
+`, ticketID, canceledAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+UPDATE tickets SET
+    status = 'canceled',
+    last_event_at = $2,
+    updated_at = NOW(),
+    canceled_at = $2
+WHERE ticket_id = $1 AND last_event_at <= $2
+`, ticketID, canceledAt)
+
+		return err
+	})
 }
 
-func (r *ticketsRepository) GetAll(ctx context.Context) ([]Ticket, error) {
-	tickets := []Ticket{}
+func (r *ticketsRepository) GetAll(ctx context.Context, filter TicketsFilter) ([]Ticket, error) {
+	rows := []ticketRow{}
 
-	err := r.db.SelectContext(ctx, &tickets, "SELECT * FROM tickets")
+	err := r.db.SelectContext(
+		ctx,
+		&rows,
+		"SELECT * FROM tickets WHERE $1 OR status <> 'canceled' ORDER BY created_at, ticket_id",
+		filter.IncludeCanceled,
+	)
 	if err != nil {
 		return nil, err
 	}
 
+	tickets := make([]Ticket, 0, len(rows))
+	for _, row := range rows {
+		ticket, err := row.ticket()
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+
 	return tickets, nil
 }
+
+// lockTicket serializes concurrent confirmations and cancellations of the same ticket until the transaction ends,
+// without it both could miss each other's uncommitted writes.
+func lockTicket(ctx context.Context, tx sqlx.ExtContext, ticketID string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", ticketID)
+
+	return err
+}
@@ -0,0 +1,101 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryTicketsRepository keeps the tickets in memory, it's used when running without Postgres.
+type MemoryTicketsRepository struct {
+	lock       sync.Mutex
+	tickets    map[string]Ticket
+	tombstones map[string]time.Time
+}
+
+func NewMemoryTicketsRepository() *MemoryTicketsRepository {
+	return &MemoryTicketsRepository{
+		tickets:    make(map[string]Ticket),
+		tombstones: make(map[string]time.Time),
+	}
+}
+
+func (r *MemoryTicketsRepository) Put(_ context.Context, ticket Ticket) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now().UTC()
+
+	ticket.Status = TicketStatusConfirmed
+	ticket.CreatedAt = now
+	ticket.UpdatedAt = now
+	ticket.CanceledAt = nil
+	if canceledAt, ok := r.tombstones[ticket.TicketID]; ok && !canceledAt.Before(ticket.LastEventAt) {
+		ticket.Status = TicketStatusCanceled
+		ticket.CanceledAt = &canceledAt
+	}
+
+	if stored, ok := r.tickets[ticket.TicketID]; ok {
+		if !stored.LastEventAt.Before(ticket.LastEventAt) {
+			return nil
+		}
+		ticket.CreatedAt = stored.CreatedAt
+	}
+
+	r.tickets[ticket.TicketID] = ticket
+
+	return nil
+}
+
+func (r *MemoryTicketsRepository) Get(_ context.Context, ticketID string) (Ticket, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ticket, ok := r.tickets[ticketID]
+	if !ok {
+		return Ticket{}, ErrTicketNotFound
+	}
+
+	return ticket, nil
+}
+
+func (r *MemoryTicketsRepository) Cancel(_ context.Context, ticketID string, canceledAt time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if tombstone, ok := r.tombstones[ticketID]; !ok || tombstone.Before(canceledAt) {
+		r.tombstones[ticketID] = canceledAt
+	}
+
+	if stored, ok := r.tickets[ticketID]; ok && !stored.LastEventAt.After(canceledAt) {
+		stored.Status = TicketStatusCanceled
+		stored.LastEventAt = canceledAt
+		stored.UpdatedAt = time.Now().UTC()
+		stored.CanceledAt = &canceledAt
+		r.tickets[ticketID] = stored
+	}
+
+	return nil
+}
+
+func (r *MemoryTicketsRepository) GetAll(_ context.Context, filter TicketsFilter) ([]Ticket, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	tickets := make([]Ticket, 0, len(r.tickets))
+	for _, ticket := range r.tickets {
+		if ticket.Status == TicketStatusCanceled && !filter.IncludeCanceled {
+			continue
+		}
+		tickets = append(tickets, ticket)
+	}
+	sort.Slice(tickets, func(i, j int) bool {
+		if !tickets[i].CreatedAt.Equal(tickets[j].CreatedAt) {
+			return tickets[i].CreatedAt.Before(tickets[j].CreatedAt)
+		}
+		return tickets[i].TicketID < tickets[j].TicketID
+	})
+
+	return tickets, nil
+}
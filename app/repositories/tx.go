@@ -0,0 +1,47 @@
+package repositories
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type txKey struct{}
+
+// ContextWithTx makes repository writes done with ctx join tx instead of running on their own.
+func ContextWithTx(ctx context.Context, tx *sqlx.Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+func executor(ctx context.Context, db *sqlx.DB) sqlx.ExtContext {
+	tx, ok := ctx.Value(txKey{}).(*sqlx.Tx)
+	if ok {
+		return tx
+	}
+
+	return db
+}
+
+// runInTx runs fn in the transaction from ctx, or in a new one when ctx has none.
+func runInTx(ctx context.Context, db *sqlx.DB, fn func(ctx context.Context, tx sqlx.ExtContext) error) (err error) {
+	if tx, ok := ctx.Value(txKey{}).(*sqlx.Tx); ok {
+		return fn(ctx, tx)
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = fn(ContextWithTx(ctx, tx), tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,217 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var ErrWebhookSubscriptionNotFound = errors.New("webhook subscription not found")
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryStatusPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryStatusFailed    WebhookDeliveryStatus = "failed"
+)
+
+/*
+id UUID PRIMARY KEY,
+url TEXT NOT NULL,
+events TEXT[] NOT NULL,
+secret VARCHAR(255) NOT NULL,
+created_at TIMESTAMPTZ NOT NULL
+*/
+type WebhookSubscription struct {
+	ID        string         `db:"id"`
+	URL       string         `db:"url"`
+	Events    pq.StringArray `db:"events"`
+	Secret    string         `db:"secret"`
+	CreatedAt time.Time      `db:"created_at"`
+}
+
+/*
+id UUID PRIMARY KEY,
+subscription_id UUID NOT NULL REFERENCES webhook_subscriptions (id),
+event_id VARCHAR(255) NOT NULL,
+event_name VARCHAR(255) NOT NULL,
+payload JSONB NOT NULL,
+status VARCHAR(32) NOT NULL,
+attempts INT NOT NULL,
+next_attempt_at TIMESTAMPTZ NOT NULL,
+last_status_code INT,
+last_error TEXT,
+created_at TIMESTAMPTZ NOT NULL,
+updated_at TIMESTAMPTZ NOT NULL,
+delivered_at TIMESTAMPTZ,
+UNIQUE (subscription_id, event_id)
+*/
+type WebhookDelivery struct {
+	ID             string                `db:"id"`
+	SubscriptionID string                `db:"subscription_id"`
+	EventID        string                `db:"event_id"`
+	EventName      string                `db:"event_name"`
+	Payload        json.RawMessage       `db:"payload"`
+	Status         WebhookDeliveryStatus `db:"status"`
+	Attempts       int                   `db:"attempts"`
+	NextAttemptAt  time.Time             `db:"next_attempt_at"`
+	LastStatusCode *int                  `db:"last_status_code"`
+	LastError      *string               `db:"last_error"`
+	CreatedAt      time.Time             `db:"created_at"`
+	UpdatedAt      time.Time             `db:"updated_at"`
+	DeliveredAt    *time.Time            `db:"delivered_at"`
+}
+
+// DueWebhookDelivery is a delivery with the endpoint it goes to.
+type DueWebhookDelivery struct {
+	WebhookDelivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// WebhookDeliveryAttempt is the outcome of sending a due delivery.
+type WebhookDeliveryAttempt struct {
+	DeliveryID    string
+	Status        WebhookDeliveryStatus
+	StatusCode    *int
+	Error         *string
+	NextAttemptAt time.Time
+	// Skipped attempts are postponed to NextAttemptAt without counting as an attempt.
+	Skipped bool
+}
+
+type WebhooksRepository interface {
+	AddSubscription(ctx context.Context, subscription WebhookSubscription) error
+	GetSubscription(ctx context.Context, id string) (WebhookSubscription, error)
+	// EnqueueDelivery creates a pending delivery for every subscription interested in the event,
+	// it's a no-op for subscriptions which already have a delivery of the event.
+	EnqueueDelivery(ctx context.Context, delivery WebhookDelivery) error
+	Deliveries(ctx context.Context, subscriptionID string, limit int) ([]WebhookDelivery, error)
+	// ClaimDue returns up to limit pending deliveries due at now and postpones them by lease, so other replicas
+	// skip them while they are sent. Deliveries claimed by a replica which died are sent again once lease passes.
+	ClaimDue(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]DueWebhookDelivery, error)
+	// RecordAttempts stores the outcomes of sending claimed deliveries.
+	RecordAttempts(ctx context.Context, attempts []WebhookDeliveryAttempt) error
+}
+
+func NewWebhooksRepository(db *sqlx.DB) WebhooksRepository {
+	return &webhooksRepository{
+		db,
+	}
+}
+
+type webhooksRepository struct {
+	db *sqlx.DB
+}
+
+func (r *webhooksRepository) AddSubscription(ctx context.Context, subscription WebhookSubscription) error {
+	_, err := r.db.NamedExecContext(ctx, `
+INSERT INTO webhook_subscriptions
+    (id, url, events, secret, created_at)
+VALUES (:id, :url, :events, :secret, :created_at)
+`, subscription)
+
+	return err
+}
+
+func (r *webhooksRepository) GetSubscription(ctx context.Context, id string) (WebhookSubscription, error) {
+	subscription := WebhookSubscription{}
+
+	err := r.db.GetContext(ctx, &subscription, "SELECT * FROM webhook_subscriptions WHERE id = $1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebhookSubscription{}, ErrWebhookSubscriptionNotFound
+	}
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+
+	return subscription, nil
+}
+
+func (r *webhooksRepository) EnqueueDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	_, err := r.db.ExecContext(ctx, `
+INSERT INTO webhook_deliveries
+    (id, subscription_id, event_id, event_name, payload, status, attempts, next_attempt_at, created_at, updated_at)
+SELECT gen_random_uuid(), s.id, $1, $2, $3, 'pending', 0, NOW(), NOW(), NOW()
+FROM webhook_subscriptions s
+WHERE $2 = ANY(s.events)
+ON CONFLICT (subscription_id, event_id) DO NOTHING
+`, delivery.EventID, delivery.EventName, delivery.Payload)
+
+	return err
+}
+
+func (r *webhooksRepository) Deliveries(ctx context.Context, subscriptionID string, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+
+	err := r.db.SelectContext(ctx, &deliveries, `
+SELECT * FROM webhook_deliveries
+WHERE subscription_id = $1
+ORDER BY created_at DESC
+LIMIT $2
+`, subscriptionID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (r *webhooksRepository) ClaimDue(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]DueWebhookDelivery, error) {
+	due := []DueWebhookDelivery{}
+
+	// it's a single statement, so the rows are locked only while they are claimed, not while they are sent
+	err := r.db.SelectContext(ctx, &due, `
+UPDATE webhook_deliveries d SET
+    next_attempt_at = $3,
+    updated_at = NOW()
+FROM webhook_subscriptions s
+WHERE s.id = d.subscription_id AND d.id IN (
+    SELECT id FROM webhook_deliveries
+    WHERE status = 'pending' AND next_attempt_at <= $1
+    ORDER BY next_attempt_at
+    LIMIT $2
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING d.*, s.url, s.secret
+`, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+
+	return due, nil
+}
+
+func (r *webhooksRepository) RecordAttempts(ctx context.Context, attempts []WebhookDeliveryAttempt) error {
+	return runInTx(ctx, r.db, func(ctx context.Context, tx sqlx.ExtContext) error {
+		for _, attempt := range attempts {
+			count := 1
+			if attempt.Skipped {
+				count = 0
+			}
+
+			_, err := tx.ExecContext(ctx, `
+UPDATE webhook_deliveries SET
+    status = $2,
+    attempts = attempts + $3,
+    next_attempt_at = $4,
+    last_status_code = COALESCE($5, last_status_code),
+    last_error = $6,
+    updated_at = NOW(),
+    delivered_at = CASE WHEN $2 = 'delivered' THEN NOW() ELSE delivered_at END
+WHERE id = $1 AND status = 'pending'
+`, attempt.DeliveryID, attempt.Status, count, attempt.NextAttemptAt, attempt.StatusCode, attempt.Error)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
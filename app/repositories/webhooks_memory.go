@@ -0,0 +1,170 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type MemoryWebhooksRepository struct {
+	lock          sync.Mutex
+	subscriptions map[string]WebhookSubscription
+	deliveries    []WebhookDelivery
+}
+
+func NewMemoryWebhooksRepository() *MemoryWebhooksRepository {
+	return &MemoryWebhooksRepository{
+		subscriptions: make(map[string]WebhookSubscription),
+	}
+}
+
+func (r *MemoryWebhooksRepository) AddSubscription(_ context.Context, subscription WebhookSubscription) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.subscriptions[subscription.ID] = subscription
+
+	return nil
+}
+
+func (r *MemoryWebhooksRepository) GetSubscription(_ context.Context, id string) (WebhookSubscription, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	subscription, ok := r.subscriptions[id]
+	if !ok {
+		return WebhookSubscription{}, ErrWebhookSubscriptionNotFound
+	}
+
+	return subscription, nil
+}
+
+func (r *MemoryWebhooksRepository) EnqueueDelivery(_ context.Context, delivery WebhookDelivery) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	for _, subscription := range r.subscriptions {
+		if !containsString(subscription.Events, delivery.EventName) || r.hasDelivery(subscription.ID, delivery.EventID) {
+			continue
+		}
+
+		r.deliveries = append(r.deliveries, WebhookDelivery{
+			ID:             uuid.NewString(),
+			SubscriptionID: subscription.ID,
+			EventID:        delivery.EventID,
+			EventName:      delivery.EventName,
+			Payload:        delivery.Payload,
+			Status:         WebhookDeliveryStatusPending,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+	}
+
+	return nil
+}
+
+func (r *MemoryWebhooksRepository) Deliveries(_ context.Context, subscriptionID string, limit int) ([]WebhookDelivery, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for i := len(r.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if r.deliveries[i].SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, r.deliveries[i])
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (r *MemoryWebhooksRepository) ClaimDue(_ context.Context, now time.Time, limit int, lease time.Duration) ([]DueWebhookDelivery, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var due []int
+	for i, delivery := range r.deliveries {
+		if delivery.Status == WebhookDeliveryStatusPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, i)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return r.deliveries[due[i]].NextAttemptAt.Before(r.deliveries[due[j]].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]DueWebhookDelivery, 0, len(due))
+	for _, i := range due {
+		r.deliveries[i].NextAttemptAt = now.Add(lease)
+		r.deliveries[i].UpdatedAt = time.Now()
+
+		delivery := r.deliveries[i]
+		subscription := r.subscriptions[delivery.SubscriptionID]
+
+		claimed = append(claimed, DueWebhookDelivery{
+			WebhookDelivery: delivery,
+			URL:             subscription.URL,
+			Secret:          subscription.Secret,
+		})
+	}
+
+	return claimed, nil
+}
+
+func (r *MemoryWebhooksRepository) RecordAttempts(_ context.Context, attempts []WebhookDeliveryAttempt) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, attempt := range attempts {
+		for i, delivery := range r.deliveries {
+			if delivery.ID != attempt.DeliveryID || delivery.Status != WebhookDeliveryStatusPending {
+				continue
+			}
+
+			if !attempt.Skipped {
+				delivery.Attempts++
+			}
+			delivery.Status = attempt.Status
+			delivery.NextAttemptAt = attempt.NextAttemptAt
+			if attempt.StatusCode != nil {
+				delivery.LastStatusCode = attempt.StatusCode
+			}
+			delivery.LastError = attempt.Error
+			delivery.UpdatedAt = time.Now()
+			if attempt.Status == WebhookDeliveryStatusDelivered {
+				deliveredAt := delivery.UpdatedAt
+				delivery.DeliveredAt = &deliveredAt
+			}
+
+			r.deliveries[i] = delivery
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryWebhooksRepository) hasDelivery(subscriptionID string, eventID string) bool {
+	for _, delivery := range r.deliveries {
+		if delivery.SubscriptionID == subscriptionID && delivery.EventID == eventID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tickets/app/redisstreams"
+)
+
+// DefaultStreamRetention keeps a week of messages on every event and command topic.
+// The poison queue is not trimmed unless a policy is set for it, its messages are removed by admins.
+var DefaultStreamRetention = redisstreams.RetentionPolicy{MaxAge: time.Hour * 24 * 7}
+
+// StreamRetentionFromEnv reads REDIS_STREAM_RETENTION, see ParseStreamRetention.
+func StreamRetentionFromEnv(topics TopicStrategy) (map[string]redisstreams.RetentionPolicy, error) {
+	return ParseStreamRetention(topics, os.Getenv("REDIS_STREAM_RETENTION"))
+}
+
+// ParseStreamRetention returns the retention policy of every topic. The value is a list of "<topic>=<policy>"
+// separated by ";", for example "*=maxage:72h;TicketPrinted=maxlen:100000,maxage:24h;PoisonQueue=maxage:720h".
+// Topics are given without the prefix, "*" replaces DefaultStreamRetention. A policy is "maxlen:<count>",
+// "maxage:<duration>", both separated by "," (the stricter one wins), or "none".
+func ParseStreamRetention(topics TopicStrategy, value string) (map[string]redisstreams.RetentionPolicy, error) {
+	names, err := topics.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	defaultPolicy := DefaultStreamRetention
+	overrides := make(map[string]redisstreams.RetentionPolicy)
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		topic, rawPolicy, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid stream retention %q, expected <topic>=<policy>", entry)
+		}
+
+		policy, err := parseRetentionPolicy(rawPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream retention of %s: %w", topic, err)
+		}
+
+		topic = strings.TrimSpace(topic)
+		if topic == "*" {
+			defaultPolicy = policy
+			continue
+		}
+		overrides[topics.namespaced(topic)] = policy
+	}
+
+	retention := make(map[string]redisstreams.RetentionPolicy, len(names)+1)
+	for _, name := range names {
+		retention[name] = defaultPolicy
+	}
+	// listed for the stats even when it's not trimmed
+	retention[topics.PoisonQueueTopic()] = redisstreams.RetentionPolicy{}
+
+	for topic, policy := range overrides {
+		if _, ok := retention[topic]; !ok {
+			return nil, fmt.Errorf("unknown topic %s in stream retention", topic)
+		}
+		retention[topic] = policy
+	}
+
+	return retention, nil
+}
+
+func parseRetentionPolicy(value string) (redisstreams.RetentionPolicy, error) {
+	value = strings.TrimSpace(value)
+	if value == "none" {
+		return redisstreams.RetentionPolicy{}, nil
+	}
+
+	var policy redisstreams.RetentionPolicy
+	for _, limit := range strings.Split(value, ",") {
+		kind, rawLimit, _ := strings.Cut(strings.TrimSpace(limit), ":")
+
+		switch kind {
+		case "maxlen":
+			maxLen, err := strconv.ParseInt(rawLimit, 10, 64)
+			if err != nil || maxLen <= 0 {
+				return redisstreams.RetentionPolicy{}, fmt.Errorf("invalid maxlen %q", rawLimit)
+			}
+			policy.MaxLen = maxLen
+		case "maxage":
+			maxAge, err := time.ParseDuration(rawLimit)
+			if err != nil || maxAge <= 0 {
+				return redisstreams.RetentionPolicy{}, fmt.Errorf("invalid maxage %q", rawLimit)
+			}
+			policy.MaxAge = maxAge
+		default:
+			return redisstreams.RetentionPolicy{}, fmt.Errorf("unknown limit %q", limit)
+		}
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,46 @@
+package app_test
+
+import (
+	"testing"
+	"time"
+
+	"tickets/app"
+	"tickets/app/redisstreams"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStreamRetention(t *testing.T) {
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+
+	commands, err := app.NewCommandRegistry()
+	require.NoError(t, err)
+
+	topics := app.TopicStrategy{Prefix: "tenant-a", Events: events, Commands: commands}
+
+	retention, err := app.ParseStreamRetention(topics, "")
+	require.NoError(t, err)
+	assert.Equal(t, app.DefaultStreamRetention, retention["tenant-a.TicketPrinted"])
+	assert.Equal(t, app.DefaultStreamRetention, retention["tenant-a.commands.RefundTicket.v1"])
+	assert.True(t, retention["tenant-a.PoisonQueue"].IsZero())
+
+	retention, err = app.ParseStreamRetention(topics, "*=maxlen:1000; TicketPrinted=maxlen:10,maxage:1h; PoisonQueue=maxage:720h; commands.RefundTicket.v1=none")
+	require.NoError(t, err)
+	assert.Equal(t, redisstreams.RetentionPolicy{MaxLen: 1000}, retention["tenant-a.TicketBookingConfirmed"])
+	assert.Equal(t, redisstreams.RetentionPolicy{MaxLen: 10, MaxAge: time.Hour}, retention["tenant-a.TicketPrinted"])
+	assert.Equal(t, redisstreams.RetentionPolicy{MaxAge: time.Hour * 720}, retention["tenant-a.PoisonQueue"])
+	assert.True(t, retention["tenant-a.commands.RefundTicket.v1"].IsZero())
+
+	for _, value := range []string{
+		"TicketPrinted",
+		"TicketPrinted=maxlen:0",
+		"TicketPrinted=maxage:soon",
+		"TicketPrinted=forever",
+		"NotATopic.v1=maxlen:10",
+	} {
+		_, err = app.ParseStreamRetention(topics, value)
+		assert.Error(t, err, value)
+	}
+}
@@ -1,11 +1,16 @@
 package app
 
 import (
-	"time"
+	"errors"
+
+	"tickets/app/circuitbreaker"
+	"tickets/app/metrics"
 
 	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	watermillMetrics "github.com/ThreeDotsLabs/watermill/components/metrics"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type NewRouterInput struct {
@@ -18,29 +23,62 @@ func NewRouter(input NewRouterInput) (*message.Router, error) {
 }
 
 type InjectMiddlewaresInput struct {
-	Router *message.Router
-	Logger *log.WatermillLogrusAdapter
+	Router           *message.Router
+	Logger           *log.WatermillLogrusAdapter
+	Publisher        message.Publisher
+	PoisonQueueTopic string
+	BookingSaga      *BookingSaga
+	// Policies are filled in by the handlers, the middlewares read them while handling messages.
+	Policies *HandlerPolicies
+	// LogLevels are the log levels of handlers, the ones at debug level log payloads.
+	LogLevels HandlerLogLevels
+	// Registries resolve the types of messages.
+	Registries []*MessageRegistry
+	// UnknownTypes filters out messages which no handler could unmarshal.
+	UnknownTypes *UnknownTypeFilter
+	// Normalizer fixes the payloads of known message types before they are unmarshaled.
+	Normalizer *PayloadNormalizer
 }
 
-func InjectMiddlewares(input InjectMiddlewaresInput) {
+func InjectMiddlewares(input InjectMiddlewaresInput) error {
 	router := input.Router
 
 	// Middlewares
+	router.AddMiddleware(TracingMiddleware)
 	router.AddMiddleware(injectCorrelationId)
-	retry := middleware.Retry{
-		MaxRetries:      10,
-		InitialInterval: time.Millisecond * 100,
-		MaxInterval:     time.Second,
-		Multiplier:      2,
-		Logger:          input.Logger,
+	// counts and durations of handled messages, including retries, by handler and result
+	watermillMetrics.NewPrometheusMetricsBuilder(prometheus.DefaultRegisterer, metrics.Namespace, "router").
+		AddPrometheusRouterMetrics(router)
+	router.AddMiddleware(skipRequeuedForOtherHandlers)
+	router.AddMiddleware(RenameLegacyMessages(input.Registries))
+	// outside of retries and the poison queue, so the policy for unknown types is applied as it is
+	router.AddMiddleware(input.UnknownTypes.Middleware)
+	router.AddMiddleware(countInFlight)
+	router.AddMiddleware(delayWhenCircuitOpen)
+
+	// messages which are still failing after all retries are moved to the poison queue,
+	// the ones refused by an open circuit are redelivered once it closes
+	poisonQueue, err := middleware.PoisonQueueWithFilter(input.Publisher, input.PoisonQueueTopic, func(err error) bool {
+		return !errors.Is(err, circuitbreaker.ErrOpen)
+	})
+	if err != nil {
+		return err
 	}
 
-	logMiddleware := LogMiddleware{OkMessage: "Handling a message", ErrMessage: "Message handling error"}
+	logMiddleware := NewLogMiddleware(NewLogMiddlewareInput{
+		OkMessage:  "Handling a message",
+		ErrMessage: "Message handling error",
+		Levels:     input.LogLevels,
+		Registries: input.Registries,
+	})
 	router.AddMiddleware(logMiddleware.Middleware)
-	router.AddMiddleware(retry.Middleware)
-
-	// skip messages without type because we don't want to handle them
-	// router.AddMiddleware(skipMessagesWithEmptyType)
+	router.AddMiddleware(input.Policies.PoisonMiddleware(poisonQueue))
+	// the saga reads the payload, so it's normalized first; fixing it again wouldn't help, so it's not retried
+	router.AddMiddleware(input.Normalizer.Middleware)
+	// the saga has to see errors only after all retries failed
+	router.AddMiddleware(input.BookingSaga.Middleware)
+	router.AddMiddleware(input.Policies.RetryMiddleware(input.Logger))
+	router.AddMiddleware(input.Policies.TimeoutMiddleware)
 
-	router.AddMiddleware(fixCurrency)
+	return nil
 }
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	defaultSchedulerPollInterval = time.Second
+	defaultSchedulerBatchSize    = 100
+)
+
+type NewSchedulerInput struct {
+	Marshaler         cqrs.CommandEventMarshaler
+	Topics            TopicStrategy
+	Publisher         message.Publisher
+	ScheduledMessages repositories.ScheduledMessagesRepository
+	PollInterval      time.Duration
+	BatchSize         int
+}
+
+// Scheduler publishes events at a given time. Scheduled events are stored in Postgres, so they survive restarts,
+// and every replica can run the worker: each due event is published by one of them.
+// Publishing is at least once, a crash right after publishing may publish the event again with the same ID.
+type Scheduler struct {
+	marshaler         cqrs.CommandEventMarshaler
+	topics            TopicStrategy
+	publisher         message.Publisher
+	scheduledMessages repositories.ScheduledMessagesRepository
+	pollInterval      time.Duration
+	batchSize         int
+}
+
+func NewScheduler(input NewSchedulerInput) *Scheduler {
+	if input.PollInterval == 0 {
+		input.PollInterval = defaultSchedulerPollInterval
+	}
+	if input.BatchSize == 0 {
+		input.BatchSize = defaultSchedulerBatchSize
+	}
+
+	return &Scheduler{
+		marshaler:         input.Marshaler,
+		topics:            input.Topics,
+		publisher:         input.Publisher,
+		scheduledMessages: input.ScheduledMessages,
+		pollInterval:      input.PollInterval,
+		batchSize:         input.BatchSize,
+	}
+}
+
+// PublishAt schedules the event to be published on its topic at the given time.
+func (s *Scheduler) PublishAt(ctx context.Context, event any, at time.Time) error {
+	msg, err := s.marshaler.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	topic, err := s.topics.EventTopic(s.marshaler.Name(event))
+	if err != nil {
+		return err
+	}
+
+	msg.Metadata.Set(MessageTypeKey, s.marshaler.Name(event))
+	err = setCorrelationIdMetadata(event, msg)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(msg.Metadata)
+	if err != nil {
+		return err
+	}
+
+	return s.scheduledMessages.Add(ctx, repositories.ScheduledMessage{
+		MessageUUID: msg.UUID,
+		Topic:       topic,
+		Payload:     msg.Payload,
+		Metadata:    metadata,
+		DeliverAt:   at,
+	})
+}
+
+// Run polls for due events until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for {
+			delivered, err := s.scheduledMessages.DeliverDue(ctx, time.Now(), s.batchSize, s.publish)
+			if err != nil {
+				log.FromContext(ctx).WithError(err).Error("Could not publish scheduled messages")
+				break
+			}
+			if delivered < s.batchSize {
+				break
+			}
+		}
+	}
+}
+
+func (s *Scheduler) publish(scheduled repositories.ScheduledMessage) error {
+	msg := message.NewMessage(scheduled.MessageUUID, scheduled.Payload)
+
+	err := json.Unmarshal(scheduled.Metadata, &msg.Metadata)
+	if err != nil {
+		return err
+	}
+
+	return s.publisher.Publish(scheduled.Topic, msg)
+}
@@ -0,0 +1,142 @@
+package app_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tickets/app"
+	"tickets/app/money"
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyPublisher fails a number of publishes before it starts publishing.
+type flakyPublisher struct {
+	message.Publisher
+	failures int64
+	attempts atomic.Int64
+}
+
+func (p *flakyPublisher) Publish(topic string, messages ...*message.Message) error {
+	if p.attempts.Add(1) <= p.failures {
+		return errors.New("broker is down")
+	}
+
+	return p.Publisher.Publish(topic, messages...)
+}
+
+func TestSchedulerPublishesWhenDue(t *testing.T) {
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+	topics := app.TopicStrategy{Events: events}
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	topic, err := topics.EventTopic(events.Name(app.TicketBookingConfirmed{}))
+	require.NoError(t, err)
+	published, err := pubSub.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	scheduler := app.NewScheduler(app.NewSchedulerInput{
+		Marshaler:         cqrs.JSONMarshaler{GenerateName: events.Name},
+		Topics:            topics,
+		Publisher:         pubSub,
+		ScheduledMessages: repositories.NewMemoryScheduledMessagesRepository(),
+		PollInterval:      10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = scheduler.Run(ctx)
+	}()
+
+	event := newScheduledConfirmation()
+	deliverAt := time.Now().Add(300 * time.Millisecond)
+	require.NoError(t, scheduler.PublishAt(context.Background(), event, deliverAt))
+
+	select {
+	case msg := <-published:
+		t.Fatalf("published %s before it was due", msg.UUID)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	select {
+	case msg := <-published:
+		msg.Ack()
+		assert.False(t, time.Now().Before(deliverAt), "published early")
+		assert.Equal(t, "TicketBookingConfirmed", msg.Metadata.Get(app.MessageTypeKey))
+		assert.Equal(t, event.Header.CorrelationID, msg.Metadata.Get("correlation_id"))
+	case <-time.After(time.Second):
+		t.Fatal("not published when due")
+	}
+
+	// published messages are removed from the schedule
+	select {
+	case msg := <-published:
+		t.Fatalf("published %s twice", msg.UUID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSchedulerRepublishesAfterFailedPublish(t *testing.T) {
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+	topics := app.TopicStrategy{Events: events}
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	publisher := &flakyPublisher{Publisher: pubSub, failures: 2}
+
+	topic, err := topics.EventTopic(events.Name(app.TicketBookingConfirmed{}))
+	require.NoError(t, err)
+	published, err := pubSub.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	scheduler := app.NewScheduler(app.NewSchedulerInput{
+		Marshaler:         cqrs.JSONMarshaler{GenerateName: events.Name},
+		Topics:            topics,
+		Publisher:         publisher,
+		ScheduledMessages: repositories.NewMemoryScheduledMessagesRepository(),
+		PollInterval:      10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = scheduler.Run(ctx)
+	}()
+
+	require.NoError(t, scheduler.PublishAt(context.Background(), newScheduledConfirmation(), time.Now()))
+
+	select {
+	case msg := <-published:
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("not published after the publisher recovered")
+	}
+
+	assert.EqualValues(t, 3, publisher.attempts.Load())
+}
+
+func newScheduledConfirmation() app.TicketBookingConfirmed {
+	return app.TicketBookingConfirmed{
+		TicketEvent: &app.TicketEvent{
+			Header: app.NewEventHeader(watermill.NewUUID(), watermill.NewUUID()),
+			Ticket: &app.Ticket{
+				TicketID: watermill.NewUUID(),
+				Status:   app.TicketStatusConfirmed,
+				Price:    money.MustParse("50.00", "USD"),
+			},
+		},
+	}
+}
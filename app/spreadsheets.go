@@ -2,13 +2,23 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/ThreeDotsLabs/go-event-driven/common/clients"
 	"github.com/ThreeDotsLabs/go-event-driven/common/clients/spreadsheets"
+	"golang.org/x/time/rate"
 )
 
+// defaultRateLimitedPause is how long calls are paused after a 429 without a Retry-After header.
+const defaultRateLimitedPause = time.Second
+
+// SpreadsheetsClientInterface appends rows to the sheets of the gateway. Handlers get a client which buffers the rows
+// of a sheet, see NewBatchingSpreadsheetsClient, and rate limits the calls, see NewRateLimitedSpreadsheetsClient.
 type SpreadsheetsClientInterface interface {
 	AppendRow(ctx context.Context, spreadsheetName string, row []string) error
 }
@@ -32,9 +42,162 @@ func (c SpreadsheetsClient) AppendRow(ctx context.Context, spreadsheetName strin
 	if err != nil {
 		return err
 	}
+	if sheetsResp.StatusCode() == http.StatusTooManyRequests {
+		return &RateLimitedError{RetryAfter: retryAfter(sheetsResp.HTTPResponse)}
+	}
 	if sheetsResp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %v", sheetsResp.StatusCode())
+		return &UnexpectedStatusError{StatusCode: sheetsResp.StatusCode()}
 	}
 
 	return nil
 }
+
+// UnexpectedStatusError is returned when the spreadsheets API answered with a status other than 200 and 429.
+type UnexpectedStatusError struct {
+	StatusCode int
+}
+
+func (e *UnexpectedStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %v", e.StatusCode)
+}
+
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitedError is returned when the gateway answered 429, it matches ErrRateLimited with errors.Is.
+type RateLimitedError struct {
+	// RetryAfter is 0 when the gateway didn't say when to retry.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter == 0 {
+		return ErrRateLimited.Error()
+	}
+
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// retryAfter reads the Retry-After header in seconds, dates are not sent by the gateway.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// SpreadsheetsRateLimit caps the calls to the spreadsheets API of the gateway, which answers 429 past its limit.
+type SpreadsheetsRateLimit struct {
+	// RequestsPerSecond is the sustained rate, Burst is the number of calls which can be made at once.
+	RequestsPerSecond float64
+	Burst             int
+}
+
+var DefaultSpreadsheetsRateLimit = SpreadsheetsRateLimit{
+	RequestsPerSecond: 10,
+	Burst:             10,
+}
+
+// ParseSpreadsheetsRateLimit reads the SPREADSHEETS_RATE_LIMIT setting, the requests per second,
+// DefaultSpreadsheetsRateLimit is used when it's empty.
+func ParseSpreadsheetsRateLimit(value string) (SpreadsheetsRateLimit, error) {
+	if value == "" {
+		return DefaultSpreadsheetsRateLimit, nil
+	}
+
+	requestsPerSecond, err := strconv.ParseFloat(value, 64)
+	if err != nil || requestsPerSecond <= 0 {
+		return SpreadsheetsRateLimit{}, fmt.Errorf("invalid spreadsheets rate limit %q, expected requests per second", value)
+	}
+
+	burst := int(requestsPerSecond)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return SpreadsheetsRateLimit{
+		RequestsPerSecond: requestsPerSecond,
+		Burst:             burst,
+	}, nil
+}
+
+type rateLimitedSpreadsheetsClient struct {
+	client  SpreadsheetsClientInterface
+	limiter *rate.Limiter
+
+	lock     sync.Mutex
+	resumeAt time.Time
+}
+
+// NewRateLimitedSpreadsheetsClient spreads the calls of all handlers over time, so batches of tickets
+// don't go past the limit of the gateway. When the gateway answers 429 anyway, the calls are paused
+// for as long as it asks, and the failed call is left to the retries of its handler.
+func NewRateLimitedSpreadsheetsClient(client SpreadsheetsClientInterface, limit SpreadsheetsRateLimit) SpreadsheetsClientInterface {
+	return &rateLimitedSpreadsheetsClient{
+		client:  client,
+		limiter: rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), limit.Burst),
+	}
+}
+
+func (c *rateLimitedSpreadsheetsClient) AppendRow(ctx context.Context, spreadsheetName string, row []string) error {
+	err := c.waitForResume(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.limiter.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.client.AppendRow(ctx, spreadsheetName, row)
+
+	var rateLimited *RateLimitedError
+	if errors.As(err, &rateLimited) {
+		c.pause(rateLimited.RetryAfter)
+	}
+
+	return err
+}
+
+func (c *rateLimitedSpreadsheetsClient) waitForResume(ctx context.Context) error {
+	c.lock.Lock()
+	delay := time.Until(c.resumeAt)
+	c.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *rateLimitedSpreadsheetsClient) pause(retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = defaultRateLimitedPause
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if resumeAt := time.Now().Add(retryAfter); resumeAt.After(c.resumeAt) {
+		c.resumeAt = resumeAt
+	}
+}
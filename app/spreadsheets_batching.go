@@ -0,0 +1,131 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SpreadsheetsBatching buffers the rows appended to a sheet, see NewBatchingSpreadsheetsClient.
+type SpreadsheetsBatching struct {
+	// MaxRows flushes a batch once it has this many rows, MaxDelay once its first row waited this long.
+	MaxRows  int
+	MaxDelay time.Duration
+}
+
+var DefaultSpreadsheetsBatching = SpreadsheetsBatching{
+	MaxRows:  50,
+	MaxDelay: time.Millisecond * 50,
+}
+
+// ParseSpreadsheetsBatching reads the SPREADSHEETS_BATCH_SIZE and SPREADSHEETS_BATCH_DELAY settings, the number of rows
+// and a duration like "50ms". Empty ones are taken from DefaultSpreadsheetsBatching.
+func ParseSpreadsheetsBatching(size string, delay string) (SpreadsheetsBatching, error) {
+	batching := DefaultSpreadsheetsBatching
+
+	if size != "" {
+		maxRows, err := strconv.Atoi(size)
+		if err != nil || maxRows <= 0 {
+			return SpreadsheetsBatching{}, fmt.Errorf("invalid spreadsheets batch size %q, expected a positive number of rows", size)
+		}
+		batching.MaxRows = maxRows
+	}
+
+	if delay != "" {
+		maxDelay, err := time.ParseDuration(delay)
+		if err != nil || maxDelay <= 0 {
+			return SpreadsheetsBatching{}, fmt.Errorf("invalid spreadsheets batch delay %q, expected a positive duration", delay)
+		}
+		batching.MaxDelay = maxDelay
+	}
+
+	return batching, nil
+}
+
+type batchingSpreadsheetsClient struct {
+	client   SpreadsheetsClientInterface
+	batching SpreadsheetsBatching
+
+	lock sync.Mutex
+	// batches are the batches being filled, by sheet
+	batches map[string]*rowsBatch
+}
+
+type rowsBatch struct {
+	sheet string
+	rows  []*bufferedRow
+	timer *time.Timer
+}
+
+type bufferedRow struct {
+	ctx     context.Context
+	row     []string
+	flushed chan error
+}
+
+// NewBatchingSpreadsheetsClient buffers the rows appended to a sheet by all handlers, and flushes them together
+// once the batch has MaxRows rows or its first row waited MaxDelay. AppendRow returns only after the row
+// was flushed, with the error of its own row, so handlers ack their messages only after their rows are written.
+//
+// The gateway only has a single-row endpoint (POST /sheets/{sheet}/rows), so a flush appends the rows one by one,
+// in the order they were buffered. Each call is made with the context of its row, which carries its deadline
+// and correlation ID.
+func NewBatchingSpreadsheetsClient(client SpreadsheetsClientInterface, batching SpreadsheetsBatching) SpreadsheetsClientInterface {
+	return &batchingSpreadsheetsClient{
+		client:   client,
+		batching: batching,
+		batches:  make(map[string]*rowsBatch),
+	}
+}
+
+func (c *batchingSpreadsheetsClient) AppendRow(ctx context.Context, spreadsheetName string, row []string) error {
+	buffered := &bufferedRow{
+		ctx:     ctx,
+		row:     row,
+		flushed: make(chan error, 1),
+	}
+
+	c.lock.Lock()
+	batch, ok := c.batches[spreadsheetName]
+	if !ok {
+		batch = &rowsBatch{sheet: spreadsheetName}
+		batch.timer = time.AfterFunc(c.batching.MaxDelay, func() {
+			c.flush(batch)
+		})
+		c.batches[spreadsheetName] = batch
+	}
+	batch.rows = append(batch.rows, buffered)
+	full := len(batch.rows) >= c.batching.MaxRows
+	c.lock.Unlock()
+
+	if full {
+		c.flush(batch)
+	}
+
+	return <-buffered.flushed
+}
+
+// flush appends the rows of the batch, unless it was already flushed when it filled up before its timer fired.
+func (c *batchingSpreadsheetsClient) flush(batch *rowsBatch) {
+	c.lock.Lock()
+	if c.batches[batch.sheet] != batch {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.batches, batch.sheet)
+	c.lock.Unlock()
+
+	batch.timer.Stop()
+
+	for _, buffered := range batch.rows {
+		// the handler gave up on the row, it's appended again when the message is redelivered
+		if err := buffered.ctx.Err(); err != nil {
+			buffered.flushed <- err
+			continue
+		}
+
+		buffered.flushed <- c.client.AppendRow(buffered.ctx, batch.sheet, buffered.row)
+	}
+}
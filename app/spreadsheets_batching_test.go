@@ -0,0 +1,147 @@
+package app_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"tickets/app"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchingSpreadsheetsClientFlushesFullBatch(t *testing.T) {
+	spreadsheets := &app.SpreadsheetsClientMock{Sheets: make(map[string][][]string)}
+	client := app.NewBatchingSpreadsheetsClient(spreadsheets, app.SpreadsheetsBatching{
+		MaxRows:  3,
+		MaxDelay: time.Hour,
+	})
+
+	appended := make(chan error, 3)
+	for _, ticketID := range []string{"ticket-1", "ticket-2"} {
+		ticketID := ticketID
+		go func() {
+			appended <- client.AppendRow(context.Background(), "tickets-to-print", []string{ticketID})
+		}()
+	}
+
+	// rows are not written, and their messages not acked, until the batch is flushed
+	select {
+	case err := <-appended:
+		t.Fatalf("row appended before the batch was full: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Empty(t, spreadsheets.Sheets["tickets-to-print"])
+
+	require.NoError(t, client.AppendRow(context.Background(), "tickets-to-print", []string{"ticket-3"}))
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-appended:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("row not appended after the batch was flushed")
+		}
+	}
+
+	assert.Len(t, spreadsheets.Sheets["tickets-to-print"], 3)
+	assert.Equal(t, []string{"ticket-3"}, spreadsheets.Sheets["tickets-to-print"][2])
+}
+
+func TestBatchingSpreadsheetsClientFlushesAfterDelay(t *testing.T) {
+	spreadsheets := &app.SpreadsheetsClientMock{Sheets: make(map[string][][]string)}
+	client := app.NewBatchingSpreadsheetsClient(spreadsheets, app.SpreadsheetsBatching{
+		MaxRows:  100,
+		MaxDelay: 50 * time.Millisecond,
+	})
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for _, sheet := range []string{"tickets-to-print", "tickets-to-refund", "tickets-to-refund"} {
+		sheet := sheet
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, client.AppendRow(context.Background(), sheet, []string{"ticket"}))
+		}()
+	}
+	wg.Wait()
+
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Len(t, spreadsheets.Sheets["tickets-to-print"], 1)
+	assert.Len(t, spreadsheets.Sheets["tickets-to-refund"], 2)
+}
+
+func TestBatchingSpreadsheetsClientReturnsErrorOfItsRow(t *testing.T) {
+	spreadsheets := &app.SpreadsheetsClientMock{Sheets: make(map[string][][]string)}
+	failure := errors.New("spreadsheets are down")
+	client := app.NewBatchingSpreadsheetsClient(rowFailingSpreadsheetsClient{
+		client:  spreadsheets,
+		failing: map[string]error{"ticket-3": failure},
+	}, app.SpreadsheetsBatching{
+		MaxRows:  3,
+		MaxDelay: time.Hour,
+	})
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	lock := sync.Mutex{}
+	errs := map[string]error{}
+	wg := sync.WaitGroup{}
+	for ticketID, ctx := range map[string]context.Context{
+		"ticket-1": context.Background(),
+		"ticket-2": canceled,
+		"ticket-3": context.Background(),
+	} {
+		ticketID, ctx := ticketID, ctx
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.AppendRow(ctx, "tickets-to-print", []string{ticketID})
+
+			lock.Lock()
+			defer lock.Unlock()
+			errs[ticketID] = err
+		}()
+	}
+	wg.Wait()
+
+	assert.NoError(t, errs["ticket-1"])
+	// the handler gave up on the row before the flush, so it's not written
+	assert.ErrorIs(t, errs["ticket-2"], context.Canceled)
+	assert.ErrorIs(t, errs["ticket-3"], failure)
+	assert.Equal(t, [][]string{{"ticket-1"}}, spreadsheets.Sheets["tickets-to-print"])
+}
+
+// rowFailingSpreadsheetsClient fails the rows whose first column has an error.
+type rowFailingSpreadsheetsClient struct {
+	client  app.SpreadsheetsClientInterface
+	failing map[string]error
+}
+
+func (c rowFailingSpreadsheetsClient) AppendRow(ctx context.Context, spreadsheetName string, row []string) error {
+	if err, ok := c.failing[row[0]]; ok {
+		return err
+	}
+
+	return c.client.AppendRow(ctx, spreadsheetName, row)
+}
+
+func TestParseSpreadsheetsBatching(t *testing.T) {
+	batching, err := app.ParseSpreadsheetsBatching("", "")
+	require.NoError(t, err)
+	assert.Equal(t, app.DefaultSpreadsheetsBatching, batching)
+
+	batching, err = app.ParseSpreadsheetsBatching("10", "1s")
+	require.NoError(t, err)
+	assert.Equal(t, app.SpreadsheetsBatching{MaxRows: 10, MaxDelay: time.Second}, batching)
+
+	_, err = app.ParseSpreadsheetsBatching("0", "")
+	assert.Error(t, err)
+
+	_, err = app.ParseSpreadsheetsBatching("", "soon")
+	assert.Error(t, err)
+}
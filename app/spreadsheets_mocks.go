@@ -11,6 +11,9 @@ type SpreadsheetsClientMock struct {
 }
 
 func (c *SpreadsheetsClientMock) AppendRow(ctx context.Context, spreadsheetName string, row []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	c.Sheets[spreadsheetName] = append(c.Sheets[spreadsheetName], row)
 
 	return nil
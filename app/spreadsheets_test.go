@@ -0,0 +1,94 @@
+package app_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"tickets/app"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSpreadsheetsClient answers with the given errors in order, then succeeds.
+type recordingSpreadsheetsClient struct {
+	lock   sync.Mutex
+	errors []error
+	calls  []time.Time
+}
+
+func (c *recordingSpreadsheetsClient) AppendRow(ctx context.Context, spreadsheetName string, row []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.calls = append(c.calls, time.Now())
+	if len(c.errors) == 0 {
+		return nil
+	}
+
+	err := c.errors[0]
+	c.errors = c.errors[1:]
+
+	return err
+}
+
+func TestRateLimitedSpreadsheetsClient(t *testing.T) {
+	client := &recordingSpreadsheetsClient{}
+	limited := app.NewRateLimitedSpreadsheetsClient(client, app.SpreadsheetsRateLimit{
+		RequestsPerSecond: 20,
+		Burst:             2,
+	})
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		require.NoError(t, limited.AppendRow(context.Background(), "tickets-to-print", []string{"ticket"}))
+	}
+
+	assert.Len(t, client.calls, 4)
+	// the burst goes through at once, the rest at 20 per second
+	assert.GreaterOrEqual(t, time.Since(start), 2*time.Second/20-10*time.Millisecond)
+}
+
+func TestRateLimitedSpreadsheetsClient_pauses_when_rate_limited(t *testing.T) {
+	client := &recordingSpreadsheetsClient{
+		errors: []error{&app.RateLimitedError{RetryAfter: 200 * time.Millisecond}},
+	}
+	limited := app.NewRateLimitedSpreadsheetsClient(client, app.SpreadsheetsRateLimit{
+		RequestsPerSecond: 1000,
+		Burst:             10,
+	})
+
+	err := limited.AppendRow(context.Background(), "tickets-to-print", []string{"ticket"})
+	require.ErrorIs(t, err, app.ErrRateLimited)
+
+	err = limited.AppendRow(context.Background(), "tickets-to-print", []string{"ticket"})
+	require.NoError(t, err)
+
+	require.Len(t, client.calls, 2)
+	assert.GreaterOrEqual(t, client.calls[1].Sub(client.calls[0]), 200*time.Millisecond)
+
+	// waiting for the pause to end stops with the context
+	client.errors = []error{&app.RateLimitedError{RetryAfter: time.Minute}}
+	_ = limited.AppendRow(context.Background(), "tickets-to-print", []string{"ticket"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = limited.AppendRow(ctx, "tickets-to-print", []string{"ticket"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, client.calls, 3)
+}
+
+func TestParseSpreadsheetsRateLimit(t *testing.T) {
+	limit, err := app.ParseSpreadsheetsRateLimit("")
+	require.NoError(t, err)
+	assert.Equal(t, app.DefaultSpreadsheetsRateLimit, limit)
+
+	limit, err = app.ParseSpreadsheetsRateLimit("0.5")
+	require.NoError(t, err)
+	assert.Equal(t, app.SpreadsheetsRateLimit{RequestsPerSecond: 0.5, Burst: 1}, limit)
+
+	_, err = app.ParseSpreadsheetsRateLimit("fast")
+	assert.Error(t, err)
+}
@@ -1,5 +1,7 @@
 package app
 
+import "tickets/app/money"
+
 type TicketStatus string
 
 func (t TicketStatus) String() string {
@@ -11,14 +13,10 @@ const (
 	TicketStatusCanceled  TicketStatus = "canceled"
 )
 
-type Price struct {
-	Amount   string `json:"amount"`
-	Currency string `json:"currency"`
-}
-
 type Ticket struct {
-	TicketID      string       `json:"ticket_id"`
-	Status        TicketStatus `json:"status"`
-	CustomerEmail string       `json:"customer_email"`
-	Price         Price        `json:"price"`
+	TicketID string       `json:"ticket_id"`
+	Status   TicketStatus `json:"status"`
+	// CustomerEmail is encrypted in message payloads, see pii.Marshaler.
+	CustomerEmail string      `json:"customer_email" pii:"true"`
+	Price         money.Money `json:"price"`
 }
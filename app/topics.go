@@ -1,5 +1,13 @@
 package app
 
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
 type TopicName string
 
 func (t TopicName) String() string {
@@ -7,6 +15,199 @@ func (t TopicName) String() string {
 }
 
 const (
-	TicketBookingConfirmedTopic TopicName = "TicketBookingConfirmed"
-	TicketBookingCanceledTopic  TopicName = "TicketBookingCanceled"
+	PoisonQueueTopic TopicName = "PoisonQueue"
 )
+
+// MessageDefinition is the wire identity of an event: its name is stored in the message metadata,
+// and together with the version it makes the topic.
+type MessageDefinition struct {
+	Name    string
+	Version int
+	// LegacyName is the struct name the message was published under before the registry, it's optional.
+	// Version 1 keeps it as its topic, so the streams and consumer groups created back then carry on,
+	// and messages still named after it are handled as Name.
+	LegacyName string
+}
+
+// MessageTypeKey is the metadata key of the message name, it's set by the buses next to the "name" key
+// of cqrs.JSONMarshaler.
+const MessageTypeKey = "type"
+
+// MessageTypeFromMetadata returns the name of the message,
+// messages published before the type key was set have only the "name" key.
+func MessageTypeFromMetadata(msg *message.Message) string {
+	if messageType := msg.Metadata.Get(MessageTypeKey); messageType != "" {
+		return messageType
+	}
+
+	return msg.Metadata.Get("name")
+}
+
+// MessageRegistry maps Go types to explicit wire names, so renaming a struct never changes the topic.
+type MessageRegistry struct {
+	byType map[reflect.Type]MessageDefinition
+	byName map[string]MessageDefinition
+	types  map[string]reflect.Type
+	// legacy maps legacy names to names
+	legacy map[string]string
+}
+
+func NewMessageRegistry() *MessageRegistry {
+	return &MessageRegistry{
+		byType: make(map[reflect.Type]MessageDefinition),
+		byName: make(map[string]MessageDefinition),
+		types:  make(map[string]reflect.Type),
+		legacy: make(map[string]string),
+	}
+}
+
+// Register adds the type of v to the registry, v may be a value or a pointer.
+func (r *MessageRegistry) Register(v any, definition MessageDefinition) error {
+	if definition.Name == "" || definition.Version < 1 {
+		return fmt.Errorf("invalid definition %+v for %T", definition, v)
+	}
+
+	t := messageType(v)
+	if _, ok := r.byType[t]; ok {
+		return fmt.Errorf("%s is already registered", t)
+	}
+	if _, ok := r.byName[definition.Name]; ok {
+		return fmt.Errorf("name %s is already registered", definition.Name)
+	}
+	if _, ok := r.legacy[definition.LegacyName]; ok {
+		return fmt.Errorf("legacy name %s is already registered", definition.LegacyName)
+	}
+
+	r.byType[t] = definition
+	r.byName[definition.Name] = definition
+	r.types[definition.Name] = t
+	if definition.LegacyName != "" {
+		r.legacy[definition.LegacyName] = definition.Name
+	}
+
+	return nil
+}
+
+// Name is meant to be used as cqrs.JSONMarshaler.GenerateName, it returns an empty name
+// for unregistered types so topic generation fails instead of falling back to the struct name.
+func (r *MessageRegistry) Name(v any) string {
+	return r.byType[messageType(v)].Name
+}
+
+func (r *MessageRegistry) Definition(name string) (MessageDefinition, bool) {
+	definition, ok := r.byName[name]
+
+	return definition, ok
+}
+
+// CurrentName returns the name registered for a legacy name, other names are returned as they are.
+func (r *MessageRegistry) CurrentName(name string) string {
+	if current, ok := r.legacy[name]; ok {
+		return current
+	}
+
+	return name
+}
+
+// Type returns the Go type registered under the name.
+func (r *MessageRegistry) Type(name string) (reflect.Type, bool) {
+	t, ok := r.types[name]
+
+	return t, ok
+}
+
+// Names returns the registered names, sorted.
+func (r *MessageRegistry) Names() []string {
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func messageType(v any) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	return t
+}
+
+// TopicStrategy is the single place where topic names are built, it's shared by the buses and the processors.
+type TopicStrategy struct {
+	// Prefix namespaces all topics per environment or tenant, it's optional.
+	// Setting it on a running deployment moves every topic, the messages left on the old ones are not handled.
+	Prefix   string
+	Events   *MessageRegistry
+	Commands *MessageRegistry
+}
+
+// EventTopic returns the topic for a registered event name, for example `prod.TicketBookingConfirmed.v2`.
+// Version 1 of events with a legacy name is published to the legacy topic, for example `prod.TicketCanceledEvent`.
+func (s TopicStrategy) EventTopic(name string) (string, error) {
+	return s.topic(s.Events, "", name)
+}
+
+// CommandTopic returns the topic for a registered command name, for example `prod.commands.RefundTicket.v1`.
+func (s TopicStrategy) CommandTopic(name string) (string, error) {
+	return s.topic(s.Commands, "commands.", name)
+}
+
+// Topics returns the topics of all registered events and commands, the poison queue is not included.
+func (s TopicStrategy) Topics() ([]string, error) {
+	var topics []string
+
+	if s.Events != nil {
+		for _, name := range s.Events.Names() {
+			topic, err := s.EventTopic(name)
+			if err != nil {
+				return nil, err
+			}
+			topics = append(topics, topic)
+		}
+	}
+
+	if s.Commands != nil {
+		for _, name := range s.Commands.Names() {
+			topic, err := s.CommandTopic(name)
+			if err != nil {
+				return nil, err
+			}
+			topics = append(topics, topic)
+		}
+	}
+
+	return topics, nil
+}
+
+func (s TopicStrategy) PoisonQueueTopic() string {
+	return s.namespaced(PoisonQueueTopic.String())
+}
+
+func (s TopicStrategy) topic(registry *MessageRegistry, kind string, name string) (string, error) {
+	if registry == nil {
+		return "", fmt.Errorf("no registry for message %q", name)
+	}
+
+	definition, ok := registry.Definition(name)
+	if !ok {
+		return "", fmt.Errorf("message %q is not registered", name)
+	}
+
+	if definition.Version == 1 && definition.LegacyName != "" {
+		return s.namespaced(kind + definition.LegacyName), nil
+	}
+
+	return s.namespaced(fmt.Sprintf("%s%s.v%d", kind, definition.Name, definition.Version)), nil
+}
+
+func (s TopicStrategy) namespaced(topic string) string {
+	if s.Prefix == "" {
+		return topic
+	}
+
+	return s.Prefix + "." + topic
+}
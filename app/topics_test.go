@@ -0,0 +1,135 @@
+package app_test
+
+import (
+	"context"
+	"testing"
+	"tickets/app"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicStrategy(t *testing.T) {
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+
+	commands, err := app.NewCommandRegistry()
+	require.NoError(t, err)
+
+	assert.Equal(t, "TicketBookingCanceled", events.Name(app.TicketCanceledEvent{}))
+	assert.Equal(t, "TicketBookingCanceled", events.Name(&app.TicketCanceledEvent{}))
+	assert.Empty(t, events.Name(app.Ticket{}))
+
+	// version 1 of the events published before the registry keeps their topics
+	topic, err := app.TopicStrategy{Events: events}.EventTopic("TicketBookingConfirmed")
+	require.NoError(t, err)
+	assert.Equal(t, "TicketBookingConfirmed", topic)
+
+	topic, err = app.TopicStrategy{Events: events}.EventTopic("TicketBookingCanceled")
+	require.NoError(t, err)
+	assert.Equal(t, "TicketCanceledEvent", topic)
+	assert.Equal(t, "TicketBookingCanceled", events.CurrentName("TicketCanceledEvent"))
+	assert.Equal(t, "TicketBookingCanceled", events.CurrentName("TicketBookingCanceled"))
+
+	topic, err = app.TopicStrategy{Events: events}.EventTopic("BookingSagaFailed")
+	require.NoError(t, err)
+	assert.Equal(t, "BookingSagaFailed.v1", topic)
+
+	strategy := app.TopicStrategy{Prefix: "tenant-a", Events: events, Commands: commands}
+
+	topic, err = strategy.EventTopic("TicketPrinted")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-a.TicketPrinted", topic)
+	assert.Equal(t, "tenant-a.PoisonQueue", strategy.PoisonQueueTopic())
+
+	topic, err = strategy.CommandTopic("RefundTicket")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-a.commands.RefundTicket.v1", topic)
+
+	topics, err := strategy.Topics()
+	require.NoError(t, err)
+	assert.Contains(t, topics, "tenant-a.TicketPrinted")
+	assert.Contains(t, topics, "tenant-a.commands.RefundTicket.v1")
+	assert.NotContains(t, topics, "tenant-a.PoisonQueue")
+
+	_, err = strategy.EventTopic("")
+	assert.Error(t, err)
+
+	_, err = strategy.EventTopic("RefundTicket")
+	assert.Error(t, err)
+
+	// bumping the version moves an event with a legacy name to a versioned topic
+	registry := app.NewMessageRegistry()
+	require.NoError(t, registry.Register(app.TicketCanceledEvent{}, app.MessageDefinition{
+		Name:       "TicketBookingCanceled",
+		Version:    2,
+		LegacyName: "TicketCanceledEvent",
+	}))
+	topic, err = app.TopicStrategy{Events: registry}.EventTopic("TicketBookingCanceled")
+	require.NoError(t, err)
+	assert.Equal(t, "TicketBookingCanceled.v2", topic)
+}
+
+func TestLegacyEventsAreHandled(t *testing.T) {
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+	topics := app.TopicStrategy{Events: events}
+	marshaler := cqrs.JSONMarshaler{GenerateName: events.Name}
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	router.AddMiddleware(app.RenameLegacyMessages([]*app.MessageRegistry{events}))
+
+	processor, err := cqrs.NewEventProcessorWithConfig(router, cqrs.EventProcessorConfig{
+		GenerateSubscribeTopic: func(params cqrs.EventProcessorGenerateSubscribeTopicParams) (string, error) {
+			return topics.EventTopic(params.EventName)
+		},
+		SubscriberConstructor: func(cqrs.EventProcessorSubscriberConstructorParams) (message.Subscriber, error) {
+			return pubSub, nil
+		},
+		Marshaler: marshaler,
+	})
+	require.NoError(t, err)
+
+	handled := make(chan string, 1)
+	err = processor.AddHandlers(cqrs.NewEventHandler("append-canceled", func(ctx context.Context, event *app.TicketCanceledEvent) error {
+		handled <- event.TicketID
+		return nil
+	}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = router.Run(ctx)
+	}()
+	<-router.Running()
+
+	// published before the registry: named after the struct, to the topic named after the struct
+	legacyMarshaler := cqrs.JSONMarshaler{GenerateName: cqrs.StructName}
+	msg, err := legacyMarshaler.Marshal(app.TicketCanceledEvent{
+		TicketEvent: &app.TicketEvent{
+			Header: app.NewEventHeader(watermill.NewUUID(), watermill.NewUUID()),
+			Ticket: &app.Ticket{TicketID: "legacy-ticket"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "TicketCanceledEvent", msg.Metadata.Get("name"))
+	require.NoError(t, pubSub.Publish("TicketCanceledEvent", msg))
+
+	select {
+	case ticketID := <-handled:
+		assert.Equal(t, "legacy-ticket", ticketID)
+	case <-time.After(time.Second * 5):
+		t.Fatal("legacy event not handled")
+	}
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "tickets"
+
+type TracesExporter string
+
+const (
+	TracesExporterNone TracesExporter = "none"
+	// TracesExporterOTLP sends spans over OTLP/HTTP, it's configured with the OTEL_EXPORTER_OTLP_* variables.
+	TracesExporterOTLP TracesExporter = "otlp"
+	// TracesExporterStdout and TracesExporterFile write spans as JSON, for local runs.
+	TracesExporterStdout TracesExporter = "stdout"
+	TracesExporterFile   TracesExporter = "file"
+)
+
+var TracesExporters = []TracesExporter{
+	TracesExporterNone,
+	TracesExporterOTLP,
+	TracesExporterStdout,
+	TracesExporterFile,
+}
+
+// ParseTracesExporter reads the TRACES_EXPORTER setting, spans are not exported when it's empty.
+func ParseTracesExporter(value string) (TracesExporter, error) {
+	if value == "" {
+		return TracesExporterNone, nil
+	}
+
+	for _, exporter := range TracesExporters {
+		if string(exporter) == value {
+			return exporter, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown traces exporter %q", value)
+}
+
+type NewTracerProviderInput struct {
+	Exporter TracesExporter
+	// FilePath is where TracesExporterFile writes spans.
+	FilePath string
+}
+
+// NewTracerProvider returns nil for TracesExporterNone, so spans are not recorded at all.
+// The trace context is still passed from requests to messages and to the gateway.
+func NewTracerProvider(ctx context.Context, input NewTracerProviderInput) (*sdktrace.TracerProvider, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+
+	switch input.Exporter {
+	case TracesExporterNone:
+		return nil, nil
+	case TracesExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	case TracesExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TracesExporterFile:
+		var file io.Writer
+		file, err = os.OpenFile(input.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open traces file: %w", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", input.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", EventSource))),
+	), nil
+}
+
+// SetupTracing makes the provider global, a nil provider keeps the no-op one.
+func SetupTracing(provider *sdktrace.TracerProvider) {
+	if provider != nil {
+		otel.SetTracerProvider(provider)
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// httpTracing starts a span for every request, continuing the trace of the caller.
+func httpTracing(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer().Start(
+			ctx,
+			req.Method+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", c.Path()),
+			),
+		)
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+
+		status := responseStatus(c, err)
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+
+		spanErr := err
+		if spanErr == nil && status >= http.StatusInternalServerError {
+			spanErr = fmt.Errorf("status %d", status)
+		}
+		endSpan(span, spanErr)
+
+		return err
+	}
+}
+
+type tracingPublisher struct {
+	message.Publisher
+}
+
+// NewTracingPublisher starts a span for every published message, as a child of the span in the message context,
+// and passes the trace context in the message metadata.
+func NewTracingPublisher(publisher message.Publisher) message.Publisher {
+	return tracingPublisher{Publisher: publisher}
+}
+
+func (p tracingPublisher) Publish(topic string, messages ...*message.Message) error {
+	spans := make([]trace.Span, 0, len(messages))
+	for _, msg := range messages {
+		ctx, span := tracer().Start(
+			msg.Context(),
+			"publish "+topic,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attribute.String("messaging.destination.name", topic),
+				attribute.String("messaging.message.id", msg.UUID),
+				attribute.String("messaging.message.type", MessageTypeFromMetadata(msg)),
+			),
+		)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Metadata))
+		spans = append(spans, span)
+	}
+
+	err := p.Publisher.Publish(topic, messages...)
+	for _, span := range spans {
+		endSpan(span, err)
+	}
+
+	return err
+}
+
+// TracingMiddleware starts a span for every handled message, continuing the trace of its publisher.
+func TracingMiddleware(next message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		ctx := otel.GetTextMapPropagator().Extract(msg.Context(), propagation.MapCarrier(msg.Metadata))
+
+		handlerName := message.HandlerNameFromCtx(msg.Context())
+		ctx, span := tracer().Start(
+			ctx,
+			handlerName,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.destination.name", message.SubscribeTopicFromCtx(msg.Context())),
+				attribute.String("messaging.message.id", msg.UUID),
+				attribute.String("messaging.message.type", MessageTypeFromMetadata(msg)),
+				attribute.String("messaging.handler", handlerName),
+			),
+		)
+
+		parent := msg.Context()
+		msg.SetContext(ctx)
+		defer msg.SetContext(parent)
+
+		messages, err := next(msg)
+		endSpan(span, err)
+
+		return messages, err
+	}
+}
+
+// traceGatewayCall starts a span for a gateway call, and passes the trace context in the request headers.
+func traceGatewayCall(req *http.Request, client string) (*http.Request, trace.Span) {
+	ctx, span := tracer().Start(
+		req.Context(),
+		req.Method+" "+client,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+			attribute.String("gateway.client", client),
+		),
+	)
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	return req, span
+}
+
+func endGatewaySpan(span trace.Span, resp *http.Response, err error) {
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+
+	endSpan(span, err)
+}
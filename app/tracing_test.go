@@ -0,0 +1,106 @@
+package app_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tickets/app"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingFromPublishToGatewayCall(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous := otel.GetTracerProvider()
+	app.SetupTracing(provider)
+	defer otel.SetTracerProvider(previous)
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NotEmpty(t, r.Header.Get("traceparent"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer gateway.Close()
+
+	gatewayClient := app.NewInstrumentedHTTPClient(http.DefaultClient)
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	publisher := app.NewTracingPublisher(pubSub)
+
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	router.AddMiddleware(app.TracingMiddleware)
+
+	handled := make(chan trace.SpanContext, 1)
+	router.AddNoPublisherHandler("issue-receipt", "events", pubSub, func(msg *message.Message) error {
+		req, err := http.NewRequestWithContext(msg.Context(), http.MethodPost, gateway.URL+"/receipts-api/receipts", nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := gatewayClient.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+
+		handled <- trace.SpanContextFromContext(msg.Context())
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = router.Run(ctx)
+	}()
+	<-router.Running()
+
+	requestCtx, requestSpan := provider.Tracer("test").Start(context.Background(), "POST /tickets-status")
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("{}"))
+	msg.SetContext(requestCtx)
+	require.NoError(t, publisher.Publish("events", msg))
+	requestSpan.End()
+
+	select {
+	case spanContext := <-handled:
+		assert.Equal(t, requestSpan.SpanContext().TraceID(), spanContext.TraceID())
+	case <-time.After(time.Second * 5):
+		t.Fatal("message was not handled")
+	}
+
+	var spans map[string]sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		spans = map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+		return len(spans) == 4
+	}, time.Second*5, time.Millisecond*10)
+
+	publish := spans["publish events"]
+	handler := spans["issue-receipt"]
+	gatewayCall := spans["POST receipts"]
+	require.NotNil(t, publish)
+	require.NotNil(t, handler)
+	require.NotNil(t, gatewayCall)
+
+	assert.Equal(t, requestSpan.SpanContext().SpanID(), publish.Parent().SpanID())
+	assert.Equal(t, publish.SpanContext().SpanID(), handler.Parent().SpanID())
+	assert.Equal(t, handler.SpanContext().SpanID(), gatewayCall.Parent().SpanID())
+	assert.Equal(t, trace.SpanKindConsumer, handler.SpanKind())
+	assert.Equal(t, trace.SpanKindClient, gatewayCall.SpanKind())
+}
@@ -0,0 +1,217 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"tickets/app/metrics"
+	"tickets/app/pii"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// UnknownTypePolicy is what happens to a message whose type is missing or not registered.
+type UnknownTypePolicy string
+
+const (
+	// UnknownTypeDrop acks the message.
+	UnknownTypeDrop UnknownTypePolicy = "drop"
+	// UnknownTypeQuarantine moves the message to the quarantine topic and acks it, once per handler of the topic.
+	UnknownTypeQuarantine UnknownTypePolicy = "quarantine"
+	// UnknownTypeFail nacks the message without retries, so it's redelivered until a release knows its type.
+	// It blocks the messages behind it.
+	UnknownTypeFail UnknownTypePolicy = "fail"
+)
+
+var UnknownTypePolicies = []UnknownTypePolicy{
+	UnknownTypeDrop,
+	UnknownTypeQuarantine,
+	UnknownTypeFail,
+}
+
+// ErrUnknownMessageType is returned by handlers of messages with an unknown type under UnknownTypeFail.
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// DefaultUnknownTypeLogInterval is how often a payload of an unknown type is logged per handler.
+const DefaultUnknownTypeLogInterval = time.Minute
+
+// maxLoggedPayload is how much of a masked offending payload is logged.
+const maxLoggedPayload = 1024
+
+// ParseUnknownTypePolicy reads the UNKNOWN_MESSAGE_TYPE_POLICY setting, messages are quarantined when it's empty.
+func ParseUnknownTypePolicy(value string) (UnknownTypePolicy, error) {
+	if value == "" {
+		return UnknownTypeQuarantine, nil
+	}
+
+	for _, policy := range UnknownTypePolicies {
+		if string(policy) == value {
+			return policy, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown policy for unknown message types %q", value)
+}
+
+type NewUnknownTypeFilterInput struct {
+	Policy UnknownTypePolicy
+	// Registries hold the known types, a message is known when any of them has its name.
+	Registries []*MessageRegistry
+	// Publisher and QuarantineTopic are required by UnknownTypeQuarantine.
+	Publisher       message.Publisher
+	QuarantineTopic string
+	// LogInterval defaults to DefaultUnknownTypeLogInterval.
+	LogInterval time.Duration
+}
+
+// UnknownTypeFilter applies the policy to messages whose type/name metadata is missing or not in the registries,
+// before they reach handlers which would fail to unmarshal them and retry.
+// Every such message is counted in metrics.UnknownTypeMessages, and a sample of the payloads is logged.
+type UnknownTypeFilter struct {
+	policy          UnknownTypePolicy
+	registries      []*MessageRegistry
+	publisher       message.Publisher
+	quarantineTopic string
+	logInterval     time.Duration
+
+	mu         sync.Mutex
+	lastLogged map[string]time.Time
+	suppressed map[string]int
+}
+
+func NewUnknownTypeFilter(input NewUnknownTypeFilterInput) (*UnknownTypeFilter, error) {
+	if input.Policy == UnknownTypeQuarantine && (input.Publisher == nil || input.QuarantineTopic == "") {
+		return nil, errors.New("quarantine of unknown message types needs a publisher and a topic")
+	}
+	if input.LogInterval == 0 {
+		input.LogInterval = DefaultUnknownTypeLogInterval
+	}
+
+	return &UnknownTypeFilter{
+		policy:          input.Policy,
+		registries:      input.Registries,
+		publisher:       input.Publisher,
+		quarantineTopic: input.QuarantineTopic,
+		logInterval:     input.LogInterval,
+		lastLogged:      make(map[string]time.Time),
+		suppressed:      make(map[string]int),
+	}, nil
+}
+
+func (f *UnknownTypeFilter) known(messageType string) bool {
+	for _, registry := range f.registries {
+		if _, ok := registry.Definition(messageType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *UnknownTypeFilter) Middleware(next message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		messageType := MessageTypeFromMetadata(msg)
+		if messageType != "" && f.known(messageType) {
+			return next(msg)
+		}
+
+		handlerName := message.HandlerNameFromCtx(msg.Context())
+		metrics.UnknownTypeMessages.WithLabelValues(handlerName, string(f.policy)).Inc()
+		f.logSample(msg, handlerName, messageType)
+
+		switch f.policy {
+		case UnknownTypeDrop:
+			return nil, nil
+		case UnknownTypeFail:
+			return nil, fmt.Errorf("%w %q", ErrUnknownMessageType, messageType)
+		default:
+			return nil, f.quarantine(msg, handlerName, messageType)
+		}
+	}
+}
+
+// quarantine publishes the message with the metadata of the poison queue middleware,
+// so it can be inspected like a poisoned message when the quarantine topic is the poison queue.
+//
+// The filter runs in every handler, so a message on a topic with several handlers is quarantined once per handler,
+// each copy with its own handler in the metadata. It's on purpose: a requeued message is handled only by the handler
+// in its metadata (see skipRequeuedForOtherHandlers), so a single copy would be requeued for one handler only.
+func (f *UnknownTypeFilter) quarantine(msg *message.Message, handlerName string, messageType string) error {
+	quarantined := msg.Copy()
+	quarantined.Metadata.Set(middleware.PoisonedTopicKey, message.SubscribeTopicFromCtx(msg.Context()))
+	quarantined.Metadata.Set(middleware.PoisonedHandlerKey, handlerName)
+	quarantined.Metadata.Set(middleware.PoisonedSubscriberKey, message.SubscriberNameFromCtx(msg.Context()))
+	quarantined.Metadata.Set(middleware.ReasonForPoisonedKey, fmt.Sprintf("%s %q", ErrUnknownMessageType, messageType))
+
+	err := f.publisher.Publish(f.quarantineTopic, quarantined)
+	if err != nil {
+		return fmt.Errorf("could not quarantine message %s: %w", msg.UUID, err)
+	}
+
+	return nil
+}
+
+// logSample logs the first offending message of a handler in every log interval, with the number of messages
+// which were not logged since the previous one. Only the size and the top-level keys of the payload are logged,
+// the PII fields of an unknown type can't be told, so the payload is logged only at debug level, with its strings masked.
+func (f *UnknownTypeFilter) logSample(msg *message.Message, handlerName string, messageType string) {
+	f.mu.Lock()
+	if time.Since(f.lastLogged[handlerName]) < f.logInterval {
+		f.suppressed[handlerName]++
+		f.mu.Unlock()
+		return
+	}
+	suppressed := f.suppressed[handlerName]
+	f.lastLogged[handlerName] = time.Now()
+	f.suppressed[handlerName] = 0
+	f.mu.Unlock()
+
+	logger := log.FromContext(msg.Context()).
+		WithField("message_uuid", msg.UUID).
+		WithField("handler", handlerName).
+		WithField("message_type", messageType).
+		WithField("policy", f.policy).
+		WithField("not_logged_since_last_sample", suppressed).
+		WithField("payload_size", len(msg.Payload)).
+		WithField("payload_keys", payloadKeys(msg.Payload))
+
+	logger.Warn("Message with an unknown type")
+	if logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		logger.WithField("payload", maskedUnknownPayload(msg.Payload)).Debug("Payload of the message with an unknown type")
+	}
+}
+
+// payloadKeys returns the sorted top-level keys of a JSON object payload, and nil for other payloads.
+func payloadKeys(payload []byte) []string {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func maskedUnknownPayload(payload []byte) string {
+	masked, err := pii.MaskStrings(payload)
+	if err != nil {
+		return fmt.Sprintf("(not logged, could not mask PII: %s)", err)
+	}
+	if len(masked) > maxLoggedPayload {
+		masked = masked[:maxLoggedPayload]
+	}
+
+	return string(masked)
+}
@@ -0,0 +1,201 @@
+package app_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tickets/app"
+	"tickets/app/metrics"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownTypeFilter(t *testing.T) {
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		Policy            app.UnknownTypePolicy
+		ExpectedHandled   int64
+		ExpectQuarantined bool
+		ExpectRedelivered bool
+	}{
+		{Policy: app.UnknownTypeDrop, ExpectedHandled: 1},
+		{Policy: app.UnknownTypeQuarantine, ExpectedHandled: 1, ExpectQuarantined: true},
+		{Policy: app.UnknownTypeFail, ExpectedHandled: 1, ExpectRedelivered: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.Policy), func(t *testing.T) {
+			pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+
+			filter, err := app.NewUnknownTypeFilter(app.NewUnknownTypeFilterInput{
+				Policy:          tc.Policy,
+				Registries:      []*app.MessageRegistry{events},
+				Publisher:       pubSub,
+				QuarantineTopic: "quarantine",
+			})
+			require.NoError(t, err)
+
+			quarantined, err := pubSub.Subscribe(context.Background(), "quarantine")
+			require.NoError(t, err)
+
+			router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+			require.NoError(t, err)
+			router.AddMiddleware(filter.Middleware)
+
+			handlerName := "unknown-types-" + string(tc.Policy)
+			handled := atomic.Int64{}
+			router.AddNoPublisherHandler(handlerName, "events", pubSub, func(msg *message.Message) error {
+				handled.Add(1)
+				return nil
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go func() {
+				_ = router.Run(ctx)
+			}()
+			<-router.Running()
+
+			counter := metrics.UnknownTypeMessages.WithLabelValues(handlerName, string(tc.Policy))
+			countedBefore := testutil.ToFloat64(counter)
+			counted := func() float64 {
+				return testutil.ToFloat64(counter) - countedBefore
+			}
+
+			known := message.NewMessage(watermill.NewUUID(), []byte("{}"))
+			known.Metadata.Set(app.MessageTypeKey, "TicketPrinted")
+			require.NoError(t, pubSub.Publish("events", known))
+
+			assert.Eventually(t, func() bool {
+				return handled.Load() == tc.ExpectedHandled
+			}, time.Second*5, time.Millisecond*10)
+
+			untyped := message.NewMessage(watermill.NewUUID(), []byte(`{"something":"else"}`))
+			unknown := message.NewMessage(watermill.NewUUID(), []byte("{}"))
+			unknown.Metadata.Set("name", "TicketTeleported")
+
+			if tc.ExpectRedelivered {
+				require.NoError(t, pubSub.Publish("events", untyped))
+
+				// the failed message is nacked and redelivered over and over
+				assert.Eventually(t, func() bool {
+					return counted() > 2
+				}, time.Second*5, time.Millisecond*10)
+				assert.Equal(t, tc.ExpectedHandled, handled.Load())
+
+				return
+			}
+
+			require.NoError(t, pubSub.Publish("events", untyped, unknown))
+
+			assert.Eventually(t, func() bool {
+				return counted() == 2
+			}, time.Second*5, time.Millisecond*10)
+			assert.Equal(t, tc.ExpectedHandled, handled.Load())
+
+			if !tc.ExpectQuarantined {
+				return
+			}
+
+			// gochannel doesn't keep the order of the published messages
+			expected := map[string]*message.Message{untyped.UUID: untyped, unknown.UUID: unknown}
+			for range []*message.Message{untyped, unknown} {
+				select {
+				case msg := <-quarantined:
+					require.Contains(t, expected, msg.UUID)
+					assert.Equal(t, expected[msg.UUID].Payload, msg.Payload)
+					assert.Equal(t, handlerName, msg.Metadata.Get(middleware.PoisonedHandlerKey))
+					assert.Equal(t, "events", msg.Metadata.Get(middleware.PoisonedTopicKey))
+					assert.Contains(t, msg.Metadata.Get(middleware.ReasonForPoisonedKey), "unknown message type")
+					delete(expected, msg.UUID)
+					msg.Ack()
+				case <-time.After(time.Second * 5):
+					t.Fatal("message was not quarantined")
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownTypeFilter_logs_payload_only_at_debug_level(t *testing.T) {
+	events, err := app.NewEventRegistry()
+	require.NoError(t, err)
+
+	payload := `{"ticket_id":"ticket-1","customer_email":"alice@example.com","price":{"amount":"50.00","currency":"USD"},"seats":2}`
+
+	for _, level := range []logrus.Level{logrus.InfoLevel, logrus.DebugLevel} {
+		t.Run(level.String(), func(t *testing.T) {
+			filter, err := app.NewUnknownTypeFilter(app.NewUnknownTypeFilterInput{
+				Policy:     app.UnknownTypeDrop,
+				Registries: []*app.MessageRegistry{events},
+			})
+			require.NoError(t, err)
+
+			logger, hook := test.NewNullLogger()
+			logger.SetLevel(level)
+
+			msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+			msg.Metadata.Set(app.MessageTypeKey, "TicketRefunded")
+			msg.SetContext(log.ToContext(context.Background(), logrus.NewEntry(logger)))
+
+			_, err = filter.Middleware(func(msg *message.Message) ([]*message.Message, error) {
+				return nil, nil
+			})(msg)
+			require.NoError(t, err)
+
+			for _, entry := range hook.AllEntries() {
+				for _, value := range entry.Data {
+					assert.NotContains(t, fmt.Sprint(value), "alice@example.com")
+				}
+			}
+
+			sample := hook.AllEntries()[0]
+			assert.Equal(t, logrus.WarnLevel, sample.Level)
+			assert.Equal(t, len(payload), sample.Data["payload_size"])
+			assert.Equal(t, []string{"customer_email", "price", "seats", "ticket_id"}, sample.Data["payload_keys"])
+			assert.NotContains(t, sample.Data, "payload")
+
+			if level < logrus.DebugLevel {
+				assert.Len(t, hook.AllEntries(), 1)
+				return
+			}
+
+			require.Len(t, hook.AllEntries(), 2)
+			assert.JSONEq(t,
+				`{"ticket_id":"***","customer_email":"***","price":{"amount":"***","currency":"***"},"seats":2}`,
+				hook.AllEntries()[1].Data["payload"].(string),
+			)
+		})
+	}
+}
+
+func TestParseUnknownTypePolicy(t *testing.T) {
+	policy, err := app.ParseUnknownTypePolicy("")
+	require.NoError(t, err)
+	assert.Equal(t, app.UnknownTypeQuarantine, policy)
+
+	policy, err = app.ParseUnknownTypePolicy("drop")
+	require.NoError(t, err)
+	assert.Equal(t, app.UnknownTypeDrop, policy)
+
+	_, err = app.ParseUnknownTypePolicy("ignore")
+	assert.Error(t, err)
+
+	_, err = app.NewUnknownTypeFilter(app.NewUnknownTypeFilterInput{Policy: app.UnknownTypeQuarantine})
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+var ErrPrivateAddress = errors.New("webhook endpoints can't be on private networks")
+
+// isPrivateHost tells if the host of a subscription URL is local, hostnames are checked again when dialed.
+func isPrivateHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && isPrivateIP(ip)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified()
+}
+
+// newHTTPClient returns the client sending deliveries. Unless private networks are allowed, it refuses
+// to connect to private addresses, so hostnames resolving to them and redirects can't reach internal services.
+func newHTTPClient(allowPrivateNetworks bool) *http.Client {
+	dialer := &net.Dialer{Timeout: defaultRequestTimeout}
+	if !allowPrivateNetworks {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+			}
+
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// the dialed address would be the one of the proxy, not of the endpoint
+	transport.Proxy = nil
+
+	return &http.Client{
+		Timeout:   defaultRequestTimeout,
+		Transport: transport,
+	}
+}
@@ -0,0 +1,66 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SignatureHeader = "Webhook-Signature"
+
+// DefaultTolerance is how far the timestamp of a signature may be from the clock of the receiver.
+const DefaultTolerance = 5 * time.Minute
+
+// Sign returns the Webhook-Signature header value: "t=<unix timestamp>,v1=<hex HMAC-SHA256>",
+// where the HMAC is computed with the subscription secret over "<unix timestamp>.<body>".
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+
+	return fmt.Sprintf("t=%s,v1=%s", unix, signature(secret, unix, body))
+}
+
+// Verify checks a Webhook-Signature header value, it's what receivers are expected to do.
+// Signatures with a timestamp further than tolerance from now are rejected, so a captured request can't be replayed later.
+func Verify(secret string, header string, body []byte, tolerance time.Duration) bool {
+	var unix, sig string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "t":
+			unix = value
+		case "v1":
+			sig = value
+		}
+	}
+	if unix == "" || sig == "" {
+		return false
+	}
+
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(signature(secret, unix, body)))
+}
+
+func signature(secret string, unix string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,45 @@
+package webhooks_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tickets/app/webhooks"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"1","event":"TicketPrinted"}`)
+	timestamp := time.Now()
+
+	signature := webhooks.Sign("secret", timestamp, body)
+	assert.Regexp(t, `^t=[0-9]+,v1=[0-9a-f]{64}$`, signature)
+	assert.Equal(t, webhooks.Sign("secret", timestamp, body), signature)
+
+	assert.True(t, webhooks.Verify("secret", signature, body, webhooks.DefaultTolerance))
+	assert.False(t, webhooks.Verify("other-secret", signature, body, webhooks.DefaultTolerance))
+	assert.False(t, webhooks.Verify("secret", signature, []byte(`{}`), webhooks.DefaultTolerance))
+	assert.False(t, webhooks.Verify("secret", "v1=abc", body, webhooks.DefaultTolerance))
+}
+
+func TestVerifyRejectsTimestampsOutsideTolerance(t *testing.T) {
+	body := []byte(`{"id":"1","event":"TicketPrinted"}`)
+
+	old := webhooks.Sign("secret", time.Now().Add(-6*time.Minute), body)
+	assert.False(t, webhooks.Verify("secret", old, body, webhooks.DefaultTolerance), "replayed request accepted")
+	assert.True(t, webhooks.Verify("secret", old, body, 10*time.Minute))
+
+	future := webhooks.Sign("secret", time.Now().Add(6*time.Minute), body)
+	assert.False(t, webhooks.Verify("secret", future, body, webhooks.DefaultTolerance))
+
+	recent := webhooks.Sign("secret", time.Now().Add(-4*time.Minute), body)
+	assert.True(t, webhooks.Verify("secret", recent, body, webhooks.DefaultTolerance))
+
+	// the timestamp is signed, so it can't be moved into the window
+	_, oldSignature, _ := strings.Cut(old, ",")
+	forged := "t=" + strconv.FormatInt(time.Now().Unix(), 10) + "," + oldSignature
+	assert.False(t, webhooks.Verify("secret", forged, body, webhooks.DefaultTolerance))
+}
@@ -0,0 +1,402 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"tickets/app/circuitbreaker"
+	"tickets/app/repositories"
+
+	"github.com/ThreeDotsLabs/go-event-driven/common/log"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPollInterval   = time.Second
+	defaultBatchSize      = 50
+	defaultMaxAttempts    = 10
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = time.Hour
+	defaultRequestTimeout = time.Second * 10
+)
+
+var ErrInvalidSubscription = errors.New("invalid webhook subscription")
+
+type Subscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Delivery struct {
+	ID             string          `json:"id"`
+	EventID        string          `json:"event_id"`
+	EventName      string          `json:"event_name"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code,omitempty"`
+	LastError      *string         `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+type SubscribeInput struct {
+	URL string
+	// Events are the names of the events sent to the URL.
+	Events []string
+	// Secret signs the deliveries, see Sign.
+	Secret string
+}
+
+type NotifyInput struct {
+	EventName  string
+	EventID    string
+	OccurredAt time.Time
+	Data       any
+}
+
+// envelope is the body of every delivery.
+type envelope struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       any       `json:"data"`
+}
+
+type NewServiceInput struct {
+	Repo repositories.WebhooksRepository
+	// SupportedEvents are the event names which can be subscribed to.
+	SupportedEvents []string
+	// HTTPClient defaults to a client which can't connect to private networks, unless AllowPrivateNetworks is set.
+	HTTPClient *http.Client
+	// AllowPrivateNetworks lets subscriptions point to loopback and private addresses, for tests and local setups.
+	AllowPrivateNetworks bool
+	CircuitBreaker       circuitbreaker.Config
+	PollInterval         time.Duration
+	BatchSize            int
+	MaxAttempts          int
+	InitialBackoff       time.Duration
+	MaxBackoff           time.Duration
+}
+
+// Service manages webhook subscriptions and sends the deliveries.
+// Deliveries are stored before being sent, failed ones are retried with exponential backoff until MaxAttempts,
+// and every endpoint has its own circuit breaker, so a dead endpoint doesn't slow down the others.
+type Service struct {
+	repo            repositories.WebhooksRepository
+	supportedEvents map[string]struct{}
+	allowPrivate    bool
+	httpClient      *http.Client
+	breakerConfig   circuitbreaker.Config
+	pollInterval    time.Duration
+	batchSize       int
+	maxAttempts     int
+	initialBackoff  time.Duration
+	maxBackoff      time.Duration
+	// claimLease is how long claimed deliveries are skipped by other replicas, it covers sending a whole batch.
+	claimLease time.Duration
+
+	breakersLock sync.Mutex
+	breakers     map[string]*circuitbreaker.Breaker
+}
+
+func NewService(input NewServiceInput) *Service {
+	if input.HTTPClient == nil {
+		input.HTTPClient = newHTTPClient(input.AllowPrivateNetworks)
+	}
+	if input.PollInterval == 0 {
+		input.PollInterval = defaultPollInterval
+	}
+	if input.BatchSize == 0 {
+		input.BatchSize = defaultBatchSize
+	}
+	if input.MaxAttempts == 0 {
+		input.MaxAttempts = defaultMaxAttempts
+	}
+	if input.InitialBackoff == 0 {
+		input.InitialBackoff = defaultInitialBackoff
+	}
+	if input.MaxBackoff == 0 {
+		input.MaxBackoff = defaultMaxBackoff
+	}
+
+	supportedEvents := make(map[string]struct{}, len(input.SupportedEvents))
+	for _, name := range input.SupportedEvents {
+		supportedEvents[name] = struct{}{}
+	}
+
+	return &Service{
+		repo:            input.Repo,
+		supportedEvents: supportedEvents,
+		allowPrivate:    input.AllowPrivateNetworks,
+		httpClient:      input.HTTPClient,
+		breakerConfig:   input.CircuitBreaker,
+		pollInterval:    input.PollInterval,
+		batchSize:       input.BatchSize,
+		maxAttempts:     input.MaxAttempts,
+		initialBackoff:  input.InitialBackoff,
+		maxBackoff:      input.MaxBackoff,
+		claimLease:      claimLease(input.HTTPClient, input.BatchSize),
+		breakers:        make(map[string]*circuitbreaker.Breaker),
+	}
+}
+
+func (s *Service) Subscribe(ctx context.Context, input SubscribeInput) (Subscription, error) {
+	endpoint, err := url.Parse(input.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return Subscription{}, fmt.Errorf("%w: url must be an absolute http(s) URL", ErrInvalidSubscription)
+	}
+	if !s.allowPrivate && isPrivateHost(endpoint.Hostname()) {
+		return Subscription{}, fmt.Errorf("%w: %s", ErrInvalidSubscription, ErrPrivateAddress)
+	}
+	if input.Secret == "" {
+		return Subscription{}, fmt.Errorf("%w: secret is required", ErrInvalidSubscription)
+	}
+	if len(input.Events) == 0 {
+		return Subscription{}, fmt.Errorf("%w: at least one event is required", ErrInvalidSubscription)
+	}
+	for _, name := range input.Events {
+		if _, ok := s.supportedEvents[name]; !ok {
+			return Subscription{}, fmt.Errorf("%w: unknown event %s", ErrInvalidSubscription, name)
+		}
+	}
+
+	subscription := repositories.WebhookSubscription{
+		ID:        uuid.NewString(),
+		URL:       input.URL,
+		Events:    input.Events,
+		Secret:    input.Secret,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	err = s.repo.AddSubscription(ctx, subscription)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	return Subscription{
+		ID:        subscription.ID,
+		URL:       subscription.URL,
+		Events:    subscription.Events,
+		CreatedAt: subscription.CreatedAt,
+	}, nil
+}
+
+// Deliveries returns the latest deliveries of the subscription, newest first.
+func (s *Service) Deliveries(ctx context.Context, subscriptionID string, limit int) ([]Delivery, error) {
+	_, err := s.repo.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries, err := s.repo.Deliveries(ctx, subscriptionID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Delivery, 0, len(deliveries))
+	for _, d := range deliveries {
+		result = append(result, Delivery{
+			ID:             d.ID,
+			EventID:        d.EventID,
+			EventName:      d.EventName,
+			Payload:        d.Payload,
+			Status:         string(d.Status),
+			Attempts:       d.Attempts,
+			NextAttemptAt:  d.NextAttemptAt,
+			LastStatusCode: d.LastStatusCode,
+			LastError:      d.LastError,
+			CreatedAt:      d.CreatedAt,
+			DeliveredAt:    d.DeliveredAt,
+		})
+	}
+
+	return result, nil
+}
+
+// Notify enqueues a delivery of the event for every subscription interested in it.
+// It's idempotent per event ID, so redelivered events are not sent twice.
+func (s *Service) Notify(ctx context.Context, input NotifyInput) error {
+	payload, err := json.Marshal(envelope{
+		ID:         input.EventID,
+		Event:      input.EventName,
+		OccurredAt: input.OccurredAt,
+		Data:       input.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.repo.EnqueueDelivery(ctx, repositories.WebhookDelivery{
+		EventID:   input.EventID,
+		EventName: input.EventName,
+		Payload:   payload,
+	})
+}
+
+// Run sends due deliveries until ctx is done.
+func (s *Service) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for {
+			claimed, err := s.deliverDue(ctx)
+			if err != nil {
+				log.FromContext(ctx).WithError(err).Error("Could not send webhook deliveries")
+				break
+			}
+			if claimed < s.batchSize {
+				break
+			}
+		}
+	}
+}
+
+// deliverDue sends a batch of due deliveries. They are sent outside of any transaction,
+// the claim keeps other replicas from sending them at the same time.
+func (s *Service) deliverDue(ctx context.Context) (int, error) {
+	due, err := s.repo.ClaimDue(ctx, time.Now(), s.batchSize, s.claimLease)
+	if err != nil {
+		return 0, err
+	}
+
+	attempts := make([]repositories.WebhookDeliveryAttempt, 0, len(due))
+	for _, delivery := range due {
+		attempt := s.deliver(ctx, delivery)
+		attempt.DeliveryID = delivery.ID
+		attempts = append(attempts, attempt)
+	}
+
+	err = s.repo.RecordAttempts(ctx, attempts)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(due), nil
+}
+
+func (s *Service) deliver(ctx context.Context, delivery repositories.DueWebhookDelivery) repositories.WebhookDeliveryAttempt {
+	breaker := s.breaker(delivery.SubscriptionID)
+
+	err := breaker.Allow()
+	if err != nil {
+		reason := err.Error()
+
+		return repositories.WebhookDeliveryAttempt{
+			Status:        repositories.WebhookDeliveryStatusPending,
+			Error:         &reason,
+			NextAttemptAt: breaker.RetryAt(),
+			Skipped:       true,
+		}
+	}
+
+	statusCode, err := s.send(ctx, delivery)
+	if err == nil {
+		breaker.Success()
+
+		return repositories.WebhookDeliveryAttempt{
+			Status:        repositories.WebhookDeliveryStatusDelivered,
+			StatusCode:    statusCode,
+			NextAttemptAt: time.Now(),
+		}
+	}
+	breaker.Failure()
+
+	reason := err.Error()
+	attempt := repositories.WebhookDeliveryAttempt{
+		Status:        repositories.WebhookDeliveryStatusPending,
+		StatusCode:    statusCode,
+		Error:         &reason,
+		NextAttemptAt: time.Now().Add(s.backoff(delivery.Attempts)),
+	}
+	if delivery.Attempts+1 >= s.maxAttempts {
+		attempt.Status = repositories.WebhookDeliveryStatusFailed
+	}
+
+	log.FromContext(ctx).
+		WithError(err).
+		WithField("delivery_id", delivery.ID).
+		WithField("attempts", delivery.Attempts+1).
+		Warn("Webhook delivery failed")
+
+	return attempt
+}
+
+func (s *Service) send(ctx context.Context, delivery repositories.DueWebhookDelivery) (*int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-ID", delivery.ID)
+	req.Header.Set("Webhook-Event", delivery.EventName)
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, time.Now(), delivery.Payload))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	statusCode := resp.StatusCode
+	if statusCode < 200 || statusCode > 299 {
+		return &statusCode, fmt.Errorf("unexpected status code %d", statusCode)
+	}
+
+	return &statusCode, nil
+}
+
+// backoff is the delay after the given number of previous attempts: InitialBackoff doubled per attempt, up to MaxBackoff.
+func (s *Service) backoff(previousAttempts int) time.Duration {
+	delay := s.initialBackoff
+	for i := 0; i < previousAttempts; i++ {
+		delay *= 2
+		if delay >= s.maxBackoff {
+			return s.maxBackoff
+		}
+	}
+
+	return delay
+}
+
+func claimLease(client *http.Client, batchSize int) time.Duration {
+	timeout := client.Timeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+
+	return timeout*time.Duration(batchSize) + time.Minute
+}
+
+func (s *Service) breaker(subscriptionID string) *circuitbreaker.Breaker {
+	s.breakersLock.Lock()
+	defer s.breakersLock.Unlock()
+
+	breaker, ok := s.breakers[subscriptionID]
+	if !ok {
+		breaker = circuitbreaker.New(s.breakerConfig)
+		s.breakers[subscriptionID] = breaker
+	}
+
+	return breaker
+}
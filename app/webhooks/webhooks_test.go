@@ -0,0 +1,281 @@
+package webhooks_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"tickets/app/circuitbreaker"
+	"tickets/app/repositories"
+	"tickets/app/webhooks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Notify(t *testing.T) {
+	service := newTestService(t)
+	ctx := context.Background()
+
+	confirmed := subscribe(t, service, "https://confirmed.example.com/hook", "TicketBookingConfirmed")
+	printed := subscribe(t, service, "https://printed.example.com/hook", "TicketPrinted")
+
+	occurredAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	notify := func() {
+		err := service.Notify(ctx, webhooks.NotifyInput{
+			EventName:  "TicketBookingConfirmed",
+			EventID:    "event-1",
+			OccurredAt: occurredAt,
+			Data:       map[string]string{"ticket_id": "ticket-1"},
+		})
+		require.NoError(t, err)
+	}
+	notify()
+	// redelivered events are not sent twice
+	notify()
+
+	deliveries, err := service.Deliveries(ctx, confirmed.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "event-1", deliveries[0].EventID)
+	assert.Equal(t, string(repositories.WebhookDeliveryStatusPending), deliveries[0].Status)
+	assert.JSONEq(t, `{
+		"id": "event-1",
+		"event": "TicketBookingConfirmed",
+		"occurred_at": "2024-01-02T03:04:05Z",
+		"data": {"ticket_id": "ticket-1"}
+	}`, string(deliveries[0].Payload))
+
+	deliveries, err = service.Deliveries(ctx, printed.ID, 10)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries, "subscriptions get only the events they subscribed to")
+}
+
+func TestService_Subscribe_rejects_private_networks(t *testing.T) {
+	service := webhooks.NewService(webhooks.NewServiceInput{
+		Repo:            repositories.NewMemoryWebhooksRepository(),
+		SupportedEvents: []string{"TicketBookingConfirmed"},
+	})
+
+	for _, url := range []string{
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://10.0.0.1/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+	} {
+		_, err := service.Subscribe(context.Background(), webhooks.SubscribeInput{
+			URL:    url,
+			Events: []string{"TicketBookingConfirmed"},
+			Secret: "secret",
+		})
+		assert.ErrorIs(t, err, webhooks.ErrInvalidSubscription, url)
+	}
+}
+
+func TestService_Run_delivers(t *testing.T) {
+	endpoint := newTestEndpoint(t, http.StatusOK)
+	service := newTestService(t)
+
+	subscription := subscribe(t, service, endpoint.URL(), "TicketBookingConfirmed")
+	notifyConfirmed(t, service)
+
+	runService(t, service)
+
+	delivery := waitForStatus(t, service, subscription.ID, repositories.WebhookDeliveryStatusDelivered)
+	assert.Equal(t, 1, delivery.Attempts)
+	require.NotNil(t, delivery.LastStatusCode)
+	assert.Equal(t, http.StatusOK, *delivery.LastStatusCode)
+	assert.NotNil(t, delivery.DeliveredAt)
+
+	requests := endpoint.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, delivery.ID, requests[0].Header.Get("Webhook-ID"))
+	assert.Equal(t, "TicketBookingConfirmed", requests[0].Header.Get("Webhook-Event"))
+	assert.True(t, webhooks.Verify("secret", requests[0].Header.Get(webhooks.SignatureHeader), requests[0].Body, webhooks.DefaultTolerance))
+	assert.JSONEq(t, string(delivery.Payload), string(requests[0].Body))
+}
+
+func TestService_Run_retries_with_backoff(t *testing.T) {
+	endpoint := newTestEndpoint(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+	service := newTestService(t)
+
+	subscription := subscribe(t, service, endpoint.URL(), "TicketBookingConfirmed")
+	notifyConfirmed(t, service)
+
+	runService(t, service)
+
+	delivery := waitForStatus(t, service, subscription.ID, repositories.WebhookDeliveryStatusDelivered)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Nil(t, delivery.LastError)
+
+	requests := endpoint.Requests()
+	require.Len(t, requests, 3)
+	// InitialBackoff doubled after every failed attempt
+	assert.GreaterOrEqual(t, requests[1].At.Sub(requests[0].At), testInitialBackoff)
+	assert.GreaterOrEqual(t, requests[2].At.Sub(requests[1].At), 2*testInitialBackoff)
+}
+
+func TestService_Run_gives_up_after_max_attempts(t *testing.T) {
+	endpoint := newTestEndpoint(t, http.StatusInternalServerError)
+	service := newTestService(t)
+
+	subscription := subscribe(t, service, endpoint.URL(), "TicketBookingConfirmed")
+	notifyConfirmed(t, service)
+
+	runService(t, service)
+
+	delivery := waitForStatus(t, service, subscription.ID, repositories.WebhookDeliveryStatusFailed)
+	assert.Equal(t, testMaxAttempts, delivery.Attempts)
+	require.NotNil(t, delivery.LastStatusCode)
+	assert.Equal(t, http.StatusInternalServerError, *delivery.LastStatusCode)
+	require.NotNil(t, delivery.LastError)
+	assert.Contains(t, *delivery.LastError, "500")
+
+	requests := endpoint.Requests()
+	require.Len(t, requests, testMaxAttempts)
+	// MaxBackoff caps the doubling
+	assert.GreaterOrEqual(t, requests[3].At.Sub(requests[2].At), testMaxBackoff)
+
+	// failed deliveries are not sent anymore
+	time.Sleep(testMaxBackoff * 3)
+	assert.Len(t, endpoint.Requests(), testMaxAttempts)
+}
+
+const (
+	testInitialBackoff = 20 * time.Millisecond
+	testMaxBackoff     = 40 * time.Millisecond
+	testMaxAttempts    = 4
+)
+
+func newTestService(t *testing.T) *webhooks.Service {
+	t.Helper()
+
+	return webhooks.NewService(webhooks.NewServiceInput{
+		Repo:                 repositories.NewMemoryWebhooksRepository(),
+		SupportedEvents:      []string{"TicketBookingConfirmed", "TicketPrinted"},
+		AllowPrivateNetworks: true,
+		// the breaker would skip the attempts this test counts
+		CircuitBreaker: circuitbreaker.Config{FailureThreshold: 100},
+		PollInterval:   5 * time.Millisecond,
+		MaxAttempts:    testMaxAttempts,
+		InitialBackoff: testInitialBackoff,
+		MaxBackoff:     testMaxBackoff,
+	})
+}
+
+func subscribe(t *testing.T, service *webhooks.Service, url string, events ...string) webhooks.Subscription {
+	t.Helper()
+
+	subscription, err := service.Subscribe(context.Background(), webhooks.SubscribeInput{
+		URL:    url,
+		Events: events,
+		Secret: "secret",
+	})
+	require.NoError(t, err)
+
+	return subscription
+}
+
+func notifyConfirmed(t *testing.T, service *webhooks.Service) {
+	t.Helper()
+
+	err := service.Notify(context.Background(), webhooks.NotifyInput{
+		EventName:  "TicketBookingConfirmed",
+		EventID:    "event-1",
+		OccurredAt: time.Now().UTC(),
+		Data:       map[string]string{"ticket_id": "ticket-1"},
+	})
+	require.NoError(t, err)
+}
+
+func runService(t *testing.T, service *webhooks.Service) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = service.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitForStatus(
+	t *testing.T,
+	service *webhooks.Service,
+	subscriptionID string,
+	status repositories.WebhookDeliveryStatus,
+) webhooks.Delivery {
+	t.Helper()
+
+	var delivery webhooks.Delivery
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		deliveries, err := service.Deliveries(context.Background(), subscriptionID, 10)
+		if !assert.NoError(collectT, err) || !assert.Len(collectT, deliveries, 1) {
+			return
+		}
+		delivery = deliveries[0]
+		assert.Equal(collectT, string(status), delivery.Status)
+	}, 5*time.Second, 5*time.Millisecond)
+
+	return delivery
+}
+
+type receivedRequest struct {
+	At     time.Time
+	Header http.Header
+	Body   []byte
+}
+
+// testEndpoint answers with the given status codes in order, repeating the last one.
+type testEndpoint struct {
+	server *httptest.Server
+
+	lock        sync.Mutex
+	statusCodes []int
+	requests    []receivedRequest
+}
+
+func newTestEndpoint(t *testing.T, statusCodes ...int) *testEndpoint {
+	t.Helper()
+
+	endpoint := &testEndpoint{statusCodes: statusCodes}
+	endpoint.server = httptest.NewServer(http.HandlerFunc(endpoint.handle))
+	t.Cleanup(endpoint.server.Close)
+
+	return endpoint
+}
+
+func (e *testEndpoint) URL() string {
+	return e.server.URL + "/hook"
+}
+
+func (e *testEndpoint) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	e.lock.Lock()
+	statusCode := e.statusCodes[0]
+	if len(e.statusCodes) > 1 {
+		e.statusCodes = e.statusCodes[1:]
+	}
+	e.requests = append(e.requests, receivedRequest{At: time.Now(), Header: r.Header.Clone(), Body: body})
+	e.lock.Unlock()
+
+	w.WriteHeader(statusCode)
+}
+
+func (e *testEndpoint) Requests() []receivedRequest {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]receivedRequest(nil), e.requests...)
+}
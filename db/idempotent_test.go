@@ -12,6 +12,7 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 
+	"tickets/app/money"
 	"tickets/app/repositories"
 )
 
@@ -26,8 +27,8 @@ func TestIdempotent(t *testing.T) {
 	repo := repositories.NewTicketsRepository(db)
 
 	ticket := repositories.Ticket{
-		TicketID:      watermill.NewUUID(),
-		PriceCurrency: "USD",
+		TicketID: watermill.NewUUID(),
+		Price:    money.MustParse("0", "USD"),
 	}
 
 	err = repo.Put(context.Background(), ticket)
@@ -36,7 +37,7 @@ func TestIdempotent(t *testing.T) {
 	err = repo.Put(context.Background(), ticket)
 	assert.NoError(t, err)
 
-	tickets, err := repo.GetAll(context.Background())
+	tickets, err := repo.GetAll(context.Background(), repositories.TicketsFilter{})
 	assert.NoError(t, err)
 
 	assert.Len(t, tickets, 1)
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+	"tickets/app"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateAltersPriceAmountsOnce(t *testing.T) {
+	db := getDb()
+
+	err := app.Migrate(db)
+	require.NoError(t, err)
+
+	for _, table := range []string{"tickets", "ticket_sagas"} {
+		var column struct {
+			DataType         string `db:"data_type"`
+			NumericPrecision *int   `db:"numeric_precision"`
+		}
+		err = db.Get(&column, `
+SELECT data_type, numeric_precision FROM information_schema.columns
+WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'price_amount'
+`, table)
+		require.NoError(t, err)
+		assert.Equal(t, "numeric", column.DataType, table)
+		assert.Nil(t, column.NumericPrecision, table)
+	}
+
+	// altering the type of a column rewrites the table into a new file
+	tableFiles := func() map[string]int64 {
+		var rows []struct {
+			Name     string `db:"relname"`
+			FileNode int64  `db:"relfilenode"`
+		}
+		err := db.Select(&rows, `SELECT relname, relfilenode::BIGINT AS relfilenode FROM pg_class WHERE relname IN ('tickets', 'ticket_sagas')`)
+		require.NoError(t, err)
+
+		files := map[string]int64{}
+		for _, row := range rows {
+			files[row.Name] = row.FileNode
+		}
+
+		return files
+	}
+
+	before := tableFiles()
+	err = app.Migrate(db)
+	require.NoError(t, err)
+	assert.Equal(t, before, tableFiles(), "tables rewritten by a migration which already ran")
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"tickets/app"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tickets/app/money"
+	"tickets/app/repositories"
+)
+
+func TestProcessedMessagesRunOnce(t *testing.T) {
+	db := getDb()
+
+	err := app.Migrate(db)
+	require.NoError(t, err)
+	repo := repositories.NewProcessedMessagesRepository(db)
+	ticketsRepo := repositories.NewTicketsRepository(db)
+
+	eventID := watermill.NewUUID()
+	ticketID := watermill.NewUUID()
+	calls := 0
+
+	err = repo.RunOnce(context.Background(), "test-handler", eventID, func(ctx context.Context) error {
+		calls++
+
+		err := ticketsRepo.Put(ctx, repositories.Ticket{TicketID: ticketID, Price: money.MustParse("0", "USD")})
+		require.NoError(t, err)
+
+		return errors.New("handler failed")
+	})
+	assert.Error(t, err)
+
+	_, err = ticketsRepo.Get(context.Background(), ticketID)
+	assert.ErrorIs(t, err, repositories.ErrTicketNotFound, "writes of a failed handler should be rolled back")
+
+	for i := 0; i < 2; i++ {
+		err = repo.RunOnce(context.Background(), "test-handler", eventID, func(ctx context.Context) error {
+			calls++
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"tickets/app"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tickets/app/repositories"
+)
+
+func TestScheduledMessagesAreDeliveredOnce(t *testing.T) {
+	db := getDb()
+
+	err := app.Migrate(db)
+	require.NoError(t, err)
+	repo := repositories.NewScheduledMessagesRepository(db)
+
+	messageUUID := watermill.NewUUID()
+	err = repo.Add(context.Background(), repositories.ScheduledMessage{
+		MessageUUID: messageUUID,
+		Topic:       "test-topic",
+		Payload:     []byte(`{}`),
+		Metadata:    []byte(`{}`),
+		DeliverAt:   time.Now().Add(-time.Second),
+	})
+	require.NoError(t, err)
+
+	var deliveries int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := repo.DeliverDue(context.Background(), time.Now(), 100, func(msg repositories.ScheduledMessage) error {
+				if msg.MessageUUID == messageUUID {
+					atomic.AddInt64(&deliveries, 1)
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), deliveries)
+}
@@ -0,0 +1,206 @@
+package tests_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tickets/app"
+	"tickets/app/metrics"
+	"tickets/app/receipts"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoisonAdminRoutesNeedAdminToken(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	id := uuid.NewString()
+
+	for _, route := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/admin/poison"},
+		{http.MethodPost, "/admin/poison/" + id + "/requeue"},
+		{http.MethodDelete, "/admin/poison/" + id},
+	} {
+		assert.Equal(t, http.StatusUnauthorized, sendAdminRequest(t, route.method, route.path, "", nil), route.path)
+		assert.Equal(t, http.StatusUnauthorized, sendAdminRequest(t, route.method, route.path, "wrong", nil), route.path)
+	}
+
+	assert.Equal(t, http.StatusOK, sendAdminRequest(t, http.MethodGet, "/admin/poison", adminToken, nil))
+	assert.Equal(t, http.StatusNotFound, sendAdminRequest(t, http.MethodDelete, "/admin/poison/"+id, adminToken, nil))
+}
+
+func sendAdminRequest(t *testing.T, method string, path string, token string, body any) int {
+	t.Helper()
+
+	payload := []byte("{}")
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+
+	req, err := http.NewRequest(method, "http://localhost:8080"+path, bytes.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestRefundTicket(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	ticketID := uuid.NewString()
+	publishConfirmed(t, a.Dependencies.EventBus, ticketID, time.Now().UTC())
+	assertTicketStored(t, ticketID, true)
+
+	path := "/admin/tickets/" + ticketID + "/refund"
+	assert.Equal(t, http.StatusUnauthorized, sendAdminRequest(t, http.MethodPost, path, "", nil))
+
+	status := sendAdminRequest(t, http.MethodPost, path, adminToken, map[string]string{"reason": "customer asked"})
+	require.Equal(t, http.StatusAccepted, status)
+
+	receiptsService, ok := a.Dependencies.ReceiptsClient.(*receipts.ServiceMock)
+	require.True(t, ok)
+	spreadsheets, ok := a.Dependencies.SpreadsheetsClient.(*app.SpreadsheetsClientMock)
+	require.True(t, ok)
+
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		assert.Equal(collectT, 1, countRefundRows(spreadsheets, ticketID))
+	}, 10*time.Second, 100*time.Millisecond)
+
+	var voided []receipts.VoidReceiptRequest
+	for _, receipt := range receiptsService.VoidedReceipts {
+		if receipt.TicketID == ticketID {
+			voided = append(voided, receipt)
+		}
+	}
+	require.Len(t, voided, 1)
+	assert.Equal(t, "customer asked", voided[0].Reason)
+
+	// a redelivered command is not refunded twice
+	redelivered := app.RefundTicket{
+		Header:   app.NewEventHeader(uuid.NewString(), uuid.NewString()),
+		TicketID: ticketID,
+		Reason:   "redelivered",
+	}
+	require.NoError(t, a.Dependencies.CommandBus.Send(context.Background(), redelivered))
+	require.NoError(t, a.Dependencies.CommandBus.Send(context.Background(), redelivered))
+
+	// commands are handled in order, so the redelivered ones are handled once this one is
+	require.NoError(t, a.Dependencies.CommandBus.Send(context.Background(), app.RefundTicket{
+		Header:   app.NewEventHeader(uuid.NewString(), uuid.NewString()),
+		TicketID: ticketID,
+		Reason:   "sentinel",
+	}))
+
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		assert.GreaterOrEqual(collectT, countRefundRows(spreadsheets, ticketID), 3)
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, 3, countRefundRows(spreadsheets, ticketID))
+}
+
+func TestRefundUnknownTicket(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	assert.Equal(t, http.StatusNotFound, sendAdminRequest(t, http.MethodPost, "/admin/tickets/"+uuid.NewString()+"/refund", adminToken, nil))
+	assert.Equal(t, http.StatusNotFound, sendAdminRequest(t, http.MethodPost, "/admin/tickets/not-a-ticket/refund", adminToken, nil))
+
+	retries := metrics.HandlerRetries.WithLabelValues("refund-ticket")
+	retriesBefore := testutil.ToFloat64(retries)
+
+	// sent past the endpoint, the handler acks it instead of retrying it into the poison queue
+	require.NoError(t, a.Dependencies.CommandBus.Send(context.Background(), app.RefundTicket{
+		Header:   app.NewEventHeader(uuid.NewString(), uuid.NewString()),
+		TicketID: uuid.NewString(),
+	}))
+
+	ticketID := uuid.NewString()
+	publishConfirmed(t, a.Dependencies.EventBus, ticketID, time.Now().UTC())
+	assertTicketStored(t, ticketID, true)
+	require.Equal(t, http.StatusAccepted, sendAdminRequest(t, http.MethodPost, "/admin/tickets/"+ticketID+"/refund", adminToken, nil))
+
+	spreadsheets, ok := a.Dependencies.SpreadsheetsClient.(*app.SpreadsheetsClientMock)
+	require.True(t, ok)
+
+	// the first retry would hold the commands behind the unknown ticket longer than this
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		assert.Equal(collectT, 1, countRefundRows(spreadsheets, ticketID))
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, retriesBefore, testutil.ToFloat64(retries))
+}
+
+func TestReprintTicket(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	ticketID := uuid.NewString()
+	publishConfirmed(t, a.Dependencies.EventBus, ticketID, time.Now().UTC())
+	assertTicketStored(t, ticketID, true)
+
+	filesClient, ok := a.Dependencies.FilesClient.(*app.FilesClientMock)
+	require.True(t, ok)
+
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		assert.Contains(collectT, ticketFiles(t, filesClient, ticketID), ticketID+"-ticket.html")
+	}, 10*time.Second, 100*time.Millisecond)
+
+	path := "/admin/tickets/" + ticketID + "/print"
+	assert.Equal(t, http.StatusUnauthorized, sendAdminRequest(t, http.MethodPost, path, "", nil))
+	assert.Equal(t, http.StatusNotFound, sendAdminRequest(t, http.MethodPost, "/admin/tickets/"+uuid.NewString()+"/print", adminToken, nil))
+
+	require.Equal(t, http.StatusAccepted, sendAdminRequest(t, http.MethodPost, path, adminToken, nil))
+	require.Equal(t, http.StatusAccepted, sendAdminRequest(t, http.MethodPost, path, adminToken, nil))
+
+	// files are not overwritten, so every reprint creates a file of its own
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		assert.Len(collectT, ticketFiles(t, filesClient, ticketID), 3)
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func countRefundRows(spreadsheets *app.SpreadsheetsClientMock, ticketID string) int {
+	rows := 0
+	for _, row := range spreadsheets.Sheets["tickets-to-refund"] {
+		if row[0] == ticketID {
+			rows++
+		}
+	}
+
+	return rows
+}
+
+func ticketFiles(t *testing.T, filesClient *app.FilesClientMock, ticketID string) []string {
+	t.Helper()
+
+	resp, err := filesClient.GetFilesWithResponse(context.Background())
+	require.NoError(t, err)
+
+	var fileIDs []string
+	for _, fileID := range resp.JSON200.Files {
+		if strings.HasPrefix(fileID, ticketID) {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+
+	return fileIDs
+}
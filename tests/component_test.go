@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"os"
 	"testing"
 	"tickets/app"
+	"tickets/app/money"
+	"tickets/app/receipts"
 	"time"
 
 	"github.com/lithammer/shortuuid/v3"
@@ -71,9 +74,76 @@ func TestErrorTicketsReceipt(t *testing.T) {
 	assertTrackTicketCanceled(t, cli, ticket)
 }
 
+func TestMetricsExposed(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	ticket := TicketStatus{
+		TicketID: shortuuid.New(),
+		Status:   app.TicketStatusCanceled.String(),
+		Price: Money{
+			Amount:   "5",
+			Currency: "USD",
+		},
+	}
+	sendTicketsStatus(t, TicketsStatusRequest{
+		Tickets: []TicketStatus{ticket},
+	})
+
+	cli, ok := a.Dependencies.SpreadsheetsClient.(*app.SpreadsheetsClientMock)
+	require.True(t, ok)
+	assertTrackTicketCanceled(t, cli, ticket)
+
+	assertMetricsExposed(t,
+		`tickets_http_request_duration_seconds_count{method="POST",route="/tickets-status",status="200"}`,
+		`tickets_router_handler_execution_time_seconds_count{handler_name="append-canceled",success="true"}`,
+	)
+}
+
+func TestTicketWithoutCurrencyGetsDefaultCurrency(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	ticket := TicketStatus{
+		TicketID: shortuuid.New(),
+		Status:   app.TicketStatusConfirmed.String(),
+		Price: Money{
+			Amount:   "5",
+			Currency: "",
+		},
+	}
+	sendTicketsStatus(t, TicketsStatusRequest{
+		Tickets: []TicketStatus{ticket},
+	})
+
+	cli, ok := a.Dependencies.ReceiptsClient.(*receipts.ServiceMock)
+	require.True(t, ok)
+
+	ticket.Price.Currency = app.DefaultCurrency
+	assertReceiptForTicketIssued(t, cli, ticket)
+}
+
+func assertMetricsExposed(t *testing.T, series ...string) {
+	t.Helper()
+
+	resp, err := http.Get("http://localhost:8080/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, s := range series {
+		assert.Contains(t, string(body), s)
+	}
+}
+
+const adminToken = "test-admin-token"
+
 func waitForHttpServer(t *testing.T) *app.App {
 	t.Helper()
 	_ = os.Setenv("GATEWAY_ADDR", "http://localhost:8000")
+	_ = os.Setenv("ADMIN_TOKEN", adminToken)
 
 	a := app.NewApp(context.Background())
 
@@ -139,11 +209,12 @@ func assertTrackTicketCanceled(t *testing.T, spreadsheets *app.SpreadsheetsClien
 	assert.Len(t, column, 4)
 
 	assert.Equal(t, ticket.TicketID, column[0])
-	assert.Equal(t, ticket.Price.Amount, column[2])
+	// amounts are written with the decimals of their currency
+	assert.Equal(t, money.MustParse(ticket.Price.Amount, ticket.Price.Currency).Amount(), column[2])
 	assert.Equal(t, ticket.Price.Currency, column[3])
 }
 
-func assertReceiptForTicketIssued(t *testing.T, receiptsService *app.ReceiptsServiceMock, ticket TicketStatus) {
+func assertReceiptForTicketIssued(t *testing.T, receiptsService *receipts.ServiceMock, ticket TicketStatus) {
 	assert.EventuallyWithT(
 		t,
 		func(collectT *assert.CollectT) {
@@ -156,7 +227,7 @@ func assertReceiptForTicketIssued(t *testing.T, receiptsService *app.ReceiptsSer
 		100*time.Millisecond,
 	)
 
-	var receipt app.Ticket
+	var receipt receipts.IssueReceiptRequest
 	var ok bool
 	for _, issuedReceipt := range receiptsService.IssuedReceipts {
 		if issuedReceipt.TicketID != ticket.TicketID {
@@ -169,7 +240,7 @@ func assertReceiptForTicketIssued(t *testing.T, receiptsService *app.ReceiptsSer
 	require.Truef(t, ok, "receipt for ticket %s not found", ticket.TicketID)
 
 	assert.Equal(t, ticket.TicketID, receipt.TicketID)
-	assert.Equal(t, ticket.Price.Amount, receipt.Price.Amount)
+	assert.Equal(t, money.MustParse(ticket.Price.Amount, ticket.Price.Currency).Amount(), receipt.Price.Amount)
 	assert.Equal(t, ticket.Price.Currency, receipt.Price.Currency)
 }
 
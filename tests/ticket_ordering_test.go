@@ -0,0 +1,165 @@
+package tests_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"tickets/app"
+	"tickets/app/api"
+	"tickets/app/money"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutOfOrderConfirmationAndCancellation(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	bus := a.Dependencies.EventBus
+
+	t.Run("cancellation_delivered_after_confirmation", func(t *testing.T) {
+		ticketID := uuid.NewString()
+		confirmedAt := time.Now().UTC()
+
+		publishConfirmed(t, bus, ticketID, confirmedAt)
+		assertTicketStored(t, ticketID, true)
+
+		publishCanceled(t, bus, ticketID, confirmedAt.Add(time.Minute))
+		assertTicketStored(t, ticketID, false)
+
+		// the canceled ticket is kept for refunds
+		ticket, ok := findTicket(t, ticketID, true)
+		require.True(t, ok)
+		assert.Equal(t, "canceled", ticket.Status)
+		require.NotNil(t, ticket.CanceledAt)
+		// Postgres keeps microseconds
+		assert.WithinDuration(t, confirmedAt.Add(time.Minute), *ticket.CanceledAt, time.Microsecond)
+		assert.Equal(t, "50.00", ticket.Price.Amount())
+	})
+
+	t.Run("stale_confirmation_delivered_after_cancellation", func(t *testing.T) {
+		ticketID := uuid.NewString()
+		confirmedAt := time.Now().UTC()
+
+		// each handler consumes its topic in order, so once the sentinel ticket is processed,
+		// the events published before it were processed too
+		sentinelID := uuid.NewString()
+		publishConfirmed(t, bus, sentinelID, confirmedAt)
+		assertTicketStored(t, sentinelID, true)
+
+		publishCanceled(t, bus, ticketID, confirmedAt.Add(time.Minute))
+		publishCanceled(t, bus, sentinelID, confirmedAt.Add(time.Minute))
+		assertTicketStored(t, sentinelID, false)
+
+		publishConfirmed(t, bus, ticketID, confirmedAt)
+		sentinelID = uuid.NewString()
+		publishConfirmed(t, bus, sentinelID, confirmedAt)
+		assertTicketStored(t, sentinelID, true)
+
+		assertTicketStored(t, ticketID, false)
+
+		// the late confirmation is stored as canceled
+		ticket, ok := findTicket(t, ticketID, true)
+		require.True(t, ok)
+		assert.Equal(t, "canceled", ticket.Status)
+	})
+
+	t.Run("confirmation_newer_than_cancellation", func(t *testing.T) {
+		ticketID := uuid.NewString()
+		canceledAt := time.Now().UTC()
+
+		sentinelID := uuid.NewString()
+		publishConfirmed(t, bus, sentinelID, canceledAt)
+		assertTicketStored(t, sentinelID, true)
+
+		publishCanceled(t, bus, ticketID, canceledAt)
+		publishCanceled(t, bus, sentinelID, canceledAt.Add(time.Minute))
+		assertTicketStored(t, sentinelID, false)
+
+		publishConfirmed(t, bus, ticketID, canceledAt.Add(time.Minute))
+		assertTicketStored(t, ticketID, true)
+	})
+}
+
+func newTicketEvent(ticketID string, status app.TicketStatus, publishedAt time.Time) *app.TicketEvent {
+	header := app.NewEventHeader(uuid.NewString(), uuid.NewString())
+	header.PublishedAt = publishedAt
+
+	return &app.TicketEvent{
+		Ticket: &app.Ticket{
+			TicketID:      ticketID,
+			Status:        status,
+			CustomerEmail: "customer@example.com",
+			Price:         money.MustParse("50.00", "EUR"),
+		},
+		Header: header,
+	}
+}
+
+func publishConfirmed(t *testing.T, bus eventPublisher, ticketID string, publishedAt time.Time) {
+	t.Helper()
+
+	err := bus.Publish(context.Background(), app.TicketBookingConfirmed{
+		TicketEvent: newTicketEvent(ticketID, app.TicketStatusConfirmed, publishedAt),
+	})
+	require.NoError(t, err)
+}
+
+func publishCanceled(t *testing.T, bus eventPublisher, ticketID string, publishedAt time.Time) {
+	t.Helper()
+
+	err := bus.Publish(context.Background(), app.TicketCanceledEvent{
+		TicketEvent: newTicketEvent(ticketID, app.TicketStatusCanceled, publishedAt),
+	})
+	require.NoError(t, err)
+}
+
+type eventPublisher interface {
+	Publish(ctx context.Context, event any) error
+}
+
+func assertTicketStored(t *testing.T, ticketID string, stored bool) {
+	t.Helper()
+
+	assert.EventuallyWithT(
+		t,
+		func(collectT *assert.CollectT) {
+			assert.Equal(collectT, stored, isTicketStored(collectT, ticketID))
+		},
+		10*time.Second,
+		100*time.Millisecond,
+	)
+}
+
+func isTicketStored(t assert.TestingT, ticketID string) bool {
+	ticket, ok := findTicket(t, ticketID, false)
+
+	return ok && assert.Equal(t, "confirmed", ticket.Status)
+}
+
+func findTicket(t assert.TestingT, ticketID string, includeCanceled bool) (api.TicketDTO, bool) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:8080/tickets?include_canceled=%t", includeCanceled))
+	if !assert.NoError(t, err) {
+		return api.TicketDTO{}, false
+	}
+	defer resp.Body.Close()
+
+	var tickets []api.TicketDTO
+	err = json.NewDecoder(resp.Body).Decode(&tickets)
+	if !assert.NoError(t, err) {
+		return api.TicketDTO{}, false
+	}
+
+	for _, ticket := range tickets {
+		if ticket.TicketID == ticketID {
+			return ticket, true
+		}
+	}
+
+	return api.TicketDTO{}, false
+}
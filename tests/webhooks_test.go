@@ -0,0 +1,97 @@
+package tests_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"tickets/app/webhooks"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDeliveriesLeaveOutPII(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	subscription, err := a.Dependencies.Webhooks.Subscribe(context.Background(), webhooks.SubscribeInput{
+		URL:    "https://webhooks.example.invalid/tickets",
+		Events: []string{"TicketBookingConfirmed"},
+		Secret: "secret",
+	})
+	require.NoError(t, err)
+
+	ticketID := uuid.NewString()
+	publishConfirmed(t, a.Dependencies.EventBus, ticketID, time.Now().UTC())
+
+	var delivery webhooks.Delivery
+	require.EventuallyWithT(t, func(collectT *assert.CollectT) {
+		deliveries, err := a.Dependencies.Webhooks.Deliveries(context.Background(), subscription.ID, 10)
+		if !assert.NoError(collectT, err) || !assert.Len(collectT, deliveries, 1) {
+			return
+		}
+		delivery = deliveries[0]
+	}, 10*time.Second, 100*time.Millisecond)
+
+	assert.NotContains(t, string(delivery.Payload), "customer@example.com")
+	assert.NotContains(t, string(delivery.Payload), "idempotency_key")
+
+	var body struct {
+		Event string `json:"event"`
+		Data  struct {
+			TicketID string `json:"ticket_id"`
+			Status   string `json:"status"`
+			Price    struct {
+				Amount   string `json:"amount"`
+				Currency string `json:"currency"`
+			} `json:"price"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(delivery.Payload, &body))
+	assert.Equal(t, "TicketBookingConfirmed", body.Event)
+	assert.Equal(t, ticketID, body.Data.TicketID)
+	assert.Equal(t, "confirmed", body.Data.Status)
+	assert.Equal(t, "50.00", body.Data.Price.Amount)
+}
+
+func TestWebhookSubscriptionsNeedAdminToken(t *testing.T) {
+	a := waitForHttpServer(t)
+	defer a.Cancel()
+
+	subscribe := func(token string, url string) int {
+		body, err := json.Marshal(map[string]any{
+			"url":    url,
+			"events": []string{"TicketBookingConfirmed"},
+			"secret": "secret",
+		})
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/webhooks", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, subscribe("", "https://webhooks.example.invalid/tickets"))
+	assert.Equal(t, http.StatusUnauthorized, subscribe("wrong", "https://webhooks.example.invalid/tickets"))
+
+	assert.Equal(t, http.StatusBadRequest, subscribe(adminToken, "http://127.0.0.1:8080/admin/poison"))
+	assert.Equal(t, http.StatusBadRequest, subscribe(adminToken, "http://169.254.169.254/latest/meta-data"))
+	assert.Equal(t, http.StatusBadRequest, subscribe(adminToken, "http://localhost/"))
+	assert.Equal(t, http.StatusBadRequest, subscribe(adminToken, "file:///etc/passwd"))
+
+	assert.Equal(t, http.StatusCreated, subscribe(adminToken, "https://webhooks.example.invalid/tickets"))
+}